@@ -170,7 +170,8 @@ func (buf hybiFrameReaderFactory) NewFrameReader() (frame frameReader, err error
 type hybiFrameWriter struct {
 	writer *bufio.Writer
 
-	header *hybiFrameHeader
+	header     *hybiFrameHeader
+	deferFlush bool
 }
 
 func (frame *hybiFrameWriter) Write(msg []byte) (n int, err error) {
@@ -222,12 +223,16 @@ func (frame *hybiFrameWriter) Write(msg []byte) (n int, err error) {
 			data = append(data, msg[i]^frame.header.MaskingKey[i%4])
 		}
 		frame.writer.Write(data)
-		err = frame.writer.Flush()
+		if !frame.deferFlush {
+			err = frame.writer.Flush()
+		}
 		return length, err
 	}
 	frame.writer.Write(header)
 	frame.writer.Write(msg)
-	err = frame.writer.Flush()
+	if !frame.deferFlush {
+		err = frame.writer.Flush()
+	}
 	return length, err
 }
 
@@ -236,6 +241,7 @@ func (frame *hybiFrameWriter) Close() error { return nil }
 type hybiFrameWriterFactory struct {
 	*bufio.Writer
 	needMaskingKey bool
+	conn           *Conn
 }
 
 func (buf hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (frame frameWriter, err error) {
@@ -246,7 +252,10 @@ func (buf hybiFrameWriterFactory) NewFrameWriter(payloadType byte) (frame frameW
 			return nil, err
 		}
 	}
-	return &hybiFrameWriter{writer: buf.Writer, header: frameHeader}, nil
+	// control frames always go out right away
+	deferFlush := buf.conn != nil && buf.conn.DeferFlush &&
+		(payloadType == TextFrame || payloadType == BinaryFrame)
+	return &hybiFrameWriter{writer: buf.Writer, header: frameHeader, deferFlush: deferFlush}, nil
 }
 
 type hybiFrameHandler struct {
@@ -281,7 +290,8 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 	case PingFrame:
 		pingMsg := make([]byte, maxControlFramePayloadLength)
 		n, err := io.ReadFull(frame, pingMsg)
-		if err != nil && err != io.ErrUnexpectedEOF {
+		// an empty ping reads as EOF
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
 			return nil, err
 		}
 		io.Copy(ioutil.Discard, frame)
@@ -291,7 +301,11 @@ func (handler *hybiFrameHandler) HandleFrame(frame frameReader) (r frameReader,
 		}
 		return nil, nil
 	case PongFrame:
-		return nil, ErrNotImplemented
+		io.Copy(ioutil.Discard, frame)
+		if handler.conn.PongHandler != nil {
+			handler.conn.PongHandler()
+		}
+		return nil, nil
 	}
 	return frame, nil
 }
@@ -310,6 +324,18 @@ func (handler *hybiFrameHandler) WriteClose(status int) (err error) {
 	return err
 }
 
+func (handler *hybiFrameHandler) WritePing(msg []byte) (n int, err error) {
+	handler.conn.wio.Lock()
+	defer handler.conn.wio.Unlock()
+	w, err := handler.conn.frameWriterFactory.NewFrameWriter(PingFrame)
+	if err != nil {
+		return 0, err
+	}
+	n, err = w.Write(msg)
+	w.Close()
+	return n, err
+}
+
 func (handler *hybiFrameHandler) WritePong(msg []byte) (n int, err error) {
 	handler.conn.wio.Lock()
 	defer handler.conn.wio.Unlock()
@@ -331,10 +357,9 @@ func newHybiConn(config *Config, buf *bufio.ReadWriter, rwc io.ReadWriteCloser,
 	}
 	ws := &Conn{config: config, request: request, buf: buf, rwc: rwc,
 		frameReaderFactory: hybiFrameReaderFactory{buf.Reader},
-		frameWriterFactory: hybiFrameWriterFactory{
-			buf.Writer, request == nil},
 		PayloadType:        TextFrame,
 		defaultCloseStatus: closeStatusNormal}
+	ws.frameWriterFactory = hybiFrameWriterFactory{buf.Writer, request == nil, ws}
 	ws.frameHandler = &hybiFrameHandler{conn: ws}
 	return ws
 }
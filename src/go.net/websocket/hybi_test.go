@@ -274,7 +274,7 @@ Sec-WebSocket-Version: 9
 
 func testHybiFrame(t *testing.T, testHeader, testPayload, testMaskedPayload []byte, frameHeader *hybiFrameHeader) {
 	b := bytes.NewBuffer([]byte{})
-	frameWriterFactory := &hybiFrameWriterFactory{bufio.NewWriter(b), false}
+	frameWriterFactory := &hybiFrameWriterFactory{bufio.NewWriter(b), false, nil}
 	w, _ := frameWriterFactory.NewFrameWriter(TextFrame)
 	w.(*hybiFrameWriter).header = frameHeader
 	_, err := w.Write(testPayload)
@@ -419,6 +419,29 @@ func TestHybiClientRead(t *testing.T) {
 	}
 }
 
+func TestHybiClientReadPongAndEmptyPing(t *testing.T) {
+	wireData := []byte{0x8A, 0x05, 'h', 'e', 'l', 'l', 'o', // pong
+		0x89, 0x00, // empty ping
+		0x81, 0x05, 'w', 'o', 'r', 'l', 'd'}
+	br := bufio.NewReader(bytes.NewBuffer(wireData))
+	bw := bufio.NewWriter(bytes.NewBuffer([]byte{}))
+	conn := newHybiConn(newConfig(t, "/"), bufio.NewReadWriter(br, bw), nil, nil)
+	pongs := 0
+	conn.PongHandler = func() { pongs++ }
+
+	msg := make([]byte, 512)
+	n, err := conn.Read(msg)
+	if err != nil {
+		t.Errorf("read past pong, error %q", err)
+	}
+	if !bytes.Equal(wireData[11:16], msg[:n]) {
+		t.Errorf("read past pong %v, got %v", wireData[11:16], msg[:n])
+	}
+	if pongs != 1 {
+		t.Errorf("expect 1 pong, got %d", pongs)
+	}
+}
+
 func TestHybiShortRead(t *testing.T) {
 	wireData := []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o',
 		0x89, 0x05, 'h', 'e', 'l', 'l', 'o', // ping
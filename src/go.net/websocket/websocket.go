@@ -162,6 +162,16 @@ type Conn struct {
 	frameHandler
 	PayloadType        byte
 	defaultCloseStatus int
+
+	// If DeferFlush is set, data frames written to a hybi connection stay
+	// in the write buffer until it fills up, Flush is called or a control
+	// frame is written. It must be set before the connection is used,
+	// as the reader looks at it when it answers pings.
+	DeferFlush bool
+
+	// If PongHandler is set, Read calls it for every pong frame it
+	// reads. Pongs are otherwise skipped.
+	PongHandler func()
 }
 
 // Read implements the io.Reader interface:
@@ -216,19 +226,36 @@ func (ws *Conn) Write(msg []byte) (n int, err error) {
 
 // Close implements the io.Closer interface.
 func (ws *Conn) Close() error {
-	err := ws.frameHandler.WriteClose(ws.defaultCloseStatus)
-	if err != nil {
-		return err
-	}
-	return ws.rwc.Close()
+	return ws.CloseWithStatus(ws.defaultCloseStatus)
 }
 
+// CloseWithStatus is Close with a status other than the default. The
+// connection is closed even if the close frame can't be written, so
+// that a reader blocked on it always gets an error.
 func (ws *Conn) CloseWithStatus(status int) error {
-    err := ws.frameHandler.WriteClose(status)
-    if err != nil {
-        return err
-    }
-    return ws.rwc.Close()
+	err := ws.frameHandler.WriteClose(status)
+	if closeErr := ws.rwc.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// WritePing sends a ping frame with payload msg, which the peer should
+// answer with a pong. Only hybi connections can send pings.
+func (ws *Conn) WritePing(msg []byte) error {
+	handler, ok := ws.frameHandler.(*hybiFrameHandler)
+	if !ok {
+		return ErrNotSupported
+	}
+	_, err := handler.WritePing(msg)
+	return err
+}
+
+// Flush writes any buffered frames to the underlying connection.
+func (ws *Conn) Flush() error {
+	ws.wio.Lock()
+	defer ws.wio.Unlock()
+	return ws.buf.Flush()
 }
 
 func (ws *Conn) IsClientConn() bool { return ws.request == nil }
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Check the request carries the configured admin token, replying with
+// an error if it doesn't
+func adminAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if gServerConfig.AdminToken == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Admin actions are disabled."))
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(gServerConfig.AdminToken)) != 1 {
+		log.Println("Unauthorized admin request from ", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized."))
+		return false
+	}
+	return true
+}
+
+// Check the request carries the configured notify token, if there is
+// one, replying with an error if it doesn't
+func notifyAuthorized(w http.ResponseWriter, r *http.Request) bool {
+	if gServerConfig.NotifyToken == "" {
+		return true
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(gServerConfig.NotifyToken)) != 1 {
+		log.Println("Unauthorized notify from ", r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized."))
+		return false
+	}
+	return true
+}
+
+func requirePost(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method must be POST."))
+		return false
+	}
+	return true
+}
+
+// Save the server state right now
+func adminFlush(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "flush")
+	if err := saveState(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not save state: " + err.Error()))
+		return
+	}
+
+	w.Write([]byte("OK"))
+}
+
+// Kick the client with the "uaid" form value off, closing its websocket.
+// With "deleteChannels" set to "true", its channels go too, and it
+// starts over with a new UAID when it comes back.
+func adminEvict(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	uaid := r.FormValue("uaid")
+	if uaid == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Missing uaid."))
+		return
+	}
+	deleteChannels := r.FormValue("deleteChannels") == "true"
+
+	audit("admin@"+r.RemoteAddr, "evict", uaid)
+	connected := disconnectClient(uaid, closeEvicted, true)
+
+	gServerState.Lock()
+	channels, known := gServerState.UAIDToChannelIDs[uaid]
+	deleted := 0
+	if deleteChannels && known {
+		deleted = len(channels)
+		gServerState.removeUAID(uaid)
+	}
+	gServerState.Unlock()
+
+	if !connected && !known {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Could not find UAID."))
+		return
+	}
+	if deleted > 0 {
+		markStateDirty()
+	}
+	log.Println("Evicted ", uaid, ", deleting ", deleted, " channels")
+
+	j, err := json.Marshal(struct {
+		UAID            string `json:"uaid"`
+		Connected       bool   `json:"connected"`
+		DeletedChannels int    `json:"deletedChannels"`
+	}{uaid, connected, deleted})
+	if err != nil {
+		log.Println("Could not convert evict response to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// Stop delivering notifications, while still accepting them
+func adminPause(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "pause")
+	log.Println("Delivery paused")
+	setDeliveryPaused(true)
+	w.Write([]byte("OK"))
+}
+
+// Deliver everything that piled up while paused, and carry on as usual
+func adminResume(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "resume")
+	log.Println("Delivery resumed")
+	setDeliveryPaused(false)
+	w.Write([]byte("OK"))
+}
+
+// Ask the delivery loop for its pending notifications, replying with
+// an error if it doesn't answer
+func requestPendingDump(w http.ResponseWriter) ([]pendingInfo, bool) {
+	reply := make(chan []pendingInfo, 1)
+	timer := time.NewTimer(5 * time.Second)
+	defer timer.Stop()
+	select {
+	case pendingDumps <- reply:
+		return <-reply, true
+	case <-timer.C:
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("The delivery loop did not answer."))
+		return nil, false
+	}
+}
+
+// Dump the delivery loop's pending notifications, at GET /admin/pending
+func adminPending(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+
+	dump, ok := requestPendingDump(w)
+	if !ok {
+		return
+	}
+
+	j, err := json.Marshal(dump)
+	if err != nil {
+		log.Println("Could not convert pending notifications to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// The users, channels and memory use of the admin page, as JSON. The
+// page itself also answers with this when asked for application/json.
+func adminAPI(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+
+	j, err := json.Marshal(snapshotAdminOverview())
+	if err != nil {
+		log.Println("Could not convert admin overview to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// Everything known about one channel, at GET /admin/channel/{channelID}
+func adminChannel(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+
+	channelID := strings.TrimPrefix(r.URL.Path, "/admin/channel/")
+	gServerState.RLock()
+	_, ok := gServerState.ChannelIDToChannel[channelID]
+	gServerState.RUnlock()
+	if channelID == "" || !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Could not find channel."))
+		return
+	}
+
+	// asked before taking the lock, which the delivery loop may be
+	// waiting on
+	dump, ok := requestPendingDump(w)
+	if !ok {
+		return
+	}
+
+	type ChannelInfo struct {
+		ChannelID    string         `json:"channelID"`
+		UAID         string         `json:"uaid"`
+		Version      uint64         `json:"version"`
+		AckedVersion uint64         `json:"ackedVersion"`
+		Data         string         `json:"data,omitempty"`
+		PushEndpoint string         `json:"pushEndpoint"`
+		Online       bool           `json:"online"`
+		Wakeable     bool           `json:"wakeable"`
+		Topics       []string       `json:"topics"`
+		Strict       bool           `json:"strict"`
+		Interval     float64        `json:"interval,omitempty"`
+		History      []HistoryEntry `json:"history"`
+		Pending      []pendingInfo  `json:"pending"`
+	}
+
+	gServerState.RLock()
+	channel, ok := gServerState.ChannelIDToChannel[channelID]
+	if !ok {
+		gServerState.RUnlock()
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Could not find channel."))
+		return
+	}
+	info := ChannelInfo{
+		ChannelID:    channel.ChannelID,
+		UAID:         channel.UAID,
+		Version:      channel.Version,
+		AckedVersion: channel.Acked,
+		Data:         channel.Data,
+		PushEndpoint: makeNotifyURL("", channel.ChannelID),
+		Topics:       []string{},
+		Strict:       gServerState.StrictChannels[channelID],
+		Interval:     gServerState.MinNotifyIntervals[channelID],
+		History:      append([]HistoryEntry{}, gServerState.History[channelID]...),
+		Pending:      []pendingInfo{},
+	}
+	if client, ok := gServerState.ConnectedClients[channel.UAID]; ok {
+		info.Online = client.online()
+		info.Wakeable = client.Ip != ""
+	}
+	for topic, uaids := range gServerState.TopicToUAIDs {
+		if uaids[channel.UAID] {
+			info.Topics = append(info.Topics, topic)
+		}
+	}
+	gServerState.RUnlock()
+	sort.Strings(info.Topics)
+	for _, pending := range dump {
+		if pending.ChannelID == channelID {
+			info.Pending = append(info.Pending, pending)
+		}
+	}
+
+	j, err := json.Marshal(info)
+	if err != nil {
+		log.Println("Could not convert channel info to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"encoding/json"
+	"go.net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(method, url, token string) *http.Request {
+	r := httptest.NewRequest(method, url, nil)
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	return r
+}
+
+func TestAdminFlush(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	addTestChannel("uaid", "chan", 1)
+
+	w := httptest.NewRecorder()
+	adminFlush(w, adminRequest("POST", "/admin/flush", "wrong"))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong token got status %d, want 401", w.Code)
+	}
+	if _, err := os.Stat("serverstate.json"); err == nil {
+		t.Fatalf("unauthorized flush wrote the state")
+	}
+
+	w = httptest.NewRecorder()
+	adminFlush(w, adminRequest("POST", "/admin/flush", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("flush got status %d: %s", w.Code, w.Body.String())
+	}
+	if _, err := os.Stat("serverstate.json"); err != nil {
+		t.Fatalf("flush did not write the state: %s", err)
+	}
+
+	// make the write fail
+	os.Remove("serverstate.json")
+	os.Mkdir("serverstate.json", 0755)
+	w = httptest.NewRecorder()
+	adminFlush(w, adminRequest("POST", "/admin/flush", "secret"))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("failed flush got status %d, want 500", w.Code)
+	}
+}
+
+func TestPausedDeliveryQueues(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	channel := addTestChannel("uaid", "chan", 1)
+	client := newClient(&websocket.Conn{})
+	client.UAID = "uaid"
+	gServerState.ConnectedClients["uaid"] = client
+
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	defer setDeliveryPaused(false)
+
+	adminPause(httptest.NewRecorder(), adminRequest("POST", "/admin/pause", "secret"))
+	notifications <- Notification{UAID: "uaid", Channel: channel}
+	select {
+	case msg := <-client.outgoing:
+		t.Fatalf("paused delivery sent %s", msg)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	adminResume(httptest.NewRecorder(), adminRequest("POST", "/admin/resume", "secret"))
+	select {
+	case <-client.outgoing:
+	case <-time.After(time.Second):
+		t.Fatalf("queued notification was not delivered on resume")
+	}
+}
+
+func TestAdminChannel(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	gServerConfig.Hostname = "push.example.com"
+	gServerConfig.Port = "8080"
+	addTestChannel("uaid", "chan", 4)
+	client := newClient(&websocket.Conn{})
+	client.Ip = "10.0.0.1"
+	gServerState.ConnectedClients["uaid"] = client
+	gServerState.subscribe("uaid", "announcements")
+
+	w := httptest.NewRecorder()
+	adminChannel(w, adminRequest("GET", "/admin/channel/chan", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("channel info without a token got status %d, want 401", w.Code)
+	}
+
+	notifications := make(chan Notification)
+	pendingDumps = make(chan chan []pendingInfo)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	recordAcks("uaid", []Ack{{ChannelID: "chan", Version: 4}})
+	notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: 5}}
+	// the loop has taken it once it answers
+	reply := make(chan []pendingInfo, 1)
+	pendingDumps <- reply
+	<-reply
+
+	gServerState.Lock()
+	channel := gServerState.ChannelIDToChannel["chan"]
+	channel.Version, channel.Data = 5, "payload"
+	gServerState.StrictChannels["chan"] = true
+	gServerState.MinNotifyIntervals["chan"] = 30
+	when := time.Date(2014, 1, 2, 3, 4, 5, 0, time.UTC)
+	gServerState.History["chan"] = []HistoryEntry{{4, when}, {5, when}}
+	gServerState.Unlock()
+	// somebody else's ack doesn't count
+	recordAcks("other", []Ack{{ChannelID: "chan", Version: 5}})
+
+	w = httptest.NewRecorder()
+	adminChannel(w, adminRequest("GET", "/admin/channel/chan", "secret"))
+	var info struct {
+		ChannelID    string
+		UAID         string
+		Version      uint64
+		AckedVersion uint64
+		Data         string
+		PushEndpoint string
+		Online       bool
+		Wakeable     bool
+		Topics       []string
+		Strict       bool
+		Interval     float64
+		History      []HistoryEntry
+		Pending      []pendingInfo
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &info); w.Code != http.StatusOK || err != nil {
+		t.Fatalf("channel info got %d %s", w.Code, w.Body.String())
+	}
+	if info.ChannelID != "chan" || info.UAID != "uaid" || info.Version != 5 || info.AckedVersion != 4 ||
+		info.Data != "payload" || info.PushEndpoint != "http://push.example.com:8080/notify/chan" ||
+		!info.Online || !info.Wakeable || len(info.Topics) != 1 || info.Topics[0] != "announcements" {
+		t.Fatalf("channel info got %s", w.Body.String())
+	}
+	if !info.Strict || info.Interval != 30 || len(info.History) != 2 || !info.History[1].Time.Equal(when) {
+		t.Fatalf("channel info got delivery settings %s", w.Body.String())
+	}
+	if len(info.Pending) != 1 || info.Pending[0].Version != 5 {
+		t.Fatalf("channel info got pending %+v, want version 5", info.Pending)
+	}
+
+	w = httptest.NewRecorder()
+	adminChannel(w, adminRequest("GET", "/admin/channel/missing", "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown channel got status %d", w.Code)
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	addTestChannel("uaid", "b", 2)
+	addTestChannel("uaid", "a", 1)
+	addTestChannel("other", "c", 3)
+	gServerState.ConnectedClients["uaid"] = newClient(&websocket.Conn{})
+	gServerState.subscribe("uaid", "announcements")
+
+	w := httptest.NewRecorder()
+	adminAPI(w, adminRequest("GET", "/admin/api", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("admin api without a token got status %d, want 401", w.Code)
+	}
+
+	// the admin page answers with the same when asked for JSON
+	r := adminRequest("GET", "/admin", "secret")
+	r.Header.Set("Accept", "application/json")
+	w = httptest.NewRecorder()
+	admin(w, r)
+
+	var overview struct {
+		TotalMemory uint64 `json:"totalMemory"`
+		Users       []struct {
+			UAID      string    `json:"uaid"`
+			Connected bool      `json:"connected"`
+			Topics    []string  `json:"topics"`
+			Channels  []Channel `json:"channels"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &overview); err != nil {
+		t.Fatalf("admin api sent %q: %v", w.Body.String(), err)
+	}
+	if w.Header().Get("Content-Type") != "application/json" || overview.TotalMemory == 0 || len(overview.Users) != 2 {
+		t.Fatalf("admin api sent %s", w.Body.String())
+	}
+
+	other, user := overview.Users[0], overview.Users[1]
+	if other.UAID != "other" || other.Connected || len(other.Topics) != 0 || len(other.Channels) != 1 {
+		t.Fatalf("admin api sent %+v for other", other)
+	}
+	if user.UAID != "uaid" || !user.Connected || len(user.Topics) != 1 || user.Topics[0] != "announcements" ||
+		len(user.Channels) != 2 || user.Channels[0].ChannelID != "a" || user.Channels[1].Version != 2 {
+		t.Fatalf("admin api sent %+v for uaid", user)
+	}
+}
+
+func TestAdminShowsRemoteAddress(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+	exchange(t, ws, map[string]interface{}{"messageType": "hello", "uaid": "uaid",
+		"wakeup_hostport": map[string]interface{}{"ip": "127.0.0.1", "port": 9.0}})
+	gServerState.Lock()
+	addTestChannel("uaid", "chan", 1)
+	gServerState.Unlock()
+
+	w := httptest.NewRecorder()
+	adminAPI(w, adminRequest("GET", "/admin/api", "secret"))
+	var overview struct {
+		Users []struct {
+			RemoteAddr string `json:"remoteAddr"`
+			WakeupAddr string `json:"wakeupAddr"`
+		} `json:"users"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &overview); err != nil || len(overview.Users) != 1 {
+		t.Fatalf("admin api sent %q: %v", w.Body.String(), err)
+	}
+	if user := overview.Users[0]; !strings.HasPrefix(user.RemoteAddr, "127.0.0.1:") || user.WakeupAddr != "127.0.0.1:9" {
+		t.Fatalf("admin api sent %+v", user)
+	}
+}
+
+func TestAdminEvict(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+	if status := hello(t, ws, "uaid"); status != 200 {
+		t.Fatalf("hello got status %g", status)
+	}
+	gServerState.Lock()
+	addTestChannel("uaid", "chan", 1)
+	gServerState.Unlock()
+
+	w := httptest.NewRecorder()
+	adminEvict(w, adminRequest("POST", "/admin/evict?uaid=uaid", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("evict without a token got status %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	adminEvict(w, adminRequest("POST", "/admin/evict?uaid=uaid&deleteChannels=true", "secret"))
+	if want := `{"uaid":"uaid","connected":true,"deletedChannels":1}`; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Fatalf("evict got %d %s", w.Code, w.Body.String())
+	}
+	if !isClosed(ws) {
+		t.Fatalf("evicted client is still connected")
+	}
+	gServerState.RLock()
+	_, connected := gServerState.ConnectedClients["uaid"]
+	_, registered := gServerState.ChannelIDToChannel["chan"]
+	gServerState.RUnlock()
+	if connected || registered {
+		t.Fatalf("evicted client left behind connected %v, registered %v", connected, registered)
+	}
+
+	// nothing left to evict
+	w = httptest.NewRecorder()
+	adminEvict(w, adminRequest("POST", "/admin/evict?uaid=uaid", "secret"))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("evicting an unknown UAID got status %d, want 404", w.Code)
+	}
+}
+
+func TestAdminPendingDumpsUndelivered(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	// so that it's still on its first attempt when it's dumped
+	gServerConfig.RedeliveryBackoff = 60
+	addTestChannel("uaid", "chan", 3)
+	notifications := make(chan Notification)
+	pendingDumps = make(chan chan []pendingInfo)
+	startTestDelivery(t, notifications, make(chan []Ack))
+
+	// nobody is connected to take it
+	notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: 3}}
+
+	w := httptest.NewRecorder()
+	adminPending(w, adminRequest("GET", "/admin/pending", ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("pending dump without a token got status %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	adminPending(w, adminRequest("GET", "/admin/pending", "secret"))
+	var dump []pendingInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &dump); err != nil {
+		t.Fatalf("bad dump %q: %v", w.Body.String(), err)
+	}
+	if len(dump) != 1 {
+		t.Fatalf("dump is %s, want the one pending notification", w.Body.String())
+	}
+	info := dump[0]
+	if info.ChannelID != "chan" || info.UAID != "uaid" || info.Version != 3 || info.Attempts != 1 {
+		t.Fatalf("dumped %+v", info)
+	}
+	if info.Age < 0 || info.Age > 5 {
+		t.Fatalf("notification is %g seconds old", info.Age)
+	}
+	if info.NextAttempt == nil || info.NextAttempt.Before(time.Now()) ||
+		info.NextAttempt.After(time.Now().Add(redeliveryBackoff(1))) {
+		t.Fatalf("next attempt at %v, want within the redelivery backoff", info.NextAttempt)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The audit log records every change to the server state: who did it,
+// what they did, to what, and when. Records are written by their own
+// goroutine from a bounded buffer, so auditing never holds up a handler;
+// if the buffer fills up, records are dropped and counted.
+
+type auditRecord struct {
+	Time      time.Time `json:"time"`
+	Actor     string    `json:"actor"`
+	Operation string    `json:"op"`
+	Targets   []string  `json:"targets,omitempty"`
+}
+
+const auditBufferSize = 1024
+
+var auditQueue chan auditRecord
+var auditDone chan bool
+
+// Guards auditQueue, which stopAudit closes while handlers may still
+// be auditing. Sends never block, so they only hold the read lock
+// briefly.
+var auditLock sync.RWMutex
+
+var auditDropped = newCounter("push_audit_dropped_total",
+	"Audit records dropped because the buffer was full")
+
+func startAudit() {
+	if gServerConfig.AuditLog == "" {
+		return
+	}
+
+	file, err := os.OpenFile(gServerConfig.AuditLog, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		log.Println("Could not open audit log ", err)
+		os.Exit(-1)
+	}
+
+	auditLock.Lock()
+	auditQueue = make(chan auditRecord, auditBufferSize)
+	auditDone = make(chan bool)
+	go auditWriter(file, auditQueue)
+	auditLock.Unlock()
+}
+
+// Write out the records still buffered and stop auditing. Records
+// audited after this are dropped.
+func stopAudit() {
+	auditLock.Lock()
+	queue, done := auditQueue, auditDone
+	auditQueue = nil
+	if queue != nil {
+		close(queue)
+	}
+	auditLock.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+func audit(actor, operation string, targets ...string) {
+	auditLock.RLock()
+	defer auditLock.RUnlock()
+	if auditQueue == nil {
+		return
+	}
+
+	select {
+	case auditQueue <- auditRecord{time.Now().UTC(), actor, operation, targets}:
+	default:
+		auditDropped.Inc()
+	}
+}
+
+func auditWriter(file *os.File, queue chan auditRecord) {
+	for record := range queue {
+		var line []byte
+		if gServerConfig.AuditFormat == "text" {
+			line = []byte(fmt.Sprintf("%s %s %s %s\n", record.Time.Format(time.RFC3339),
+				record.Actor, record.Operation, strings.Join(record.Targets, ",")))
+		} else {
+			j, err := json.Marshal(record)
+			if err != nil {
+				log.Println("Could not convert audit record to json ", err)
+				continue
+			}
+			line = append(j, '\n')
+		}
+
+		if _, err := file.Write(line); err != nil {
+			log.Println("Could not write audit record ", err)
+		}
+	}
+
+	file.Close()
+	close(auditDone)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestRegisterAndUnregisterAreAudited(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AuditLog = "audit.log"
+	startAudit()
+
+	client := newClient(nil)
+	client.UAID = "uaid"
+	handleRegister(client, map[string]interface{}{"channelID": "chan"})
+	handleUnregister(client, map[string]interface{}{"channelID": "chan"})
+	stopAudit()
+
+	data, err := ioutil.ReadFile("audit.log")
+	if err != nil {
+		t.Fatalf("ReadFile error %s", err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("got %d audit records, want 2:\n%s", len(lines), data)
+	}
+
+	for i, op := range []string{"register", "unregister"} {
+		var record auditRecord
+		if err := json.Unmarshal([]byte(lines[i]), &record); err != nil {
+			t.Fatalf("could not parse audit record %q: %s", lines[i], err)
+		}
+		if record.Actor != "uaid" || record.Operation != op ||
+			len(record.Targets) != 1 || record.Targets[0] != "chan" || record.Time.IsZero() {
+			t.Fatalf("unexpected audit record %+v for %s", record, op)
+		}
+	}
+}
+
+func TestAuditingDuringStopIsSafe(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AuditLog = "audit.log"
+	startAudit()
+
+	var auditors sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		auditors.Add(1)
+		go func() {
+			defer auditors.Done()
+			for j := 0; j < 100; j++ {
+				audit("uaid", "register", "chan")
+			}
+		}()
+	}
+	stopAudit()
+	auditors.Wait()
+
+	// and after it, auditing does nothing
+	audit("uaid", "unregister", "chan")
+	stopAudit()
+}
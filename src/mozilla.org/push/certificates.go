@@ -0,0 +1,102 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// One server can answer to several hostnames, each with its own
+// certificate. The certificate is picked by the name the client asks
+// for during the TLS handshake (SNI), falling back to CertFilename and
+// KeyFilename for any other name.
+
+type CertificateFiles struct {
+	CertFilename string `json:"certFilename"`
+	KeyFilename  string `json:"keyFilename"`
+}
+
+func loadCertificates() (*tls.Config, error) {
+	fallback, err := tls.LoadX509KeyPair(gServerConfig.CertFilename, gServerConfig.KeyFilename)
+	if err != nil {
+		return nil, err
+	}
+
+	byName := make(map[string]*tls.Certificate)
+	for name, files := range gServerConfig.Certificates {
+		cert, err := tls.LoadX509KeyPair(files.CertFilename, files.KeyFilename)
+		if err != nil {
+			return nil, err
+		}
+		byName[strings.ToLower(name)] = &cert
+	}
+
+	getCertificate := func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		if cert, ok := byName[strings.ToLower(hello.ServerName)]; ok {
+			return cert, nil
+		}
+		return &fallback, nil
+	}
+	config := &tls.Config{GetCertificate: getCertificate}
+	if err := configureTLS(config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// Apply TLSMinVersion, CipherSuites and PreferServerCiphers to config.
+// Connections need TLS 1.2 unless TLSMinVersion says otherwise. Cipher
+// suites are named as in crypto/tls, and only the ones it considers
+// secure can be picked; TLS 1.3 always uses its own.
+func configureTLS(config *tls.Config) error {
+	config.MinVersion = tls.VersionTLS12
+	if gServerConfig.TLSMinVersion != "" {
+		version, ok := tlsVersions[gServerConfig.TLSMinVersion]
+		if !ok {
+			return fmt.Errorf("unknown tlsMinVersion %q", gServerConfig.TLSMinVersion)
+		}
+		config.MinVersion = version
+	}
+
+	if len(gServerConfig.CipherSuites) > 0 {
+		byName := make(map[string]uint16)
+		for _, suite := range tls.CipherSuites() {
+			byName[suite.Name] = suite.ID
+		}
+		config.CipherSuites = nil
+		for _, name := range gServerConfig.CipherSuites {
+			id, ok := byName[name]
+			if !ok {
+				return fmt.Errorf("unknown or insecure cipher suite %q", name)
+			}
+			config.CipherSuites = append(config.CipherSuites, id)
+		}
+	}
+
+	config.PreferServerCipherSuites = gServerConfig.PreferServerCiphers
+	return nil
+}
+
+// The host to put in notify URLs handed out over a connection made to
+// requestHost. The Host header is up to the client, so it is only used
+// if it's one of the names we have a certificate for.
+func notifyHost(requestHost string) string {
+	name := requestHost
+	if host, _, err := net.SplitHostPort(requestHost); err == nil {
+		name = host
+	}
+	for configured := range gServerConfig.Certificates {
+		if strings.EqualFold(configured, name) {
+			return configured
+		}
+	}
+	return gServerConfig.Hostname
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"testing"
+	"time"
+)
+
+// Write a self-signed certificate for name, returning its files
+func writeTestCertificate(t *testing.T, name string) CertificateFiles {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files := CertificateFiles{name + ".crt", name + ".key"}
+	ioutil.WriteFile(files.CertFilename, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(files.KeyFilename, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return files
+}
+
+func TestCertificatesAreChosenBySNI(t *testing.T) {
+	setupTest(t)
+	fallback := writeTestCertificate(t, "push.example.com")
+	gServerConfig.CertFilename = fallback.CertFilename
+	gServerConfig.KeyFilename = fallback.KeyFilename
+	gServerConfig.Certificates = map[string]CertificateFiles{
+		"a.example.com": writeTestCertificate(t, "a.example.com"),
+		"b.example.com": writeTestCertificate(t, "b.example.com"),
+	}
+
+	config, err := loadCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for serverName, want := range map[string]string{
+		"a.example.com":     "a.example.com",
+		"B.example.com":     "b.example.com",
+		"other.example.com": "push.example.com",
+		"":                  "push.example.com",
+	} {
+		cert, err := config.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if leaf.Subject.CommonName != want {
+			t.Fatalf("%q got the certificate for %s, want %s", serverName, leaf.Subject.CommonName, want)
+		}
+	}
+}
+
+func TestNotifyHostIsOnlyAConfiguredName(t *testing.T) {
+	setupTest(t)
+	gServerConfig.Hostname = "push.example.com"
+	gServerConfig.Certificates = map[string]CertificateFiles{"a.example.com": {}}
+
+	for requestHost, want := range map[string]string{
+		"a.example.com:8080":    "a.example.com",
+		"A.example.com":         "a.example.com",
+		"evil.example.com:8080": "push.example.com",
+	} {
+		if host := notifyHost(requestHost); host != want {
+			t.Fatalf("notify host for %s is %s, want %s", requestHost, host, want)
+		}
+	}
+}
+
+func TestTLSSettings(t *testing.T) {
+	setupTest(t)
+	files := writeTestCertificate(t, "push.example.com")
+	gServerConfig.CertFilename = files.CertFilename
+	gServerConfig.KeyFilename = files.KeyFilename
+
+	config, err := loadCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS12 || config.CipherSuites != nil {
+		t.Fatalf("default TLS config has min version %x, cipher suites %v", config.MinVersion, config.CipherSuites)
+	}
+
+	gServerConfig.TLSMinVersion = "1.3"
+	gServerConfig.CipherSuites = []string{"TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"}
+	gServerConfig.PreferServerCiphers = true
+	config, err = loadCertificates()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.MinVersion != tls.VersionTLS13 || len(config.CipherSuites) != 1 ||
+		config.CipherSuites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 || !config.PreferServerCipherSuites {
+		t.Fatalf("TLS config has min version %x, cipher suites %v", config.MinVersion, config.CipherSuites)
+	}
+
+	for _, bad := range []struct{ version, suite string }{
+		{"1.4", "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256"},
+		{"1.2", "TLS_RSA_WITH_RC4_128_SHA"},
+		{"1.2", "AES"},
+	} {
+		gServerConfig.TLSMinVersion = bad.version
+		gServerConfig.CipherSuites = []string{bad.suite}
+		if _, err := loadCertificates(); err == nil {
+			t.Fatalf("accepted TLS version %q with cipher suite %q", bad.version, bad.suite)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Each instance owns the UAIDs that hash closest to one of its points
+// on the ring. Giving every instance many points keeps the load even,
+// and means that adding or removing an instance only moves the UAIDs
+// next to its points.
+
+const ringPointsPerPeer = 100
+
+type hashRing struct {
+	points []uint32
+	owners map[uint32]string
+}
+
+func newHashRing(peers []string) *hashRing {
+	ring := &hashRing{owners: make(map[uint32]string)}
+	for _, peer := range peers {
+		for i := 0; i < ringPointsPerPeer; i++ {
+			point := crc32.ChecksumIEEE([]byte(peer + "#" + strconv.Itoa(i)))
+			ring.points = append(ring.points, point)
+			ring.owners[point] = peer
+		}
+	}
+	sort.Slice(ring.points, func(i, j int) bool { return ring.points[i] < ring.points[j] })
+	return ring
+}
+
+// The peer owning key, or "" if the ring is empty
+func (ring *hashRing) owner(key string) string {
+	if len(ring.points) == 0 {
+		return ""
+	}
+	hash := crc32.ChecksumIEEE([]byte(key))
+	i := sort.Search(len(ring.points), func(i int) bool { return ring.points[i] >= hash })
+	if i == len(ring.points) {
+		i = 0
+	}
+	return ring.owners[ring.points[i]]
+}
+
+var gRing struct {
+	sync.RWMutex
+	*hashRing
+}
+
+// Replace the cluster membership
+func setPeers(peers []string) {
+	ring := newHashRing(peers)
+	gRing.Lock()
+	gRing.hashRing = ring
+	gRing.Unlock()
+	log.Println("Cluster peers are now ", peers)
+}
+
+func ownerOf(uaid string) string {
+	gRing.RLock()
+	defer gRing.RUnlock()
+	if gRing.hashRing == nil {
+		return ""
+	}
+	return gRing.owner(uaid)
+}
+
+// Marks requests that were already forwarded, so they are never bounced again
+const forwardedHeader = "X-Push-Forwarded"
+
+// If uaid isn't connected here and belongs to another instance, pass
+// the request on to that instance and relay its response. Returns
+// whether the request was answered, which it also is when the body is
+// too large to forward.
+func forwardToOwner(w http.ResponseWriter, r *http.Request, uaid string) bool {
+	if r.Header.Get(forwardedHeader) != "" {
+		return false
+	}
+	gServerState.RLock()
+	client, ok := gServerState.ConnectedClients[uaid]
+	online := ok && client.online()
+	gServerState.RUnlock()
+	if online {
+		return false
+	}
+	owner := ownerOf(uaid)
+	if owner == "" || owner == gServerConfig.SelfURL {
+		return false
+	}
+
+	// keep the body around in case we end up handling this ourselves
+	body, err := ioutil.ReadAll(r.Body)
+	var tooLarge *http.MaxBytesError
+	if errors.As(err, &tooLarge) {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Could not read the body; it may be too large."))
+		return true
+	} else if err != nil {
+		log.Println("Could not read request body ", err)
+		return false
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	url := owner + r.URL.RequestURI()
+	req, err := http.NewRequest(r.Method, url, bytes.NewReader(body))
+	if err != nil {
+		log.Println("Could not build forwarded request ", err)
+		return false
+	}
+	req.Header.Set("Content-Type", r.Header.Get("Content-Type"))
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	req.Header.Set(forwardedHeader, gServerConfig.SelfURL)
+
+	log.Println("Forwarding ", r.URL, " to ", owner)
+	resp, err := outboundClient.Do(req)
+	if err != nil {
+		// the owner may be gone; deliver as best we can from here
+		log.Println("Could not forward to ", owner, err)
+		return false
+	}
+	defer resp.Body.Close()
+
+	if contentType := resp.Header.Get("Content-Type"); contentType != "" {
+		w.Header().Set("Content-Type", contentType)
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+	return true
+}
+
+// Replace the cluster membership with the JSON list of peer URLs posted
+func adminPeers(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	var peers []string
+	if err := json.NewDecoder(r.Body).Decode(&peers); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Expected a JSON list of peer URLs."))
+		return
+	}
+	// notifies for channels registered on a peer can only be
+	// forwarded when the peer's channels can be looked up
+	if _, shared := gStorage.(channelLoader); !shared && len(peers) > 1 {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Peers need the shared redis storage."))
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "set-peers", peers...)
+	setPeers(peers)
+	w.Write([]byte("OK"))
+}
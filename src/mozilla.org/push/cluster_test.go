@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRingOwnershipIsStable(t *testing.T) {
+	before := newHashRing([]string{"http://a", "http://b", "http://c"})
+	after := newHashRing([]string{"http://a", "http://b", "http://c", "http://d"})
+
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		uaid := fmt.Sprint("uaid", i)
+		if before.owner(uaid) != after.owner(uaid) {
+			if after.owner(uaid) != "http://d" {
+				t.Fatalf("%s moved between existing peers", uaid)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 500 {
+		t.Fatalf("%d of 1000 UAIDs moved to the new peer", moved)
+	}
+}
+
+func TestNotifyIsForwardedToOwner(t *testing.T) {
+	setupTest(t)
+
+	var forwarded *http.Request
+	var forwardedBody string
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r
+		body, _ := ioutil.ReadAll(r.Body)
+		forwardedBody = string(body)
+		w.Write([]byte("handled by peer"))
+	}))
+	defer peer.Close()
+
+	gServerConfig.SelfURL = "http://self"
+	setPeers([]string{gServerConfig.SelfURL, peer.URL})
+	defer setPeers(nil)
+
+	// find a UAID for each instance
+	var remote, local string
+	for i := 0; remote == "" || local == ""; i++ {
+		uaid := fmt.Sprint("uaid", i)
+		if ownerOf(uaid) == peer.URL {
+			remote = uaid
+		} else {
+			local = uaid
+		}
+	}
+	remoteChannel := addTestChannel(remote, "remote", 1)
+	localChannel := addTestChannel(local, "local", 1)
+
+	w, n := notify(t, "remote", "version=5")
+	if forwarded == nil || n != nil {
+		t.Fatalf("notify for a remote UAID was handled locally")
+	}
+	if forwarded.URL.Path != "/notify/remote" || forwardedBody != "version=5" {
+		t.Fatalf("peer got %s with body %q", forwarded.URL.Path, forwardedBody)
+	}
+	if !strings.Contains(w.Body.String(), "handled by peer") {
+		t.Fatalf("peer's response was not relayed: %s", w.Body.String())
+	}
+	if remoteChannel.Version != 1 {
+		t.Fatalf("forwarded notify changed the local version")
+	}
+
+	forwarded = nil
+	if _, n = notify(t, "local", "version=5"); forwarded != nil || n == nil {
+		t.Fatalf("notify for a local UAID was not handled locally")
+	}
+	if localChannel.Version != 5 {
+		t.Fatalf("local notify left version at %d", localChannel.Version)
+	}
+}
+
+func TestPeersNeedSharedStorage(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	defer setPeers(nil)
+	postPeers := func() *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/admin/peers", strings.NewReader(`["http://a", "http://b"]`))
+		r.Header.Set("Authorization", "Bearer secret")
+		w := httptest.NewRecorder()
+		adminPeers(w, r)
+		return w
+	}
+
+	// a peer's channels can't be found to forward their notifies
+	if w := postPeers(); w.Code != http.StatusBadRequest || ownerOf("uaid") != "" {
+		t.Fatalf("peers were set with file storage, got %d", w.Code)
+	}
+	if w, _ := notify(t, "unknown", "version=5"); w.Code != http.StatusNotFound {
+		t.Fatalf("notify for an unknown channel got %d, want 404", w.Code)
+	}
+
+	gStorage = newRedisStorage(startFakeRedis(t, "").address(), "")
+	if w := postPeers(); w.Code != http.StatusOK || ownerOf("uaid") == "" {
+		t.Fatalf("peers were refused with redis storage, got %d", w.Code)
+	}
+}
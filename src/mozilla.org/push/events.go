@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Browser clients can also receive their messages as Server-Sent
+// Events. A GET to /events/{uaid} attaches to the UAID like a
+// long-poll does, but stays open, sending each
+// message as an event as soon as it is queued. Acks are POSTed to
+// /events/{uaid}/ack, and the same poll token is required.
+
+func eventsHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/events/"), "/")
+	uaid := parts[0]
+	if uaid == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "ack") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found."))
+		return
+	}
+	if !pollAuthorized(w, r, uaid) {
+		return
+	}
+
+	if len(parts) == 2 {
+		pollAck(w, r, uaid)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method must be GET."))
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Streaming is not supported."))
+		return
+	}
+
+	client := attachClient(uaid)
+	if client == nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("UAID is connected over a websocket."))
+		return
+	}
+	defer detachClient(client)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case message := <-client.outgoing:
+			// messages are single-line JSON, so each fits in one data field
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", message); err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStreamGetsNotification(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	channel := addTestChannel("uaid", "chan", 4)
+
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+
+	r, _ := http.NewRequest("GET", server.URL+"/events/uaid", nil)
+	r.Header.Set("Authorization", "Bearer "+pollToken("uaid"))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("event stream got %s with type %s", resp.Status, resp.Header.Get("Content-Type"))
+	}
+
+	waitForPoll(t, "uaid")
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	var message struct {
+		Name    string    `json:"messageType"`
+		Updates []Channel `json:"updates"`
+	}
+	if !strings.HasPrefix(line, "data: ") {
+		t.Fatalf("event stream sent %q", line)
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(line, "data: ")), &message); err != nil {
+		t.Fatal(err)
+	}
+	if message.Name != "notification" || message.Updates[0] != *channel {
+		t.Fatalf("event stream sent %q", line)
+	}
+
+	// hanging up detaches the client
+	resp.Body.Close()
+	for i := 0; i < 100 && connectedClient("uaid") != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if connectedClient("uaid") != nil {
+		t.Fatalf("closed event stream left a client behind")
+	}
+}
+
+func TestEventStreamKeepsWakeupAddress(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	channel := addTestChannel("uaid", "chan", 4)
+	woken := helloWakeable(t, "uaid")
+
+	server := httptest.NewServer(http.HandlerFunc(eventsHandler))
+	defer server.Close()
+	r, _ := http.NewRequest("GET", server.URL+"/events/uaid", nil)
+	r.Header.Set("Authorization", "Bearer "+pollToken("uaid"))
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitForPoll(t, "uaid")
+	resp.Body.Close()
+	for i := 0; i < 100; i++ {
+		gServerState.RLock()
+		streaming := len(gServerState.Transports["uaid"]) > 0
+		gServerState.RUnlock()
+		if !streaming {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the stream is gone, but the UAID can still be woken up
+	checkWokenUp(t, woken, channel)
+}
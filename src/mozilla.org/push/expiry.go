@@ -0,0 +1,65 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// With ChannelTTL set, channels that go that long without a register,
+// notify or hello are unregistered, so that clients which went away for
+// good don't keep their channels forever. A UAID left without channels
+// is forgotten along with its topic subscriptions once it's offline,
+// and the sweep also purges the orphans /admin/orphans would report.
+
+var channelsExpired = newCounter("push_channels_expired_total",
+	"Channels unregistered for going unused longer than channelTTLSeconds")
+
+func startExpiry() {
+	ttl := configDuration(gServerConfig.ChannelTTL)
+	if ttl <= 0 {
+		return
+	}
+
+	// a sweep is a walk over every channel, so not too often
+	interval := ttl / 10
+	if interval < time.Second {
+		interval = time.Second
+	} else if interval > time.Hour {
+		interval = time.Hour
+	}
+	go func() {
+		for now := range time.Tick(interval) {
+			expireChannels(now, ttl)
+		}
+	}()
+}
+
+func expireChannels(now time.Time, ttl time.Duration) {
+	cutoff := now.Add(-ttl).Unix()
+
+	gServerState.Lock()
+	var expired []*Channel
+	for _, channel := range gServerState.ChannelIDToChannel {
+		if channel.Updated == 0 {
+			// saved before channels were stamped; start counting now
+			channel.Updated = now.Unix()
+		} else if channel.Updated < cutoff {
+			expired = append(expired, channel)
+		}
+	}
+	for _, channel := range expired {
+		gServerState.removeChannel(channel.ChannelID)
+		audit(channel.UAID, "expire", channel.ChannelID)
+	}
+	report := gServerState.purgeOrphans()
+	for _, uaid := range report.EmptyUAIDs {
+		gServerState.unsubscribeAll(uaid)
+	}
+	gServerState.Unlock()
+
+	channelsExpired.Add(uint64(len(expired)))
+	if len(expired) > 0 || len(report.EmptyUAIDs) > 0 {
+		log.Println("Expired ", len(expired), " channels and ", len(report.EmptyUAIDs), " UAIDs")
+		markStateDirty()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStaleChannelsExpire(t *testing.T) {
+	setupTest(t)
+	now := time.Now()
+	stale := now.Add(-2 * time.Hour).Unix()
+
+	addTestChannel("uaid", "fresh", 1).Updated = now.Unix()
+	addTestChannel("uaid", "stale", 1).Updated = stale
+	addTestChannel("uaid", "legacy", 1)
+	gServerState.StrictChannels["stale"] = true
+	addTestChannel("gone", "abandoned", 1).Updated = stale
+	gServerState.subscribe("gone", "news")
+	gServerState.subscribe("uaid", "news")
+
+	expireChannels(now, time.Hour)
+	checkIndices(t)
+	for _, channelID := range []string{"stale", "abandoned"} {
+		if _, ok := gServerState.ChannelIDToChannel[channelID]; ok {
+			t.Fatalf("stale channel %s was kept", channelID)
+		}
+	}
+	for _, channelID := range []string{"fresh", "legacy"} {
+		if _, ok := gServerState.ChannelIDToChannel[channelID]; !ok {
+			t.Fatalf("channel %s expired early", channelID)
+		}
+	}
+	if gServerState.StrictChannels["stale"] {
+		t.Fatalf("expired channel's settings were kept")
+	}
+	if _, ok := gServerState.UAIDToChannelIDs["gone"]; ok || gServerState.TopicToUAIDs["news"]["gone"] {
+		t.Fatalf("UAID left without channels was kept")
+	}
+	if !gServerState.TopicToUAIDs["news"]["uaid"] {
+		t.Fatalf("live UAID lost its subscription")
+	}
+
+	// a channel saved before stamping gets its TTL from the first sweep
+	if updated := gServerState.ChannelIDToChannel["legacy"].Updated; updated != now.Unix() {
+		t.Fatalf("unstamped channel got stamped %d", updated)
+	}
+}
+
+func TestHelloKeepsChannelsAlive(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 1)
+	channel.Updated = time.Now().Add(-2 * time.Hour).Unix()
+
+	client := newClient(nil)
+	handleHello(client, map[string]interface{}{"uaid": "uaid", "channelIDs": []interface{}{"chan"}})
+	<-client.outgoing
+
+	expireChannels(time.Now(), time.Hour)
+	if _, ok := gServerState.ChannelIDToChannel["chan"]; !ok {
+		t.Fatalf("channel of a client that said hello expired")
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+)
+
+// Reads the fields of a client message, which can have any type at all,
+// remembering the first one that was missing or of the wrong type. The
+// getters return the zero value for a field that is absent or null.
+type fieldReader struct {
+	err error
+}
+
+func (r *fieldReader) fail(name, problem string) {
+	if r.err == nil {
+		r.err = fmt.Errorf("%s %s", name, problem)
+	}
+}
+
+func (r *fieldReader) string(f map[string]interface{}, name string, required bool) string {
+	switch value := f[name].(type) {
+	case string:
+		if value == "" && required {
+			r.fail(name, "is missing")
+		}
+		return value
+	case nil:
+		if required {
+			r.fail(name, "is missing")
+		}
+	default:
+		r.fail(name, "is not a string")
+	}
+	return ""
+}
+
+func (r *fieldReader) number(f map[string]interface{}, name string, required bool) float64 {
+	switch value := f[name].(type) {
+	case float64:
+		return value
+	case nil:
+		if required {
+			r.fail(name, "is missing")
+		}
+	default:
+		r.fail(name, "is not a number")
+	}
+	return 0
+}
+
+func (r *fieldReader) strings(f map[string]interface{}, name string) []string {
+	switch value := f[name].(type) {
+	case []interface{}:
+		values := make([]string, 0, len(value))
+		for _, element := range value {
+			s, ok := element.(string)
+			if !ok {
+				r.fail(name, "is not an array of strings")
+				return nil
+			}
+			values = append(values, s)
+		}
+		return values
+	case nil:
+	default:
+		r.fail(name, "is not an array")
+	}
+	return nil
+}
+
+func (r *fieldReader) object(f map[string]interface{}, name string) map[string]interface{} {
+	switch value := f[name].(type) {
+	case map[string]interface{}:
+		return value
+	case nil:
+	default:
+		r.fail(name, "is not an object")
+	}
+	return nil
+}
+
+// UAIDs end up in paths like /uaid/{uaid}/notify and in storage keys,
+// so the ones clients pick are kept to a short run of letters, digits
+// and a little punctuation, which generated UUIDs fit in
+var uaidPattern = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Read the UAID field name, which must be a valid UAID if present
+func (r *fieldReader) uaid(f map[string]interface{}, name string, required bool) string {
+	uaid := r.string(f, name, required)
+	if uaid != "" && !uaidPattern.MatchString(uaid) {
+		r.fail(name, "is not a valid UAID")
+	}
+	return uaid
+}
+
+// Tell the client its message of type messageType was refused because
+// of err
+func sendFieldError(client *Client, messageType string, err error) {
+	logEvent(levelWarn, "message_rejected", "uaid", client.UAID, "messageType", messageType, "error", err)
+
+	j, err := marshalFor(client.profile, struct {
+		Name   string `json:"messageType"`
+		Status int    `json:"status"`
+		Error  string `json:"error"`
+	}{messageType, 400, err.Error()})
+	if err != nil {
+		log.Println("Could not convert error response to json ", err)
+		return
+	}
+
+	sendToClient(client, string(j))
+}
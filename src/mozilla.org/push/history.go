@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+// With HistorySize set, the server remembers the last HistorySize
+// versions of each channel and when they came in. A client that says
+// hello with "history": true is sent them in a "history" message right
+// after the hello, oldest first, for context on what happened while it
+// was away. This is unlike redelivery, which only ever sends the latest
+// version of a channel until it's acked.
+
+type HistoryEntry struct {
+	Version uint64    `json:"version"`
+	Time    time.Time `json:"time"`
+}
+
+// Add the current versions of channels to their history. Callers hold
+// the lock.
+func (state *ServerState) recordHistory(channels []*Channel, now time.Time) {
+	size := gServerConfig.HistorySize
+	for _, channel := range channels {
+		history := append(state.History[channel.ChannelID], HistoryEntry{channel.Version, now})
+		if len(history) > size {
+			// a fresh slice, so the dropped entries can be collected
+			history = append([]HistoryEntry(nil), history[len(history)-size:]...)
+		}
+		state.History[channel.ChannelID] = history
+	}
+}
+
+func sendHistory(client *Client) {
+	type HistoryUpdate struct {
+		ChannelID string    `json:"channelID"`
+		Version   uint64    `json:"version"`
+		Time      time.Time `json:"time"`
+	}
+	type HistoryResponse struct {
+		Name    string          `json:"messageType"`
+		Updates []HistoryUpdate `json:"updates"`
+	}
+
+	response := HistoryResponse{"history", []HistoryUpdate{}}
+	gServerState.RLock()
+	for channelID := range gServerState.UAIDToChannelIDs[client.UAID] {
+		for _, entry := range gServerState.History[channelID] {
+			response.Updates = append(response.Updates, HistoryUpdate{channelID, entry.Version, entry.Time})
+		}
+	}
+	gServerState.RUnlock()
+
+	sort.SliceStable(response.Updates, func(i, j int) bool {
+		a, b := response.Updates[i], response.Updates[j]
+		if !a.Time.Equal(b.Time) {
+			return a.Time.Before(b.Time)
+		}
+		if a.ChannelID != b.ChannelID {
+			return a.ChannelID < b.ChannelID
+		}
+		return a.Version < b.Version
+	})
+
+	j, err := marshalFor(client.profile, response)
+	if err != nil {
+		log.Println("Could not convert history response to json ", err)
+		return
+	}
+
+	sendToClient(client, string(j))
+}
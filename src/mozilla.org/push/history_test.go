@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"go.net/websocket"
+	"net/http"
+	"testing"
+)
+
+func TestReconnectingClientGetsHistory(t *testing.T) {
+	setupTest(t)
+	gServerConfig.HistorySize = 2
+	addTestChannel("uaid", "a", 0)
+	addTestChannel("uaid", "b", 0)
+	addTestChannel("other", "c", 0)
+
+	for _, update := range []struct{ channelID, version string }{
+		{"a", "1"}, {"b", "1"}, {"a", "2"}, {"c", "1"}, {"a", "3"},
+	} {
+		if w, _ := notify(t, update.channelID, "version="+update.version); w.Code != http.StatusOK {
+			t.Fatalf("notify got status %d", w.Code)
+		}
+	}
+
+	reconnect := func(history bool) *Client {
+		delete(gServerState.ConnectedClients, "uaid")
+		client := newClient(&websocket.Conn{})
+		handleHello(client, map[string]interface{}{"uaid": "uaid",
+			"channelIDs": []interface{}{"a", "b"}, "history": history})
+		<-client.outgoing
+		return client
+	}
+
+	if client := reconnect(false); len(client.outgoing) != 0 {
+		t.Fatalf("history was sent without being asked for: %s", <-client.outgoing)
+	}
+
+	client := reconnect(true)
+	var response struct {
+		Name    string `json:"messageType"`
+		Updates []struct {
+			ChannelID string `json:"channelID"`
+			Version   uint64 `json:"version"`
+		} `json:"updates"`
+	}
+	if err := json.Unmarshal([]byte(<-client.outgoing), &response); err != nil {
+		t.Fatal(err)
+	}
+	// a's first version fell out of its history, and c isn't this
+	// client's
+	want := []struct {
+		channelID string
+		version   uint64
+	}{{"b", 1}, {"a", 2}, {"a", 3}}
+	if response.Name != "history" || len(response.Updates) != len(want) {
+		t.Fatalf("got %+v, want the history of a and b", response)
+	}
+	for i, update := range response.Updates {
+		if update.ChannelID != want[i].channelID || update.Version != want[i].version {
+			t.Fatalf("history is %+v, want %v", response.Updates, want)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Routine events, logged for every message or notification, can flood
+// the logs under load or when a broken client is stuck in a reconnect
+// loop. They go through logSampled, which only logs one in every
+// LogSampleRate occurrences of each event. Errors keep going straight
+// to log.Println, so they are never sampled away.
+//
+// The busiest paths log events with logEvent instead, at a level and
+// with key/value fields such as uaid, channelID and version. Events
+// below LogLevel are dropped; everything logSampled logs is at the
+// debug level. With LogFormat "json", every line, events and plain
+// log.Println alike, is written as a JSON object.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (level logLevel) String() string {
+	return levelNames[level]
+}
+
+// The configured LogLevel; everything is logged by default
+func minLogLevel() logLevel {
+	for level, name := range levelNames {
+		if strings.EqualFold(gServerConfig.LogLevel, name) {
+			return logLevel(level)
+		}
+	}
+	return levelDebug
+}
+
+func setupLogging() {
+	if gServerConfig.LogFormat == "json" {
+		useJSONLogs(os.Stderr)
+	}
+}
+
+// The JSON records have their own time, so the log package's prefix is
+// dropped
+func useJSONLogs(out io.Writer) {
+	log.SetFlags(0)
+	log.SetOutput(&jsonLogWriter{out: out})
+}
+
+var gLogSamples struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+// Whether this occurrence of event is to be logged
+func sampled(event string) bool {
+	if rate := gServerConfig.LogSampleRate; rate > 1 {
+		gLogSamples.Lock()
+		if gLogSamples.counts == nil {
+			gLogSamples.counts = make(map[string]uint64)
+		}
+		n := gLogSamples.counts[event]
+		gLogSamples.counts[event] = n + 1
+		gLogSamples.Unlock()
+
+		return n%uint64(rate) == 0
+	}
+	return true
+}
+
+// Log event followed by v like log.Println, unless sampled out. Use a
+// fixed string for event, as occurrences are counted per event.
+func logSampled(event string, v ...interface{}) {
+	if minLogLevel() > levelDebug || !sampled(event) {
+		return
+	}
+
+	if w, ok := log.Writer().(*jsonLogWriter); ok {
+		w.write(map[string]interface{}{"level": levelDebug.String(),
+			"event": strings.TrimSpace(event), "msg": strings.TrimSpace(fmt.Sprintln(v...))})
+		return
+	}
+	log.Println(append([]interface{}{event}, v...)...)
+}
+
+// Log event with fields given as key, value, key, value...
+// Debug events are sampled like logSampled's.
+func logEvent(level logLevel, event string, fields ...interface{}) {
+	if level < minLogLevel() || (level == levelDebug && !sampled(event)) {
+		return
+	}
+
+	if w, ok := log.Writer().(*jsonLogWriter); ok {
+		record := map[string]interface{}{"level": level.String(), "event": event}
+		for i := 0; i+1 < len(fields); i += 2 {
+			record[fmt.Sprint(fields[i])] = jsonLogValue(fields[i+1])
+		}
+		w.write(record)
+		return
+	}
+
+	var line strings.Builder
+	fmt.Fprintf(&line, "%s %s", strings.ToUpper(level.String()), event)
+	for i := 0; i+1 < len(fields); i += 2 {
+		fmt.Fprintf(&line, " %v=%v", fields[i], fields[i+1])
+	}
+	log.Println(line.String())
+}
+
+// Values that don't make sense as JSON, such as errors, are logged as
+// text
+func jsonLogValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, string, bool, int, int64, uint64, float64:
+		return v
+	case error:
+		return v.Error()
+	}
+	return fmt.Sprint(v)
+}
+
+// Writes every line logged as a JSON object. What comes from the log
+// package is the "msg" of an info line.
+type jsonLogWriter struct {
+	sync.Mutex
+	out io.Writer
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	w.write(map[string]interface{}{"level": levelInfo.String(), "msg": strings.TrimSuffix(string(p), "\n")})
+	return len(p), nil
+}
+
+func (w *jsonLogWriter) write(record map[string]interface{}) {
+	record["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, err := json.Marshal(record)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": levelError.String(),
+			"msg": "could not log " + fmt.Sprint(record) + ": " + err.Error()})
+	}
+
+	w.Lock()
+	defer w.Unlock()
+	w.out.Write(append(line, '\n'))
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRoutineLogsAreSampled(t *testing.T) {
+	setupTest(t)
+	gServerConfig.LogSampleRate = 10
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	for i := 0; i < 100; i++ {
+		logSampled("sampled event ", i)
+	}
+	logSampled("other event")
+
+	if n := strings.Count(buf.String(), "sampled event"); n != 10 {
+		t.Fatalf("logged %d of 100 sampled events, want 10", n)
+	}
+	if !strings.Contains(buf.String(), "other event") {
+		t.Fatalf("first occurrence of another event was sampled away")
+	}
+}
+
+func TestEventsBelowLogLevelAreDropped(t *testing.T) {
+	setupTest(t)
+	gServerConfig.LogLevel = "warn"
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	logEvent(levelInfo, "register", "uaid", "uaid", "channelID", "chan")
+	logSampled("sampled event")
+	logEvent(levelWarn, "register_refused", "uaid", "uaid", "channelID", "chan")
+
+	if out := buf.String(); strings.Contains(out, "register ") || strings.Contains(out, "sampled event") {
+		t.Fatalf("logged events below the level: %q", out)
+	}
+	if out := buf.String(); !strings.Contains(out, "WARN register_refused uaid=uaid channelID=chan") {
+		t.Fatalf("warning was not logged: %q", out)
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	setupTest(t)
+
+	var buf bytes.Buffer
+	useJSONLogs(&buf)
+	defer log.SetFlags(log.LstdFlags)
+	defer log.SetOutput(os.Stderr)
+
+	logEvent(levelInfo, "notify", "uaid", "uaid", "channelID", "chan", "version", uint64(7),
+		"error", errors.New("oops"))
+	log.Println("plain line")
+
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("%q is not JSON: %v", line, err)
+		}
+		if record["time"] == nil {
+			t.Fatalf("%q has no time", line)
+		}
+		lines = append(lines, record)
+	}
+	if len(lines) != 2 {
+		t.Fatalf("logged %d lines, want 2", len(lines))
+	}
+
+	event := lines[0]
+	if event["level"] != "info" || event["event"] != "notify" || event["uaid"] != "uaid" ||
+		event["channelID"] != "chan" || event["version"] != 7.0 || event["error"] != "oops" {
+		t.Fatalf("logged event %v", event)
+	}
+	if plain := lines[1]; plain["level"] != "info" || plain["msg"] != "plain line" {
+		t.Fatalf("logged plain line as %v", plain)
+	}
+}
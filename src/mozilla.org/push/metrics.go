@@ -0,0 +1,268 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"runtime"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A minimal metrics registry, served in the Prometheus
+// text exposition format at /metrics
+
+type metric interface {
+	writeTo(w io.Writer)
+}
+
+var gMetrics struct {
+	sync.Mutex
+	all []metric
+}
+
+func registerMetric(m metric) {
+	gMetrics.Lock()
+	defer gMetrics.Unlock()
+	gMetrics.all = append(gMetrics.all, m)
+}
+
+// A Counter only ever goes up
+type Counter struct {
+	name  string
+	help  string
+	value uint64
+}
+
+func newCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	registerMetric(c)
+	return c
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.value, n)
+}
+
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.value)
+}
+
+func (c *Counter) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %d\n",
+		c.name, c.help, c.name, c.name, c.Value())
+}
+
+// A CounterVec is a family of counters told apart by the value of one
+// label. Callers must keep the set of label values small.
+type CounterVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func newCounterVec(name, help, label string) *CounterVec {
+	c := &CounterVec{name: name, help: help, label: label, values: make(map[string]uint64)}
+	registerMetric(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValue string) {
+	c.Add(labelValue, 1)
+}
+
+func (c *CounterVec) Add(labelValue string, n uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue] += n
+}
+
+func (c *CounterVec) Value(labelValue string) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[labelValue]
+}
+
+func (c *CounterVec) writeTo(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	labelValues := make([]string, 0, len(c.values))
+	for labelValue := range c.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, labelValue, c.values[labelValue])
+	}
+}
+
+// A GaugeFunc reads its value when the metrics are served
+type GaugeFunc struct {
+	name  string
+	help  string
+	value func() int64
+}
+
+func newGaugeFunc(name, help string, value func() int64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, value: value}
+	registerMetric(g)
+	return g
+}
+
+func (g *GaugeFunc) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.name, g.help, g.name, g.name, g.value())
+}
+
+// A Gauge is a value that goes up and down
+type Gauge struct {
+	name  string
+	help  string
+	value int64
+}
+
+func newGauge(name, help string) *Gauge {
+	g := &Gauge{name: name, help: help}
+	registerMetric(g)
+	return g
+}
+
+func (g *Gauge) Set(value int64) {
+	atomic.StoreInt64(&g.value, value)
+}
+
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.value)
+}
+
+func (g *Gauge) writeTo(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n",
+		g.name, g.help, g.name, g.name, g.Value())
+}
+
+// A GaugeVec is a family of values that go up and down, told apart by
+// the value of one label
+type GaugeVec struct {
+	name   string
+	help   string
+	label  string
+	mu     sync.Mutex
+	values map[string]int64
+}
+
+func newGaugeVec(name, help, label string) *GaugeVec {
+	g := &GaugeVec{name: name, help: help, label: label, values: make(map[string]int64)}
+	registerMetric(g)
+	return g
+}
+
+func (g *GaugeVec) Set(labelValue string, value int64) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[labelValue] = value
+}
+
+func (g *GaugeVec) Value(labelValue string) int64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.values[labelValue]
+}
+
+func (g *GaugeVec) writeTo(w io.Writer) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n", g.name, g.help, g.name)
+	labelValues := make([]string, 0, len(g.values))
+	for labelValue := range g.values {
+		labelValues = append(labelValues, labelValue)
+	}
+	sort.Strings(labelValues)
+	for _, labelValue := range labelValues {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", g.name, g.label, labelValue, g.values[labelValue])
+	}
+}
+
+var goroutines = newGaugeFunc("push_goroutines",
+	"Goroutines currently running; this should follow the number of connections",
+	func() int64 { return int64(runtime.NumGoroutine()) })
+
+var connectedClients = newGaugeFunc("push_connected_clients",
+	"Clients in ConnectedClients, connected or waiting for a wakeup",
+	func() int64 {
+		gServerState.RLock()
+		defer gServerState.RUnlock()
+		return int64(len(gServerState.ConnectedClients))
+	})
+
+var registeredChannels = newGaugeFunc("push_registered_channels",
+	"Channels registered on this server",
+	func() int64 {
+		gServerState.RLock()
+		defer gServerState.RUnlock()
+		return int64(len(gServerState.ChannelIDToChannel))
+	})
+
+var clientResets = newCounter("push_client_resets_total",
+	"Hellos that claimed unknown channels, resetting the UAID")
+
+var incompleteHandshakes = newCounter("push_incomplete_handshakes_total",
+	"Connections that closed without completing a hello")
+
+var ackFailures = newCounter("push_ack_failures_total",
+	"Updates clients acknowledged as failed")
+var invalidAcks = newCounter("push_invalid_acks_total",
+	"Malformed ack updates, which are rejected")
+var ackProtocolViolations = newCounter("push_ack_protocol_violations_total",
+	"Acks for a version newer than the one pending")
+
+// Delivery metrics by the platform clients report in their hello
+var notificationsSent = newCounterVec("push_notifications_sent_total",
+	"Notifications sent to connected clients", "platform")
+var acksByPlatform = newCounterVec("push_acks_total",
+	"Updates clients acknowledged as delivered", "platform")
+var ackFailuresByPlatform = newCounterVec("push_ack_failures_by_platform_total",
+	"Updates clients acknowledged as failed", "platform")
+var ackLatency = newCounterVec("push_ack_latency_milliseconds_total",
+	"Time from queueing a notification to its ack; divide by push_acks_total for the mean",
+	"platform")
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	gMetrics.Lock()
+	defer gMetrics.Unlock()
+	for _, m := range gMetrics.all {
+		m.writeTo(w)
+	}
+}
+
+var defaultPlatforms = []string{"android", "ios", "firefoxos", "desktop"}
+
+// The metrics label for a reported platform. Only the configured
+// platforms are used as is, so a client can't blow up the number of
+// labels by making platforms up.
+func platformLabel(reported string) string {
+	if reported == "" {
+		return "unknown"
+	}
+	platforms := gServerConfig.Platforms
+	if platforms == nil {
+		platforms = defaultPlatforms
+	}
+	for _, platform := range platforms {
+		if platform == reported {
+			return platform
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// When the delivery loop falls behind, notifies can't queue their
+// notifications right away. NotifyQueuePolicy says what they do then:
+// "block", the default, waits as long as it takes; "timeout" waits up
+// to NotifyQueueTimeout seconds and then sheds the notify; "reject"
+// sheds it right away; and "drop-oldest" makes room by dropping the
+// oldest notification in the queue, which needs a NotifyQueueSize. Shed
+// notifies are answered with a 503. Either way the new version is
+// already saved, so a dropped notification only misses its delivery.
+
+var errQueueFull = errors.New("the notification queue is full")
+
+var queuedNotificationsDropped = newCounter("push_queued_notifications_dropped_total",
+	"Queued notifications dropped to make room for newer ones")
+
+func newNotifyChan() chan Notification {
+	return make(chan Notification, gServerConfig.NotifyQueueSize)
+}
+
+func queueNotification(notification Notification) error {
+	queue := notifyChan
+	select {
+	case queue <- notification:
+		return nil
+	default:
+	}
+
+	switch gServerConfig.NotifyQueuePolicy {
+	case "reject":
+		return errQueueFull
+
+	case "timeout":
+		timeout := configDuration(gServerConfig.NotifyQueueTimeout)
+		if timeout <= 0 {
+			timeout = time.Second
+		}
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case queue <- notification:
+			return nil
+		case <-timer.C:
+			return errQueueFull
+		}
+
+	case "drop-oldest":
+		// other notifies may take the room first, so keep at it
+		// until this one fits
+		for cap(queue) > 0 {
+			select {
+			case queue <- notification:
+				return nil
+			default:
+			}
+			select {
+			case dropped := <-queue:
+				logEvent(levelDebug, "notification_dropped", "uaid", dropped.UAID,
+					"channelID", dropped.Channel.ChannelID, "version", dropped.Channel.Version,
+					"reason", "queue full")
+				queuedNotificationsDropped.Inc()
+			default:
+			}
+		}
+		return errQueueFull
+	}
+
+	queue <- notification
+	return nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Fill a queue of one with a notification for "old", then notify "new"
+func notifySaturated(t *testing.T, policy string) (*httptest.ResponseRecorder, chan Notification) {
+	setupTest(t)
+	gServerConfig.NotifyQueuePolicy = policy
+	gServerConfig.NotifyQueueTimeout = 0.05
+	addTestChannel("uaid", "old", 1)
+	addTestChannel("uaid", "new", 1)
+
+	queue := make(chan Notification, 1)
+	queue <- Notification{UAID: "uaid", Channel: gServerState.ChannelIDToChannel["old"]}
+	notifyChan = queue
+
+	r := httptest.NewRequest("PUT", "/notify/new", nil)
+	w := httptest.NewRecorder()
+	notifyHandler(w, r)
+	return w, queue
+}
+
+func TestFullQueueRejects(t *testing.T) {
+	w, queue := notifySaturated(t, "reject")
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("notify into a full queue got %d, want 503", w.Code)
+	}
+	if n := <-queue; n.Channel.ChannelID != "old" {
+		t.Fatalf("the queued notification was replaced by %s", n.Channel.ChannelID)
+	}
+}
+
+func TestRefusedNotifyKeepsVersion(t *testing.T) {
+	w, queue := notifySaturated(t, "reject")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("notify into a full queue got %d, want 503", w.Code)
+	}
+	if version := gServerState.ChannelIDToChannel["new"].Version; version != 1 {
+		t.Fatalf("refused notify left version %d, want 1", version)
+	}
+
+	// the app server retries once there's room
+	<-queue
+	w = httptest.NewRecorder()
+	notifyHandler(w, httptest.NewRequest("PUT", "/notify/new", nil))
+	if n := <-queue; w.Code != http.StatusOK || n.Channel.Version != 2 {
+		t.Fatalf("retried notify got %d and queued version %d, want 2", w.Code, n.Channel.Version)
+	}
+}
+
+func TestRefusedUAIDNotifyKeepsQueuedVersions(t *testing.T) {
+	setupTest(t)
+	gServerConfig.NotifyQueuePolicy = "reject"
+	a := addTestChannel("uaid", "a", 1)
+	b := addTestChannel("uaid", "b", 5)
+	queue := make(chan Notification, 1)
+	notifyChan = queue
+
+	w := httptest.NewRecorder()
+	uaidHandler(w, httptest.NewRequest("PUT", "/uaid/uaid/notify", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("notify into a queue of one got %d, want 503", w.Code)
+	}
+
+	// the channel that made it into the queue keeps its bump, so a
+	// retry won't reuse the version its client may already have
+	n := <-queue
+	kept, reverted, want := a, b, uint64(5)
+	if n.Channel.ChannelID == "b" {
+		kept, reverted, want = b, a, 1
+	}
+	if kept.Version != n.Channel.Version || reverted.Version != want {
+		t.Fatalf("got versions %d and %d after queueing %s at %d", a.Version, b.Version, n.Channel.ChannelID, n.Channel.Version)
+	}
+}
+
+func TestFullQueueTimesOut(t *testing.T) {
+	start := time.Now()
+	w, _ := notifySaturated(t, "timeout")
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("notify into a full queue got %d, want 503", w.Code)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Fatalf("notify gave up after %v, before the timeout", elapsed)
+	}
+}
+
+func TestFullQueueWaitsUntilTimeout(t *testing.T) {
+	setupTest(t)
+	gServerConfig.NotifyQueuePolicy = "timeout"
+	gServerConfig.NotifyQueueTimeout = 1
+	queue := make(chan Notification, 1)
+	queue <- Notification{UAID: "old"}
+	notifyChan = queue
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		<-queue
+	}()
+
+	if err := queueNotification(Notification{UAID: "uaid"}); err != nil {
+		t.Fatalf("notification wasn't queued once there was room: %v", err)
+	}
+}
+
+func TestFullQueueDropsOldest(t *testing.T) {
+	dropped := queuedNotificationsDropped.Value()
+	w, queue := notifySaturated(t, "drop-oldest")
+	if w.Code != http.StatusOK {
+		t.Fatalf("notify into a full queue got %d, want 200", w.Code)
+	}
+	if n := <-queue; n.Channel.ChannelID != "new" {
+		t.Fatalf("queue holds %s, want the newer notification", n.Channel.ChannelID)
+	}
+	if queuedNotificationsDropped.Value() != dropped+1 {
+		t.Fatalf("dropped notification was not counted")
+	}
+}
+
+func TestFullQueueBlocksByDefault(t *testing.T) {
+	setupTest(t)
+	queue := make(chan Notification, 1)
+	queue <- Notification{UAID: "old"}
+	notifyChan = queue
+
+	done := make(chan error)
+	go func() {
+		done <- queueNotification(Notification{UAID: "new"})
+	}()
+	select {
+	case <-done:
+		t.Fatalf("notification into a full queue didn't wait")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	<-queue
+	if err := <-done; err != nil {
+		t.Fatalf("notification wasn't queued once there was room: %v", err)
+	}
+	if n := <-queue; n.UAID != "new" {
+		t.Fatalf("queue holds %s, want the waiting notification", n.UAID)
+	}
+}
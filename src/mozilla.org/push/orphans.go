@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// Leftovers that the channel maps can collect when something forgets to
+// clean up after itself. /admin/orphans lists them, and
+// /admin/orphans/purge removes them.
+type orphanReport struct {
+	// In ChannelIDToChannel, but not listed under their UAID
+	UnownedChannels []string `json:"unownedChannels"`
+	// "uaid/channelID" entries of UAIDToChannelIDs whose channel doesn't
+	// exist, or belongs to another UAID
+	MissingChannels []string `json:"missingChannels"`
+	// Intervals, strictness and history kept for channels that don't
+	// exist
+	StraySettings []string `json:"straySettings"`
+	// UAIDs that own no channels and aren't connected
+	EmptyUAIDs []string `json:"emptyUAIDs"`
+	// Topics nobody is subscribed to
+	EmptyTopics []string `json:"emptyTopics"`
+}
+
+// Callers hold at least the read lock
+func (state *ServerState) findOrphans() orphanReport {
+	report := orphanReport{[]string{}, []string{}, []string{}, []string{}, []string{}}
+
+	for channelID, channel := range state.ChannelIDToChannel {
+		if _, ok := state.UAIDToChannelIDs[channel.UAID][channelID]; !ok {
+			report.UnownedChannels = append(report.UnownedChannels, channelID)
+		}
+	}
+	for uaid, channels := range state.UAIDToChannelIDs {
+		for channelID := range channels {
+			if channel, ok := state.ChannelIDToChannel[channelID]; !ok || channel.UAID != uaid {
+				report.MissingChannels = append(report.MissingChannels, uaid+"/"+channelID)
+			}
+		}
+	}
+
+	stray := make(map[string]bool)
+	for channelID := range state.MinNotifyIntervals {
+		stray[channelID] = true
+	}
+	for channelID := range state.StrictChannels {
+		stray[channelID] = true
+	}
+	for channelID := range state.History {
+		stray[channelID] = true
+	}
+	for channelID := range stray {
+		if _, ok := state.ChannelIDToChannel[channelID]; !ok {
+			report.StraySettings = append(report.StraySettings, channelID)
+		}
+	}
+
+	for uaid, channels := range state.UAIDToChannelIDs {
+		live := 0
+		for channelID := range channels {
+			if channel, ok := state.ChannelIDToChannel[channelID]; ok && channel.UAID == uaid {
+				live++
+			}
+		}
+		if _, connected := state.ConnectedClients[uaid]; live == 0 && !connected {
+			report.EmptyUAIDs = append(report.EmptyUAIDs, uaid)
+		}
+	}
+	for topic, uaids := range state.TopicToUAIDs {
+		if len(uaids) == 0 {
+			report.EmptyTopics = append(report.EmptyTopics, topic)
+		}
+	}
+
+	sort.Strings(report.UnownedChannels)
+	sort.Strings(report.MissingChannels)
+	sort.Strings(report.StraySettings)
+	sort.Strings(report.EmptyUAIDs)
+	sort.Strings(report.EmptyTopics)
+	return report
+}
+
+// Remove what findOrphans reports and return it. Callers hold the lock.
+func (state *ServerState) purgeOrphans() orphanReport {
+	report := state.findOrphans()
+
+	for _, channelID := range report.UnownedChannels {
+		delete(state.ChannelIDToChannel, channelID)
+		delete(state.MinNotifyIntervals, channelID)
+		delete(state.StrictChannels, channelID)
+		delete(state.History, channelID)
+	}
+	for uaid, channels := range state.UAIDToChannelIDs {
+		for channelID := range channels {
+			if channel, ok := state.ChannelIDToChannel[channelID]; !ok || channel.UAID != uaid {
+				delete(channels, channelID)
+			}
+		}
+	}
+	for _, channelID := range report.StraySettings {
+		delete(state.MinNotifyIntervals, channelID)
+		delete(state.StrictChannels, channelID)
+		delete(state.History, channelID)
+	}
+	for _, uaid := range report.EmptyUAIDs {
+		delete(state.UAIDToChannelIDs, uaid)
+	}
+	for _, topic := range report.EmptyTopics {
+		delete(state.TopicToUAIDs, topic)
+	}
+	return report
+}
+
+func adminOrphans(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+
+	gServerState.RLock()
+	report := gServerState.findOrphans()
+	gServerState.RUnlock()
+	writeOrphanReport(w, report)
+}
+
+func adminPurgeOrphans(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "purge-orphans")
+	gServerState.Lock()
+	report := gServerState.purgeOrphans()
+	gServerState.Unlock()
+	markStateDirty()
+
+	log.Println("Purged ", len(report.UnownedChannels), " unowned channels, ",
+		len(report.MissingChannels), " missing channels, ", len(report.StraySettings), " stray settings, ",
+		len(report.EmptyUAIDs), " empty UAIDs and ", len(report.EmptyTopics), " empty topics")
+	writeOrphanReport(w, report)
+}
+
+func writeOrphanReport(w http.ResponseWriter, report orphanReport) {
+	j, err := json.Marshal(report)
+	if err != nil {
+		log.Println("Could not convert orphan report to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+)
+
+func TestOrphansAreListedAndPurged(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	addTestChannel("uaid", "chan", 1)
+	gServerState.MinNotifyIntervals["chan"] = 5
+	gServerState.subscribe("uaid", "news")
+
+	gServerState.ChannelIDToChannel["unowned"] = &Channel{UAID: "uaid", ChannelID: "unowned", Version: 1}
+	gServerState.UAIDToChannelIDs["other"] = ChannelIDSet{"missing": &Channel{UAID: "other", ChannelID: "missing", Version: 1}}
+	gServerState.StrictChannels["gone"] = true
+	gServerState.UAIDToChannelIDs["online"] = make(ChannelIDSet)
+	gServerState.ConnectedClients["online"] = &Client{UAID: "online"}
+	gServerState.TopicToUAIDs["quiet"] = make(map[string]bool)
+
+	report := func(w *httptest.ResponseRecorder) orphanReport {
+		if w.Code != http.StatusOK {
+			t.Fatalf("got status %d: %s", w.Code, w.Body.String())
+		}
+		var report orphanReport
+		if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil {
+			t.Fatalf("bad report %q: %v", w.Body.String(), err)
+		}
+		return report
+	}
+	want := orphanReport{
+		UnownedChannels: []string{"unowned"},
+		MissingChannels: []string{"other/missing"},
+		StraySettings:   []string{"gone"},
+		EmptyUAIDs:      []string{"other"},
+		EmptyTopics:     []string{"quiet"},
+	}
+
+	w := httptest.NewRecorder()
+	adminOrphans(w, adminRequest("GET", "/admin/orphans", "secret"))
+	if got := report(w); !reflect.DeepEqual(got, want) {
+		t.Fatalf("listed %+v, want %+v", got, want)
+	}
+
+	w = httptest.NewRecorder()
+	adminPurgeOrphans(w, adminRequest("GET", "/admin/orphans/purge", "secret"))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Fatalf("purge with GET got status %d, want 405", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	adminPurgeOrphans(w, adminRequest("POST", "/admin/orphans/purge", "secret"))
+	if got := report(w); !reflect.DeepEqual(got, want) {
+		t.Fatalf("purged %+v, want %+v", got, want)
+	}
+	checkIndices(t)
+
+	w = httptest.NewRecorder()
+	adminOrphans(w, adminRequest("GET", "/admin/orphans", "secret"))
+	empty := orphanReport{[]string{}, []string{}, []string{}, []string{}, []string{}}
+	if got := report(w); !reflect.DeepEqual(got, empty) {
+		t.Fatalf("left %+v behind", got)
+	}
+	if gServerState.MinNotifyIntervals["chan"] != 5 || gServerState.TopicToUAIDs["news"] == nil {
+		t.Fatalf("purge removed a live channel's settings or a live topic")
+	}
+	if _, ok := gServerState.UAIDToChannelIDs["online"]; !ok {
+		t.Fatalf("purge forgot a connected UAID")
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"time"
+)
+
+// Every outbound HTTP request the server makes, webhooks and notifies
+// forwarded to peers alike, goes through this one client. Its timeouts
+// bound how long a slow or unreachable receiver can hold a goroutine.
+var outboundClient = newOutboundClient()
+
+func newOutboundClient() *http.Client {
+	connectTimeout := configDuration(gServerConfig.OutboundConnectTimeout)
+	if connectTimeout <= 0 {
+		connectTimeout = 5 * time.Second
+	}
+	timeout := configDuration(gServerConfig.OutboundTimeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+
+	dialer := &net.Dialer{Timeout: connectTimeout, KeepAlive: 30 * time.Second}
+	return &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:               http.ProxyFromEnvironment,
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: connectTimeout,
+			MaxIdleConnsPerHost: 16,
+			IdleConnTimeout:     90 * time.Second,
+		},
+	}
+}
+
+// Rebuild the client once the configuration is known
+func startOutbound() {
+	outboundClient = newOutboundClient()
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSlowPeerTimesOut(t *testing.T) {
+	setupTest(t)
+	gServerConfig.OutboundTimeout = 0.2
+
+	release := make(chan struct{})
+	peer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer peer.Close()
+	defer close(release)
+
+	previous := outboundClient
+	startOutbound()
+	defer func() { outboundClient = previous }()
+
+	gServerConfig.SelfURL = "http://self"
+	setPeers([]string{gServerConfig.SelfURL, peer.URL})
+	defer setPeers(nil)
+
+	var remote string
+	for i := 0; remote == ""; i++ {
+		if uaid := fmt.Sprint("uaid", i); ownerOf(uaid) == peer.URL {
+			remote = uaid
+		}
+	}
+	addTestChannel(remote, "remote", 1)
+
+	start := time.Now()
+	_, n := notify(t, "remote", "version=5")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("forwarding to a slow peer took %s", elapsed)
+	}
+	if n == nil {
+		t.Fatalf("notify was not handled locally after forwarding timed out")
+	}
+}
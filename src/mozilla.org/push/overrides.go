@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"unicode"
+)
+
+// Any config field can be overridden without editing the config file,
+// by a flag named after its JSON name (-port 8081) or an environment
+// variable named after it in upper case with a PUSH_ prefix
+// (PUSH_PORT=8081). Flags win over the environment, which wins over
+// the file. Strings are taken as they are, and everything else as JSON
+// (-useTLS true, PUSH_PEERS='["a:8080"]'). The config file itself can
+// be named by PUSH_CONFIG as well as -config.
+
+// The fields of config by their JSON names
+func configFields(config *ServerConfig) map[string]reflect.Value {
+	fields := make(map[string]reflect.Value)
+	value := reflect.ValueOf(config).Elem()
+	for i := 0; i < value.NumField(); i++ {
+		name := strings.Split(value.Type().Field(i).Tag.Get("json"), ",")[0]
+		if name != "" && name != "-" {
+			fields[name] = value.Field(i)
+		}
+	}
+	return fields
+}
+
+// The environment variable that overrides the field with JSON name
+// name: channelTTLSeconds is PUSH_CHANNEL_TTL_SECONDS
+func overrideVariable(name string) string {
+	runes := []rune(name)
+	var variable strings.Builder
+	variable.WriteString("PUSH_")
+	for i, r := range runes {
+		if i > 0 && unicode.IsUpper(r) {
+			previous := runes[i-1]
+			acronymEnds := unicode.IsUpper(previous) && i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if !unicode.IsUpper(previous) || acronymEnds {
+				variable.WriteByte('_')
+			}
+		}
+		variable.WriteRune(unicode.ToUpper(r))
+	}
+	return variable.String()
+}
+
+// Shorter flags for the settings that say where the server's files are
+var configFlagAliases = map[string]string{
+	"state":     "stateFilename",
+	"templates": "templatesDir",
+}
+
+// Add a flag for every config field to flags, to be applied by
+// applyConfigOverrides once they're parsed
+func registerConfigFlags(flags *flag.FlagSet) {
+	for name := range configFields(&gServerConfig) {
+		flags.String(name, "", fmt.Sprintf("overrides %s in the config file, and %s", name, overrideVariable(name)))
+	}
+	for alias, name := range configFlagAliases {
+		flags.String(alias, "", "same as -"+name)
+	}
+}
+
+func flagWasSet(flags *flag.FlagSet, name string) bool {
+	set := false
+	flags.Visit(func(f *flag.Flag) {
+		set = set || f.Name == name
+	})
+	return set
+}
+
+func setConfigField(field reflect.Value, raw string) error {
+	if field.Kind() == reflect.String {
+		field.SetString(raw)
+		return nil
+	}
+	return json.Unmarshal([]byte(raw), field.Addr().Interface())
+}
+
+// Apply the environment variables, and then the flags set in flags, to
+// gServerConfig
+func applyConfigOverrides(flags *flag.FlagSet) error {
+	fields := configFields(&gServerConfig)
+	for name, field := range fields {
+		if raw, ok := os.LookupEnv(overrideVariable(name)); ok {
+			if err := setConfigField(field, raw); err != nil {
+				return fmt.Errorf("bad %s: %v", overrideVariable(name), err)
+			}
+		}
+	}
+
+	var err error
+	flags.Visit(func(f *flag.Flag) {
+		name := f.Name
+		if alias, ok := configFlagAliases[name]; ok {
+			name = alias
+		}
+		field, ok := fields[name]
+		if !ok || err != nil {
+			return
+		}
+		if setErr := setConfigField(field, f.Value.String()); setErr != nil {
+			err = fmt.Errorf("bad -%s: %v", f.Name, setErr)
+		}
+	})
+	return err
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOverrideVariableNames(t *testing.T) {
+	for name, want := range map[string]string{
+		"port":                 "PUSH_PORT",
+		"notifyPrefix":         "PUSH_NOTIFY_PREFIX",
+		"useTLS":               "PUSH_USE_TLS",
+		"channelTTLSeconds":    "PUSH_CHANNEL_TTL_SECONDS",
+		"allowForeignWakeupIP": "PUSH_ALLOW_FOREIGN_WAKEUP_IP",
+	} {
+		if got := overrideVariable(name); got != want {
+			t.Fatalf("%s is overridden by %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	setupTest(t)
+	gServerConfig.Hostname = "file.example.com"
+	gServerConfig.Port = "8080"
+	gServerConfig.NotifyRate = 1
+
+	t.Setenv("PUSH_PORT", "8081")
+	t.Setenv("PUSH_HOSTNAME", "env.example.com")
+	t.Setenv("PUSH_USE_TLS", "true")
+	t.Setenv("PUSH_PEERS", `["a:8080", "b:8080"]`)
+
+	flags := flag.NewFlagSet("push", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse([]string{"-port", "8082", "-notifyRate", "2.5"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigOverrides(flags); err != nil {
+		t.Fatal(err)
+	}
+
+	config := gServerConfig
+	if config.Port != "8082" || config.Hostname != "env.example.com" || !config.UseTLS ||
+		config.NotifyRate != 2.5 || len(config.Peers) != 2 || config.NotifyPrefix != "/notify/" {
+		t.Fatalf("config with overrides is %+v", config)
+	}
+
+	t.Setenv("PUSH_NOTIFY_RATE", "fast")
+	if err := applyConfigOverrides(flag.NewFlagSet("push", flag.ContinueOnError)); err == nil {
+		t.Fatalf("accepted a notifyRate that isn't a number")
+	}
+}
+
+func TestStateAndTemplatesCanLiveElsewhere(t *testing.T) {
+	setupTest(t)
+	os.Mkdir("state", 0700)
+
+	flags := flag.NewFlagSet("push", flag.ContinueOnError)
+	registerConfigFlags(flags)
+	if err := flags.Parse([]string{"-state", "state/push.json", "-templates", "/etc/push/templates"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigOverrides(flags); err != nil {
+		t.Fatal(err)
+	}
+	if gServerConfig.StateFilename != "state/push.json" || gServerConfig.TemplatesDir != "/etc/push/templates" {
+		t.Fatalf("config with file flags is %+v", gServerConfig)
+	}
+
+	storage, err := newStorage("")
+	if err != nil || storage.(*FileStorage).Filename != "state/push.json" {
+		t.Fatalf("storage is %v, %v", storage, err)
+	}
+	if err := savePendingNotifications([]Notification{{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan"}}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join("state", pendingFilename)); err != nil {
+		t.Fatalf("pending notifications aren't next to the state: %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"time"
+)
+
+// The delivery loop samples the age of its pending notifications once a
+// second. Many of them getting old at once usually means clients are
+// being disconnected en masse, so when the oldest has been older than
+// PendingAgeAlert for PendingAgeAlertFor seconds in a row, the
+// PendingAgeWebhook is fired, and fired again once it recovers.
+
+// Pending notifications are counted into buckets by how many seconds
+// they have been waiting
+var pendingAgeBuckets = []float64{1, 10, 60, 600, 3600}
+
+var pendingByAge = newGaugeVec("push_pending_notifications",
+	"Notifications awaiting an ack for at least older_than seconds", "older_than")
+var pendingDepth = newGauge("push_pending_depth",
+	"Notifications awaiting an ack")
+var oldestPendingAge = newGauge("push_pending_oldest_age_seconds",
+	"Seconds the oldest notification has been awaiting an ack")
+
+type pendingAgeAlarm struct {
+	// when the oldest pending notification got over the threshold,
+	// or zero if it isn't
+	since  time.Time
+	firing bool
+}
+
+var gPendingAgeAlarm pendingAgeAlarm
+
+func samplePendingAges(pending map[string]Notification, now time.Time) {
+	counts := make([]int64, len(pendingAgeBuckets))
+	var oldest time.Duration
+	for _, notification := range pending {
+		age := now.Sub(notification.Queued)
+		if age > oldest {
+			oldest = age
+		}
+		for i, bucket := range pendingAgeBuckets {
+			if age.Seconds() >= bucket {
+				counts[i]++
+			}
+		}
+	}
+
+	for i, bucket := range pendingAgeBuckets {
+		pendingByAge.Set(strconv.FormatFloat(bucket, 'f', -1, 64), counts[i])
+	}
+	pendingDepth.Set(int64(len(pending)))
+	oldestPendingAge.Set(int64(oldest.Seconds()))
+	gPendingAgeAlarm.check(oldest, now)
+}
+
+func (alarm *pendingAgeAlarm) check(oldest time.Duration, now time.Time) {
+	threshold := configDuration(gServerConfig.PendingAgeAlert)
+	if threshold <= 0 {
+		return
+	}
+
+	if oldest <= threshold {
+		alarm.since = time.Time{}
+		if alarm.firing {
+			alarm.firing = false
+			log.Println("Pending notifications are no longer getting old")
+			fireWebhook(gServerConfig.PendingAgeWebhook, "pending-age-resolved", "")
+		}
+		return
+	}
+
+	if alarm.since.IsZero() {
+		alarm.since = now
+	}
+	if !alarm.firing && now.Sub(alarm.since) >= configDuration(gServerConfig.PendingAgeAlertFor) {
+		alarm.firing = true
+		log.Println("Oldest pending notification has been waiting ", oldest)
+		fireWebhook(gServerConfig.PendingAgeWebhook, "pending-age", "")
+	}
+}
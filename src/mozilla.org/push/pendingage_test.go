@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSustainedOldPendingFiresWebhook(t *testing.T) {
+	setupTest(t)
+	events := make(chan string, 10)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var hook webhook
+		json.NewDecoder(r.Body).Decode(&hook)
+		events <- hook.Event
+	}))
+	defer receiver.Close()
+
+	gServerConfig.PendingAgeWebhook = receiver.URL
+	gServerConfig.PendingAgeAlert = 60
+	gServerConfig.PendingAgeAlertFor = 30
+	startWebhooks()
+	defer func() {
+		close(webhookQueue)
+		webhookQueue = nil
+	}()
+
+	expect := func(want string) {
+		t.Helper()
+		select {
+		case event := <-events:
+			if event != want {
+				t.Fatalf("webhook got %q, want %q", event, want)
+			}
+		case <-time.After(100 * time.Millisecond):
+			if want != "" {
+				t.Fatalf("webhook %q was never fired", want)
+			}
+		}
+	}
+
+	start := time.Now()
+	pending := map[string]Notification{
+		"old": {UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "old", Version: 1}, Queued: start.Add(-2 * time.Minute)},
+		"new": {UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "new", Version: 1}, Queued: start},
+	}
+	samplePendingAges(pending, start)
+	if pendingByAge.Value("60") != 1 || pendingByAge.Value("1") != 1 || oldestPendingAge.Value() != 120 {
+		t.Fatalf("pending ages sampled as %d over 60s, %d over 1s, oldest %ds",
+			pendingByAge.Value("60"), pendingByAge.Value("1"), oldestPendingAge.Value())
+	}
+	// old, but not for long enough yet
+	expect("")
+
+	samplePendingAges(pending, start.Add(30*time.Second))
+	expect("pending-age")
+	samplePendingAges(pending, start.Add(31*time.Second))
+	expect("")
+
+	delete(pending, "old")
+	samplePendingAges(pending, start.Add(32*time.Second))
+	expect("pending-age-resolved")
+}
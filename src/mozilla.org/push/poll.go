@@ -0,0 +1,196 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Clients that can't hold a websocket can long-poll instead. A GET to
+// /poll/{uaid} stands in for the connection while it lasts: it waits
+// for the messages a websocket would have been sent, and returns them
+// as soon as there are any. Acks are POSTed to /poll/{uaid}/ack in the
+// same form as over the websocket.
+//
+// Polling needs the UAID's poll token, which is handed out in the
+// hello response when PollSecret is set.
+
+// The poll token for uaid, or "" if polling is disabled
+func pollToken(uaid string) string {
+	if gServerConfig.PollSecret == "" {
+		return ""
+	}
+	mac := hmac.New(sha256.New, []byte(gServerConfig.PollSecret))
+	mac.Write([]byte(uaid))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the request carries uaid's poll token, replying with an error
+// if it doesn't
+func pollAuthorized(w http.ResponseWriter, r *http.Request, uaid string) bool {
+	want := pollToken(uaid)
+	if want == "" {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Polling is disabled."))
+		return false
+	}
+
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Unauthorized."))
+		return false
+	}
+	return true
+}
+
+// Take over uaid's entry in ConnectedClients for the length of a poll
+// or stream. If uaid is already connected, the poll or stream is added
+// to its Transports instead when the DeliveryPolicy allows it, and
+// nil is returned when it doesn't. A websocket client that went away
+// but can still be woken up over UDP keeps its entry too, so that it
+// is woken again once the poll or stream is over.
+func attachClient(uaid string) *Client {
+	client := newClient(nil)
+	client.UAID = uaid
+	client.attached = true
+
+	gServerState.Lock()
+	previous, ok := gServerState.ConnectedClients[uaid]
+	if ok && previous.online() {
+		if gServerConfig.DeliveryPolicy == "" {
+			gServerState.Unlock()
+			return nil
+		}
+		gServerState.Transports[uaid] = append(gServerState.Transports[uaid], client)
+	} else if ok && previous != nil && previous.Ip != "" {
+		// deliveryTargets skips the offline client, so the poll or
+		// stream is still the one delivered to
+		gServerState.Transports[uaid] = append(gServerState.Transports[uaid], client)
+	} else {
+		gServerState.ConnectedClients[uaid] = client
+	}
+	gServerState.Unlock()
+
+	requestRedelivery(uaid)
+	return client
+}
+
+func detachClient(client *Client) {
+	close(client.done)
+	gServerState.Lock()
+	if gServerState.ConnectedClients[client.UAID] == client {
+		delete(gServerState.ConnectedClients, client.UAID)
+	}
+	transports := gServerState.Transports[client.UAID]
+	for i, transport := range transports {
+		if transport == client {
+			transports = append(transports[:i:i], transports[i+1:]...)
+			break
+		}
+	}
+	if len(transports) == 0 {
+		delete(gServerState.Transports, client.UAID)
+	} else {
+		gServerState.Transports[client.UAID] = transports
+	}
+	gServerState.Unlock()
+}
+
+func pollHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/poll/"), "/")
+	uaid := parts[0]
+	if uaid == "" || len(parts) > 2 || (len(parts) == 2 && parts[1] != "ack") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found."))
+		return
+	}
+	if !pollAuthorized(w, r, uaid) {
+		return
+	}
+
+	if len(parts) == 2 {
+		pollAck(w, r, uaid)
+		return
+	}
+	if r.Method != "GET" {
+		w.Header().Set("Allow", "GET")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Method must be GET."))
+		return
+	}
+
+	client := attachClient(uaid)
+	if client == nil {
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte("UAID is connected over a websocket."))
+		return
+	}
+	defer detachClient(client)
+
+	timeout := configDuration(gServerConfig.PollTimeout)
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var messages []json.RawMessage
+	select {
+	case message := <-client.outgoing:
+		messages = append(messages, json.RawMessage(message))
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	// return whatever else is already waiting along with it
+	for len(client.outgoing) > 0 {
+		messages = append(messages, json.RawMessage(<-client.outgoing))
+	}
+
+	j, err := json.Marshal(struct {
+		Messages []json.RawMessage `json:"messages"`
+	}{messages})
+	if err != nil {
+		log.Println("Could not convert poll response to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// Acks from polling clients, in the body of a POST to /poll/{uaid}/ack
+func pollAck(w http.ResponseWriter, r *http.Request, uaid string) {
+	if !requirePost(w, r) {
+		return
+	}
+
+	var f map[string]interface{}
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Could not parse ack."))
+		return
+	}
+	if _, ok := f["updates"].([]interface{}); !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Ack has no updates."))
+		return
+	}
+
+	client := newClient(nil)
+	client.UAID = uaid
+	handleAck(client, f)
+	w.Write([]byte("OK"))
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func pollRequest(method, url, token, body string) *http.Request {
+	r := httptest.NewRequest(method, url, strings.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	return r
+}
+
+// The client connected for uaid, if any, looked up while handlers may
+// be running
+func connectedClient(uaid string) *Client {
+	gServerState.RLock()
+	defer gServerState.RUnlock()
+	return gServerState.ConnectedClients[uaid]
+}
+
+// Wait for a poll for uaid to be waiting for messages
+func waitForPoll(t *testing.T, uaid string) {
+	for i := 0; i < 100; i++ {
+		gServerState.RLock()
+		online := len(deliveryTargets(uaid)) > 0
+		gServerState.RUnlock()
+		if online {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("poll for %s never started", uaid)
+}
+
+func TestLongPollGetsNotification(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	channel := addTestChannel("uaid", "chan", 4)
+	token := pollToken("uaid")
+
+	w := httptest.NewRecorder()
+	pollHandler(w, pollRequest("GET", "/poll/uaid", pollToken("other"), ""))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("poll with another UAID's token got status %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		pollHandler(w, pollRequest("GET", "/poll/uaid", token, ""))
+		close(done)
+	}()
+	waitForPoll(t, "uaid")
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	<-done
+
+	var response struct {
+		Messages []struct {
+			Name    string    `json:"messageType"`
+			Updates []Channel `json:"updates"`
+		} `json:"messages"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("poll got %d %s: %s", w.Code, w.Body.String(), err)
+	}
+	if len(response.Messages) != 1 || response.Messages[0].Name != "notification" ||
+		response.Messages[0].Updates[0] != *channel {
+		t.Fatalf("poll got %s", w.Body.String())
+	}
+	if _, ok := gServerState.ConnectedClients["uaid"]; ok {
+		t.Fatalf("finished poll left a client behind")
+	}
+
+	ackChan = make(chan []Ack, 1)
+	w = httptest.NewRecorder()
+	pollHandler(w, pollRequest("POST", "/poll/uaid/ack", token,
+		`{"updates": [{"channelID": "chan", "version": 4}]}`))
+	if acks := <-ackChan; w.Code != http.StatusOK || len(acks) != 1 ||
+		acks[0].ChannelID != "chan" || acks[0].Version != 4 {
+		t.Fatalf("poll ack got %d and sent %+v", w.Code, acks)
+	}
+}
+
+func TestLongPollTimesOut(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	gServerConfig.PollTimeout = 0.05
+
+	w := httptest.NewRecorder()
+	pollHandler(w, pollRequest("GET", "/poll/uaid", pollToken("uaid"), ""))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("idle poll got status %d, want 204", w.Code)
+	}
+}
+
+// Attach two transports for uaid under policy, with a delivery loop
+// running, and send them a notification for chan
+func deliverToTwoTransports(t *testing.T, policy string) (first, second *Client) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	gServerConfig.DeliveryPolicy = policy
+	channel := addTestChannel("uaid", "chan", 4)
+
+	first, second = attachClient("uaid"), attachClient("uaid")
+	if first == nil || second == nil {
+		t.Fatalf("could not attach two transports with policy %q", policy)
+	}
+	// made after attaching, so that the redeliveries attaching asks
+	// for can't send extra copies
+	redeliverChan = make(chan string, 1)
+
+	notifyChan = make(chan Notification)
+	ackChan = make(chan []Ack)
+	startTestDelivery(t, notifyChan, ackChan)
+	snapshot := *channel
+	notifyChan <- Notification{UAID: "uaid", Channel: &snapshot}
+	return first, second
+}
+
+func received(client *Client) bool {
+	select {
+	case <-client.outgoing:
+		return true
+	case <-time.After(50 * time.Millisecond):
+		return false
+	}
+}
+
+func TestSingleDeliveryAcrossTransports(t *testing.T) {
+	first, second := deliverToTwoTransports(t, "primary")
+	defer detachClient(second)
+	if !received(first) || received(second) {
+		t.Fatalf("notification did not go to the first transport alone")
+	}
+
+	// an ack from the other transport clears it for both
+	w := httptest.NewRecorder()
+	pollHandler(w, pollRequest("POST", "/poll/uaid/ack", pollToken("uaid"),
+		`{"updates": [{"channelID": "chan", "version": 4}]}`))
+	if w.Code != http.StatusOK {
+		t.Fatalf("ack got status %d", w.Code)
+	}
+	requestRedelivery("uaid")
+	if received(first) || received(second) {
+		t.Fatalf("acked notification was delivered again")
+	}
+
+	// once the first transport goes, the second takes over
+	detachClient(first)
+	notifyChan <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: 5}}
+	if !received(second) {
+		t.Fatalf("remaining transport did not get the notification")
+	}
+}
+
+func TestFanOutAcrossTransports(t *testing.T) {
+	first, second := deliverToTwoTransports(t, "all")
+	defer detachClient(first)
+	defer detachClient(second)
+	if !received(first) || !received(second) {
+		t.Fatalf("notification did not go to every transport")
+	}
+}
+
+func TestOneTransportByDefault(t *testing.T) {
+	setupTest(t)
+	first := attachClient("uaid")
+	defer detachClient(first)
+	if second := attachClient("uaid"); second != nil {
+		detachClient(second)
+		t.Fatalf("second transport attached without a delivery policy")
+	}
+}
+
+// Say hello for uaid with a wakeup address and hang up, leaving the
+// client offline but wakeable. Wakeups are sent to the returned
+// channel instead of over UDP.
+func helloWakeable(t *testing.T, uaid string) chan *Client {
+	startWakeups()
+	woken := make(chan *Client, 1)
+	wakeup = func(client *Client, channelID string) error {
+		woken <- client
+		return nil
+	}
+	t.Cleanup(func() { wakeup = wakeupClient })
+
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	exchange(t, ws, map[string]interface{}{"messageType": "hello", "uaid": uaid,
+		"wakeup_hostport": map[string]interface{}{"ip": "127.0.0.1", "port": 9.0}})
+	ws.Close()
+	for i := 0; i < 100; i++ {
+		gServerState.RLock()
+		online := len(deliveryTargets(uaid)) > 0
+		gServerState.RUnlock()
+		if !online {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return woken
+}
+
+// Check that a notification for uaid wakes up the client helloWakeable
+// left behind
+func checkWokenUp(t *testing.T, woken chan *Client, channel *Channel) {
+	attemptDelivery(Notification{UAID: channel.UAID, Channel: channel})
+	select {
+	case client := <-woken:
+		if client.Ip != "127.0.0.1" || client.Port != 9 {
+			t.Fatalf("woke up %s:%v", client.Ip, client.Port)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("client was not woken up")
+	}
+}
+
+func TestPollKeepsWakeupAddress(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	channel := addTestChannel("uaid", "chan", 4)
+	woken := helloWakeable(t, "uaid")
+
+	w := httptest.NewRecorder()
+	done := make(chan bool)
+	go func() {
+		pollHandler(w, pollRequest("GET", "/poll/uaid", pollToken("uaid"), ""))
+		close(done)
+	}()
+	waitForPoll(t, "uaid")
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	<-done
+	if w.Code != http.StatusOK {
+		t.Fatalf("poll got status %d", w.Code)
+	}
+	select {
+	case <-woken:
+		t.Fatalf("client was woken up while it was polling")
+	default:
+	}
+
+	// once the poll is over, the UAID can be woken up again
+	checkWokenUp(t, woken, channel)
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Marshal v to JSON, renaming fields as the named profile says. Fields
+// of nested objects are renamed too, so that a profile applies to the
+// channels in a notification as well as to the message itself.
+func marshalFor(profile string, v interface{}) ([]byte, error) {
+	j, err := json.Marshal(v)
+	renames := gServerConfig.Profiles[profile]
+	if err != nil || len(renames) == 0 {
+		return j, err
+	}
+
+	// keep numbers as they are; versions don't fit in a float64
+	var decoded interface{}
+	dec := json.NewDecoder(bytes.NewReader(j))
+	dec.UseNumber()
+	if err = dec.Decode(&decoded); err != nil {
+		return nil, err
+	}
+	return json.Marshal(renameFields(decoded, renames))
+}
+
+func renameFields(v interface{}, renames map[string]string) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		renamed := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			if name, ok := renames[key]; ok {
+				key = name
+			}
+			renamed[key] = renameFields(value, renames)
+		}
+		return renamed
+
+	case []interface{}:
+		for i := range v {
+			v[i] = renameFields(v[i], renames)
+		}
+	}
+	return v
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// The fields of the next message sent to client
+func receiveFields(t *testing.T, client *Client) map[string]json.RawMessage {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(<-client.outgoing), &fields); err != nil {
+		t.Fatal(err)
+	}
+	return fields
+}
+
+func TestProfilesRenameFields(t *testing.T) {
+	for _, profile := range []struct {
+		name, uaid, pushEndpoint string
+	}{
+		{"", "uaid", "pushEndpoint"},
+		{"device", "deviceID", "endpoint"},
+	} {
+		setupTest(t)
+		gServerConfig.Profiles = map[string]map[string]string{
+			"device": {"uaid": "deviceID", "pushEndpoint": "endpoint"},
+		}
+
+		client := newClient(nil)
+		handleHello(client, map[string]interface{}{"uaid": "uaid", "profile": profile.name})
+		if hello := receiveFields(t, client); hello[profile.uaid] == nil || len(hello) != 4 {
+			t.Fatalf("hello with profile %q sent %v", profile.name, hello)
+		}
+
+		handleRegister(client, map[string]interface{}{"channelID": "chan"})
+		if register := receiveFields(t, client); register[profile.pushEndpoint] == nil {
+			t.Fatalf("register with profile %q sent %v", profile.name, register)
+		}
+
+		sendNotificationToClient(client, &Channel{UAID: "uaid", ChannelID: "chan", Version: 1 << 60})
+		var notification struct {
+			Updates []map[string]json.RawMessage `json:"updates"`
+		}
+		json.Unmarshal([]byte(<-client.outgoing), &notification)
+		update := notification.Updates[0]
+		if update[profile.uaid] == nil || string(update["version"]) != "1152921504606846976" {
+			t.Fatalf("notification with profile %q sent %v", profile.name, update)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// With NotifyRate set, each channel can be notified NotifyRate times a
+// second on average, in bursts of up to NotifyBurst, so that one noisy
+// app server can't crowd out the rest. Notifies over the limit get a
+// 429 with a Retry-After.
+
+var notifiesLimited = newCounter("push_notifies_rate_limited_total",
+	"Notifies refused because their channel was over notifyRate")
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+type rateLimiter struct {
+	sync.Mutex
+	buckets   map[string]*tokenBucket
+	lastPrune time.Time
+}
+
+var gNotifyLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+
+func notifyBurst(rate float64) float64 {
+	if burst := float64(gServerConfig.NotifyBurst); burst > 0 {
+		return burst
+	}
+	return math.Max(1, math.Ceil(rate))
+}
+
+// Take a token for key, or say how long until there is one
+func (limiter *rateLimiter) allow(key string, now time.Time) (bool, time.Duration) {
+	rate := gServerConfig.NotifyRate
+	if rate <= 0 {
+		return true, 0
+	}
+	burst := notifyBurst(rate)
+
+	limiter.Lock()
+	defer limiter.Unlock()
+
+	// a bucket that has had time to fill up again is as good as none
+	if now.Sub(limiter.lastPrune) > time.Minute {
+		limiter.lastPrune = now
+		for other, bucket := range limiter.buckets {
+			if now.Sub(bucket.last).Seconds()*rate >= burst {
+				delete(limiter.buckets, other)
+			}
+		}
+	}
+
+	bucket, ok := limiter.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: burst, last: now}
+		limiter.buckets[key] = bucket
+	}
+	bucket.tokens = math.Min(burst, bucket.tokens+now.Sub(bucket.last).Seconds()*rate)
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false, time.Duration((1 - bucket.tokens) / rate * float64(time.Second))
+	}
+	bucket.tokens--
+	return true, 0
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	setupTest(t)
+	gServerConfig.NotifyRate = 2
+	gServerConfig.NotifyBurst = 3
+	limiter := rateLimiter{buckets: make(map[string]*tokenBucket)}
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.allow("chan", now); !ok {
+			t.Fatalf("notify %d of a burst was refused", i)
+		}
+	}
+	ok, wait := limiter.allow("chan", now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("notify past the burst got %v, wait %v", ok, wait)
+	}
+	if ok, _ := limiter.allow("other", now); !ok {
+		t.Fatalf("another channel was limited too")
+	}
+
+	if ok, _ := limiter.allow("chan", now.Add(500*time.Millisecond)); !ok {
+		t.Fatalf("notify was refused after the bucket refilled")
+	}
+
+	// full buckets are forgotten
+	limiter.allow("other", now.Add(2*time.Minute))
+	if _, ok := limiter.buckets["chan"]; ok {
+		t.Fatalf("idle bucket was kept")
+	}
+}
+
+func TestNotifyIsRateLimited(t *testing.T) {
+	setupTest(t)
+	gServerConfig.NotifyRate = 0.01
+	gServerConfig.NotifyBurst = 1
+	gNotifyLimiter = rateLimiter{buckets: make(map[string]*tokenBucket)}
+	channel := addTestChannel("uaid", "chan", 1)
+
+	if w, _ := notify(t, "chan", ""); w.Code != http.StatusOK {
+		t.Fatalf("first notify got status %d", w.Code)
+	}
+	w, n := notify(t, "chan", "")
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") != "100" || n != nil {
+		t.Fatalf("notify over the limit got status %d, Retry-After %q", w.Code, w.Header().Get("Retry-After"))
+	}
+	if channel.Version != 2 {
+		t.Fatalf("limited notify bumped the version to %d", channel.Version)
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RedisStorage keeps the state in Redis, so that several servers can
+// share it. Everything is kept in small keys, so that servers only
+// ever write what they changed themselves: each channel is its own
+// key, channel:<channelID>, next to its version under
+// version:<channelID>, and so are each topic subscription, and each
+// channel's history, minimum interval and strictness.
+//
+// A server only writes the keys whose values changed since it loaded
+// or last wrote them, and only deletes the ones it knew and removed
+// itself. Channels are written with redisPutChannels, so a save never
+// overwrites a newer version written by another server, nor brings
+// back a channel another server unregistered.
+type RedisStorage struct {
+	client *redisClient
+	// The values this server loaded or wrote last, by key
+	written map[string]string
+
+	// Guards written, and keeps puts and saves from racing each
+	// other
+	putLock sync.Mutex
+}
+
+const (
+	redisChannelPrefix      = "channel:"
+	redisVersionPrefix      = "version:"
+	redisSubscriptionPrefix = "subscription:"
+	redisHistoryPrefix      = "history:"
+	redisIntervalPrefix     = "interval:"
+	redisStrictPrefix       = "strict:"
+)
+
+// Older versions kept everything but the channels in one key
+const redisLegacyStateKey = "state"
+
+func newRedisStorage(address, password string) *RedisStorage {
+	return &RedisStorage{client: &redisClient{address: address, password: password},
+		written: make(map[string]string)}
+}
+
+// The parts of the state older versions saved under the "state" key
+type redisExtraState struct {
+	TopicToUAIDs       map[string]map[string]bool `json:"topicToUAIDs"`
+	MinNotifyIntervals map[string]float64         `json:"minNotifyIntervals"`
+	StrictChannels     map[string]bool            `json:"strictChannels"`
+	History            map[string][]HistoryEntry  `json:"history"`
+}
+
+// A subscription of uaid to topic is kept under the key
+// subscription:["<uaid>","<topic>"]
+func redisSubscriptionKey(uaid, topic string) string {
+	j, _ := json.Marshal([]string{uaid, topic})
+	return redisSubscriptionPrefix + string(j)
+}
+
+// The keys and values state is kept as. Callers hold the read lock.
+func redisEntries(state *ServerState) (map[string]string, error) {
+	entries := make(map[string]string)
+	put := func(key string, value interface{}) error {
+		j, err := json.Marshal(value)
+		if err == nil {
+			entries[key] = string(j)
+		}
+		return err
+	}
+
+	for channelID, channel := range state.ChannelIDToChannel {
+		if err := put(redisChannelPrefix+channelID, channel); err != nil {
+			return nil, err
+		}
+	}
+	for topic, uaids := range state.TopicToUAIDs {
+		for uaid, subscribed := range uaids {
+			if subscribed {
+				entries[redisSubscriptionKey(uaid, topic)] = "true"
+			}
+		}
+	}
+	for channelID, history := range state.History {
+		if err := put(redisHistoryPrefix+channelID, history); err != nil {
+			return nil, err
+		}
+	}
+	for channelID, interval := range state.MinNotifyIntervals {
+		if err := put(redisIntervalPrefix+channelID, interval); err != nil {
+			return nil, err
+		}
+	}
+	for channelID, strict := range state.StrictChannels {
+		if strict {
+			entries[redisStrictPrefix+channelID] = "true"
+		}
+	}
+	return entries, nil
+}
+
+// Take the value of key, as saved by redisEntries, into state
+func loadRedisEntry(state *ServerState, key, value string) error {
+	switch {
+	case strings.HasPrefix(key, redisChannelPrefix):
+		channel, err := decodeRedisChannel(value)
+		if err == nil && channel != nil {
+			state.addChannel(channel)
+		}
+		return err
+
+	case strings.HasPrefix(key, redisSubscriptionPrefix):
+		var names []string
+		err := json.Unmarshal([]byte(strings.TrimPrefix(key, redisSubscriptionPrefix)), &names)
+		if err != nil || len(names) != 2 {
+			return fmt.Errorf("bad subscription key %q", key)
+		}
+		state.subscribe(names[0], names[1])
+
+	case strings.HasPrefix(key, redisHistoryPrefix):
+		var history []HistoryEntry
+		if err := json.Unmarshal([]byte(value), &history); err != nil {
+			return err
+		}
+		state.History[strings.TrimPrefix(key, redisHistoryPrefix)] = history
+
+	case strings.HasPrefix(key, redisIntervalPrefix):
+		interval, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		state.MinNotifyIntervals[strings.TrimPrefix(key, redisIntervalPrefix)] = interval
+
+	case strings.HasPrefix(key, redisStrictPrefix):
+		state.StrictChannels[strings.TrimPrefix(key, redisStrictPrefix)] = true
+	}
+	return nil
+}
+
+func (storage *RedisStorage) Load(state *ServerState) error {
+	var keys []string
+	for _, prefix := range []string{redisChannelPrefix, redisSubscriptionPrefix,
+		redisHistoryPrefix, redisIntervalPrefix, redisStrictPrefix} {
+		found, err := storage.client.scan(prefix + "*")
+		if err != nil {
+			return err
+		}
+		keys = append(keys, found...)
+	}
+
+	state.UAIDToChannelIDs = make(map[string]ChannelIDSet)
+	state.ChannelIDToChannel = make(ChannelIDSet)
+	state.TopicToUAIDs = make(map[string]map[string]bool)
+	state.MinNotifyIntervals = make(map[string]float64)
+	state.StrictChannels = make(map[string]bool)
+	state.History = make(map[string][]HistoryEntry)
+	written := make(map[string]string)
+
+	reply, err := storage.client.do("GET", redisLegacyStateKey)
+	if err != nil {
+		return err
+	}
+	if extra, ok := reply.(string); ok {
+		var decoded redisExtraState
+		if err = json.Unmarshal([]byte(extra), &decoded); err != nil {
+			log.Println("Dropping the rest of the saved state: ", err)
+		}
+		for topic, uaids := range decoded.TopicToUAIDs {
+			for uaid := range uaids {
+				state.subscribe(uaid, topic)
+			}
+		}
+		for channelID, interval := range decoded.MinNotifyIntervals {
+			state.MinNotifyIntervals[channelID] = interval
+		}
+		for channelID, strict := range decoded.StrictChannels {
+			state.StrictChannels[channelID] = strict
+		}
+		for channelID, history := range decoded.History {
+			state.History[channelID] = history
+		}
+		// the next save moves it to its own keys, and deletes it
+		written[redisLegacyStateKey] = extra
+	}
+
+	for len(keys) > 0 {
+		batch := keys
+		if len(batch) > 100 {
+			batch = batch[:100]
+		}
+		keys = keys[len(batch):]
+
+		reply, err := storage.client.do(append([]string{"MGET"}, batch...)...)
+		if err != nil {
+			return err
+		}
+		values, _ := reply.([]interface{})
+		for i, value := range values {
+			value, ok := value.(string)
+			if !ok {
+				// deleted since the scan
+				continue
+			}
+			if err := loadRedisEntry(state, batch[i], value); err != nil {
+				log.Println("Dropping ", batch[i], ": ", err)
+				continue
+			}
+			written[batch[i]] = value
+		}
+	}
+
+	storage.putLock.Lock()
+	storage.written = written
+	storage.putLock.Unlock()
+	if len(written) == 0 {
+		return errNoSavedState
+	}
+	return nil
+}
+
+// Sets channel keys, and their version keys, unless a newer version is
+// already saved. KEYS has a channel key and its version key for each
+// channel, and ARGV its value, its version, "known" if this server
+// saved or loaded it before, in which case it is only set if it still
+// exists, and the version it reverts, if any, which it may replace
+// even though it's newer. Versions are compared as decimal strings,
+// as Lua numbers can't hold all of them.
+const redisPutChannels = `
+for n = 1, #KEYS / 2 do
+  local key, versionKey = KEYS[2 * n - 1], KEYS[2 * n]
+  local value, version, known, reverts = ARGV[4 * n - 3], ARGV[4 * n - 2], ARGV[4 * n - 1], ARGV[4 * n]
+  local saved = redis.call('GET', versionKey)
+  local newer = saved and saved ~= reverts and (#saved > #version or (#saved == #version and saved > version))
+  local gone = known == 'known' and redis.call('EXISTS', key) == 0
+  if not newer and not gone then
+    redis.call('MSET', key, value, versionKey, version)
+  end
+end
+return 'OK'
+`
+
+// Write the channel entries among entries with redisPutChannels, over
+// the versions in reverts. Called with putLock held.
+func (storage *RedisStorage) putChannels(entries map[string]string, versions, reverts map[string]uint64) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	keys := make([]string, 0, 2*len(entries))
+	args := make([]string, 0, 4*len(entries))
+	for key, value := range entries {
+		channelID := strings.TrimPrefix(key, redisChannelPrefix)
+		known := ""
+		if _, ok := storage.written[key]; ok {
+			known = "known"
+		}
+		reverted := ""
+		if from, ok := reverts[key]; ok {
+			reverted = strconv.FormatUint(from, 10)
+		}
+		keys = append(keys, key, redisVersionPrefix+channelID)
+		args = append(args, value, strconv.FormatUint(versions[key], 10), known, reverted)
+	}
+	command := append([]string{"EVAL", redisPutChannels, strconv.Itoa(len(keys))}, keys...)
+	_, err := storage.client.do(append(command, args...)...)
+	return err
+}
+
+func (storage *RedisStorage) Save(state *ServerState) error {
+	state.RLock()
+	entries, err := redisEntries(state)
+	versions := make(map[string]uint64, len(state.ChannelIDToChannel))
+	for channelID, channel := range state.ChannelIDToChannel {
+		versions[redisChannelPrefix+channelID] = channel.Version
+	}
+	state.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	storage.putLock.Lock()
+	defer storage.putLock.Unlock()
+
+	channels := make(map[string]string)
+	set := []string{"MSET"}
+	removed := []string{"DEL"}
+	for key, value := range entries {
+		if written, ok := storage.written[key]; ok && written == value {
+			continue
+		}
+		if strings.HasPrefix(key, redisChannelPrefix) {
+			channels[key] = value
+		} else {
+			set = append(set, key, value)
+		}
+	}
+	for key := range storage.written {
+		if _, ok := entries[key]; !ok {
+			removed = append(removed, key)
+			if strings.HasPrefix(key, redisChannelPrefix) {
+				removed = append(removed, redisVersionPrefix+strings.TrimPrefix(key, redisChannelPrefix))
+			}
+		}
+	}
+
+	if err = storage.putChannels(channels, versions, nil); err != nil {
+		return err
+	}
+	for key, value := range channels {
+		storage.written[key] = value
+	}
+	if len(set) > 1 {
+		if _, err = storage.client.do(set...); err != nil {
+			return err
+		}
+		for i := 1; i < len(set); i += 2 {
+			storage.written[set[i]] = set[i+1]
+		}
+	}
+	if len(removed) > 1 {
+		if _, err = storage.client.do(removed...); err != nil {
+			return err
+		}
+		for _, key := range removed[1:] {
+			delete(storage.written, key)
+		}
+	}
+	return nil
+}
+
+func (storage *RedisStorage) PutChannels(state *ServerState, channels []*Channel) error {
+	return storage.RevertChannels(state, channels, nil)
+}
+
+// Like PutChannels, but each channel may go back from the version in
+// from, as long as no other server saved another since
+func (storage *RedisStorage) RevertChannels(state *ServerState, channels []*Channel, from []uint64) error {
+	storage.putLock.Lock()
+	defer storage.putLock.Unlock()
+
+	entries := make(map[string]string, len(channels))
+	versions := make(map[string]uint64, len(channels))
+	reverts := make(map[string]uint64, len(from))
+	state.RLock()
+	for i, channel := range channels {
+		j, err := json.Marshal(channel)
+		if err != nil {
+			state.RUnlock()
+			return err
+		}
+		key := redisChannelPrefix + channel.ChannelID
+		entries[key] = string(j)
+		versions[key] = channel.Version
+		if from != nil {
+			reverts[key] = from[i]
+		}
+	}
+	state.RUnlock()
+
+	if err := storage.putChannels(entries, versions, reverts); err != nil {
+		return err
+	}
+	for key, value := range entries {
+		storage.written[key] = value
+	}
+	return nil
+}
+
+// Redis answers a PING
+func (storage *RedisStorage) Check() error {
+	_, err := storage.client.do("PING")
+	return err
+}
+
+// Look up a single channel, which may have been registered on another
+// server. Returns nil if there is no such channel. The channel counts
+// as loaded, so saves leave it alone, or write it only while it still
+// exists.
+func (storage *RedisStorage) LoadChannel(channelID string) (*Channel, error) {
+	storage.putLock.Lock()
+	defer storage.putLock.Unlock()
+
+	key := redisChannelPrefix + channelID
+	reply, err := storage.client.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := decodeRedisChannel(reply)
+	if err == nil && channel != nil {
+		storage.written[key] = reply.(string)
+	}
+	return channel, err
+}
+
+func decodeRedisChannel(value interface{}) (*Channel, error) {
+	j, ok := value.(string)
+	if !ok {
+		return nil, nil
+	}
+	var channel Channel
+	if err := json.Unmarshal([]byte(j), &channel); err != nil {
+		return nil, err
+	}
+	return &channel, nil
+}
+
+// Just enough of a Redis client for RedisStorage. Commands take turns
+// on a single connection, which is dialed again when it breaks.
+type redisClient struct {
+	sync.Mutex
+	address  string
+	password string
+
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+// An error reply from the server, as opposed to a broken connection
+type redisError string
+
+func (err redisError) Error() string {
+	return "redis: " + string(err)
+}
+
+// Run a command and return its reply: a string, an int64, a slice of
+// replies, or nil
+func (client *redisClient) do(args ...string) (interface{}, error) {
+	client.Lock()
+	defer client.Unlock()
+
+	// a connection that went away since the last command is
+	// only noticed now, so give it one more try
+	reply, err := client.roundTrip(args)
+	if _, failed := err.(redisError); err != nil && !failed {
+		log.Println("Lost the Redis connection, reconnecting: ", err)
+		reply, err = client.roundTrip(args)
+	}
+	return reply, err
+}
+
+func (client *redisClient) roundTrip(args []string) (interface{}, error) {
+	if client.conn == nil {
+		if err := client.dial(); err != nil {
+			return nil, err
+		}
+	}
+
+	reply, err := client.send(args)
+	if _, failed := err.(redisError); err != nil && !failed {
+		client.conn.Close()
+		client.conn = nil
+	}
+	return reply, err
+}
+
+func (client *redisClient) dial() error {
+	connectTimeout := configDuration(gServerConfig.OutboundConnectTimeout)
+	if connectTimeout <= 0 {
+		connectTimeout = 5 * time.Second
+	}
+	conn, err := net.DialTimeout("tcp", client.address, connectTimeout)
+	if err != nil {
+		return err
+	}
+	client.conn, client.reader = conn, bufio.NewReader(conn)
+
+	if client.password != "" {
+		if _, err = client.send([]string{"AUTH", client.password}); err != nil {
+			conn.Close()
+			client.conn = nil
+			return err
+		}
+	}
+	return nil
+}
+
+func (client *redisClient) send(args []string) (interface{}, error) {
+	timeout := configDuration(gServerConfig.OutboundTimeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	client.conn.SetDeadline(time.Now().Add(timeout))
+
+	var command strings.Builder
+	fmt.Fprintf(&command, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&command, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := io.WriteString(client.conn, command.String()); err != nil {
+		return nil, err
+	}
+	return readRedisReply(client.reader)
+}
+
+// All the keys matching pattern
+func (client *redisClient) scan(pattern string) ([]string, error) {
+	var keys []string
+	cursor := "0"
+	for {
+		reply, err := client.do("SCAN", cursor, "MATCH", pattern, "COUNT", "1000")
+		if err != nil {
+			return nil, err
+		}
+		parts, _ := reply.([]interface{})
+		if len(parts) != 2 {
+			return nil, errors.New("redis: unexpected SCAN reply")
+		}
+		cursor, _ = parts[0].(string)
+		found, _ := parts[1].([]interface{})
+		for _, key := range found {
+			if key, ok := key.(string); ok {
+				keys = append(keys, key)
+			}
+		}
+		if cursor == "0" || cursor == "" {
+			return keys, nil
+		}
+	}
+}
+
+func readRedisReply(reader *bufio.Reader) (interface{}, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return nil, redisError(line[1:])
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err = io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		replies := make([]interface{}, n)
+		for i := range replies {
+			// an error inside an array is just another element
+			if replies[i], err = readRedisReply(reader); err != nil {
+				if _, failed := err.(redisError); !failed {
+					return nil, err
+				}
+				replies[i] = err
+			}
+		}
+		return replies, nil
+	}
+	return nil, fmt.Errorf("redis: unexpected reply %q", line)
+}
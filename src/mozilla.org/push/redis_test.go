@@ -0,0 +1,389 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Speaks enough of the Redis protocol for RedisStorage
+type fakeRedis struct {
+	sync.Mutex
+	password string
+	data     map[string]string
+	conns    []net.Conn
+	listener net.Listener
+}
+
+func startFakeRedis(t *testing.T, password string) *fakeRedis {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	redis := &fakeRedis{password: password, data: make(map[string]string), listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			redis.Lock()
+			redis.conns = append(redis.conns, conn)
+			redis.Unlock()
+			go redis.serve(conn)
+		}
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		redis.dropConnections()
+	})
+	return redis
+}
+
+func (redis *fakeRedis) address() string {
+	return redis.listener.Addr().String()
+}
+
+func (redis *fakeRedis) dropConnections() {
+	redis.Lock()
+	defer redis.Unlock()
+	for _, conn := range redis.conns {
+		conn.Close()
+	}
+	redis.conns = nil
+}
+
+func (redis *fakeRedis) get(key string) (string, bool) {
+	redis.Lock()
+	defer redis.Unlock()
+	value, ok := redis.data[key]
+	return value, ok
+}
+
+func (redis *fakeRedis) serve(conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	authenticated := redis.password == ""
+	for {
+		command, err := readRedisReply(reader)
+		if err != nil {
+			return
+		}
+		var args []string
+		for _, arg := range command.([]interface{}) {
+			args = append(args, arg.(string))
+		}
+		conn.Write([]byte(redis.execute(args, &authenticated)))
+	}
+}
+
+func bulk(value string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(value), value)
+}
+
+func (redis *fakeRedis) execute(args []string, authenticated *bool) string {
+	redis.Lock()
+	defer redis.Unlock()
+
+	if args[0] == "AUTH" {
+		if args[1] != redis.password {
+			return "-ERR invalid password\r\n"
+		}
+		*authenticated = true
+		return "+OK\r\n"
+	}
+	if !*authenticated {
+		return "-NOAUTH Authentication required.\r\n"
+	}
+
+	switch args[0] {
+	case "PING":
+		return "+PONG\r\n"
+
+	case "GET":
+		if value, ok := redis.data[args[1]]; ok {
+			return bulk(value)
+		}
+		return "$-1\r\n"
+
+	case "MGET":
+		reply := fmt.Sprintf("*%d\r\n", len(args)-1)
+		for _, key := range args[1:] {
+			if value, ok := redis.data[key]; ok {
+				reply += bulk(value)
+			} else {
+				reply += "$-1\r\n"
+			}
+		}
+		return reply
+
+	case "MSET":
+		for i := 1; i+1 < len(args); i += 2 {
+			redis.data[args[i]] = args[i+1]
+		}
+		return "+OK\r\n"
+
+	case "DEL":
+		for _, key := range args[1:] {
+			delete(redis.data, key)
+		}
+		return fmt.Sprintf(":%d\r\n", len(args)-1)
+
+	case "EVAL":
+		// RedisStorage only ever runs redisPutChannels, so this does
+		// what it does
+		numKeys, _ := strconv.Atoi(args[2])
+		keys, argv := args[3:3+numKeys], args[3+numKeys:]
+		for n := 0; n < len(keys)/2; n++ {
+			key, versionKey := keys[2*n], keys[2*n+1]
+			value, version, known, reverts := argv[4*n], argv[4*n+1], argv[4*n+2], argv[4*n+3]
+			saved, ok := redis.data[versionKey]
+			newer := ok && saved != reverts && (len(saved) > len(version) || (len(saved) == len(version) && saved > version))
+			_, exists := redis.data[key]
+			if !newer && (known != "known" || exists) {
+				redis.data[key], redis.data[versionKey] = value, version
+			}
+		}
+		return bulk("OK")
+
+	case "SCAN":
+		var keys []string
+		for key := range redis.data {
+			if matched, _ := path.Match(args[3], key); matched {
+				keys = append(keys, bulk(key))
+			}
+		}
+		return fmt.Sprintf("*2\r\n%s*%d\r\n%s", bulk("0"), len(keys), strings.Join(keys, ""))
+	}
+	return "-ERR unknown command\r\n"
+}
+
+func TestRedisStorageIsShared(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "secret")
+	addTestChannel("uaid", "chan", 3)
+	gServerState.subscribe("uaid", "news")
+
+	here := newRedisStorage(redis.address(), "secret")
+	if err := here.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+
+	// another server registers a channel of its own
+	var state ServerState
+	there := newRedisStorage(redis.address(), "secret")
+	if err := there.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if channel := state.ChannelIDToChannel["chan"]; channel == nil || channel.Version != 3 ||
+		state.UAIDToChannelIDs["uaid"]["chan"] != channel || !state.TopicToUAIDs["news"]["uaid"] {
+		t.Fatalf("other server loaded %+v", state.ChannelIDToChannel)
+	}
+	state.addChannel(&Channel{UAID: "uaid2", ChannelID: "elsewhere", Version: 1})
+	if err := there.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// unregistering here deletes only our channel, even across a
+	// dropped connection
+	redis.dropConnections()
+	gServerState.removeChannel("chan")
+	if err := here.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redis.get("channel:chan"); ok {
+		t.Fatalf("removed channel is still saved")
+	}
+	if _, ok := redis.get("channel:elsewhere"); !ok {
+		t.Fatalf("channel registered on the other server was deleted")
+	}
+
+	// and a notify for the other server's channel finds it
+	gStorage = here
+	if w, n := notify(t, "elsewhere", ""); w.Code != http.StatusOK || n == nil || n.Channel.Version != 2 {
+		t.Fatalf("notify for a channel registered elsewhere got %d", w.Code)
+	}
+}
+
+func TestRedisStorageNeedsPassword(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "secret")
+
+	var state ServerState
+	if err := newRedisStorage(redis.address(), "wrong").Load(&state); err == nil {
+		t.Fatalf("load with the wrong password succeeded")
+	}
+	if err := newRedisStorage(redis.address(), "secret").Load(&state); err != errNoSavedState {
+		t.Fatalf("load from an empty Redis got %v, want errNoSavedState", err)
+	}
+}
+
+func TestRedisSavesOnlyWhatChanged(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "")
+	addTestChannel("uaid", "chan", 3)
+	gServerState.subscribe("uaid", "news")
+	here := newRedisStorage(redis.address(), "")
+	if err := here.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+
+	var state ServerState
+	there := newRedisStorage(redis.address(), "")
+	if err := there.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	state.ChannelIDToChannel["chan"].Version = 5
+	if err := there.PutChannels(&state, []*Channel{state.ChannelIDToChannel["chan"]}); err != nil {
+		t.Fatal(err)
+	}
+	state.subscribe("uaid2", "sports")
+	if err := there.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// a save here doesn't take back the other server's changes, even
+	// with an older version of the channel of its own
+	gServerState.subscribe("uaid", "weather")
+	gServerState.ChannelIDToChannel["chan"].Version = 4
+	if err := here.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+	var loaded ServerState
+	if err := newRedisStorage(redis.address(), "").Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if channel := loaded.ChannelIDToChannel["chan"]; channel == nil || channel.Version != 5 {
+		t.Fatalf("saved channel is %+v, want version 5 kept", channel)
+	}
+	for _, topic := range []string{"news", "sports", "weather"} {
+		if len(loaded.TopicToUAIDs[topic]) != 1 {
+			t.Fatalf("saved topics are %v", loaded.TopicToUAIDs)
+		}
+	}
+
+	// nor brings back a channel the other server unregistered
+	state.removeChannel("chan")
+	if err := there.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	gServerState.ChannelIDToChannel["chan"].Version = 6
+	if err := here.PutChannels(&gServerState, []*Channel{gServerState.ChannelIDToChannel["chan"]}); err != nil {
+		t.Fatal(err)
+	}
+	if value, ok := redis.get("channel:chan"); ok {
+		t.Fatalf("unregistered channel came back as %s", value)
+	}
+}
+
+func TestRedisKeepsChannelsLoadedLaterUnregistered(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "")
+	var state ServerState
+	there := newRedisStorage(redis.address(), "")
+	if err := there.Load(&state); err != errNoSavedState {
+		t.Fatal(err)
+	}
+	state.addChannel(&Channel{UAID: "uaid", ChannelID: "quiet", Version: 1})
+	state.addChannel(&Channel{UAID: "uaid", ChannelID: "bumped", Version: 1})
+	if err := there.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+
+	// here only comes across them when they're notified
+	here := newRedisStorage(redis.address(), "")
+	gStorage = here
+	if _, ok := loadSharedChannel("quiet"); !ok {
+		t.Fatalf("channel registered elsewhere was not found")
+	}
+	if w, n := notify(t, "bumped", ""); w.Code != http.StatusOK || n == nil {
+		t.Fatalf("notify for a channel registered elsewhere got %d", w.Code)
+	}
+
+	state.removeChannel("quiet")
+	state.removeChannel("bumped")
+	if err := there.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	gServerState.ChannelIDToChannel["bumped"].Version = 3
+	if err := here.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"channel:quiet", "channel:bumped"} {
+		if value, ok := redis.get(key); ok {
+			t.Fatalf("unregistered %s came back as %s", key, value)
+		}
+	}
+}
+
+func TestRedisRevertsOnlyItsOwnVersion(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "")
+	channel := addTestChannel("uaid", "chan", 3)
+	storage := newRedisStorage(redis.address(), "")
+	if err := storage.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+
+	// a refused notify's version was saved anyway
+	channel.Version = 4
+	if err := storage.PutChannels(&gServerState, []*Channel{channel}); err != nil {
+		t.Fatal(err)
+	}
+	channel.Version = 3
+	if err := storage.PutChannels(&gServerState, []*Channel{channel}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := redis.get("version:chan"); version != "4" {
+		t.Fatalf("a put took the version back to %s", version)
+	}
+	if err := storage.RevertChannels(&gServerState, []*Channel{channel}, []uint64{4}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := redis.get("version:chan"); version != "3" {
+		t.Fatalf("reverted version is %s, want 3", version)
+	}
+
+	// but not once another server saved a newer one
+	if _, err := storage.client.do("MSET", "version:chan", "5"); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.RevertChannels(&gServerState, []*Channel{channel}, []uint64{4}); err != nil {
+		t.Fatal(err)
+	}
+	if version, _ := redis.get("version:chan"); version != "5" {
+		t.Fatalf("revert replaced another server's version with %s", version)
+	}
+}
+
+func TestRedisMovesLegacyState(t *testing.T) {
+	setupTest(t)
+	redis := startFakeRedis(t, "")
+	redis.data["state"] = `{"topicToUAIDs": {"news": {"uaid": true}}, "minNotifyIntervals": {"chan": 2}}`
+
+	var state ServerState
+	storage := newRedisStorage(redis.address(), "")
+	if err := storage.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if !state.TopicToUAIDs["news"]["uaid"] || state.MinNotifyIntervals["chan"] != 2 {
+		t.Fatalf("loaded topics %v and intervals %v", state.TopicToUAIDs, state.MinNotifyIntervals)
+	}
+	if err := storage.Save(&state); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := redis.get("state"); ok {
+		t.Fatalf("the legacy state key was kept")
+	}
+	if _, ok := redis.get(redisSubscriptionKey("uaid", "news")); !ok {
+		t.Fatalf("subscription wasn't moved to its own key")
+	}
+	if value, _ := redis.get("interval:chan"); value != "2" {
+		t.Fatalf("interval was moved as %q", value)
+	}
+}
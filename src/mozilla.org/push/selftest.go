@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+	"uuid"
+)
+
+// POST /admin/selftest runs a notification through the whole pipeline,
+// register, notify, deliver and ack, using a throwaway UAID and channel
+// and an internal client standing in for a device. It's meant to check
+// that a freshly deployed server works end to end.
+
+func adminSelftest(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "selftest")
+	start := time.Now()
+	err := selftest(5 * time.Second)
+
+	type SelftestResponse struct {
+		OK        bool   `json:"ok"`
+		LatencyMs int64  `json:"latencyMs"`
+		Error     string `json:"error,omitempty"`
+	}
+	response := SelftestResponse{err == nil, int64(time.Since(start) / time.Millisecond), ""}
+	if err != nil {
+		log.Println("Selftest failed: ", err)
+		response.Error = err.Error()
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Could not convert selftest response to json ", err)
+		return
+	}
+	w.Write(j)
+}
+
+// Wait for the next message to the client and decode it into v
+func selftestReceive(client *Client, timer <-chan time.Time, v interface{}) error {
+	select {
+	case message := <-client.outgoing:
+		return json.Unmarshal([]byte(message), v)
+	case <-timer:
+		return errors.New("timed out waiting for the server")
+	}
+}
+
+func selftest(timeout time.Duration) error {
+	uaid, err := uuid.GenUUID()
+	if err != nil {
+		return err
+	}
+	channelID, err := uuid.GenUUID()
+	if err != nil {
+		return err
+	}
+
+	client := newClient(nil)
+	client.UAID = "selftest-" + uaid
+	client.attached = true
+	gServerState.Lock()
+	gServerState.ConnectedClients[client.UAID] = client
+	gServerState.Unlock()
+	defer func() {
+		close(client.done)
+		gServerState.Lock()
+		delete(gServerState.ConnectedClients, client.UAID)
+		gServerState.removeUAID(client.UAID)
+		gServerState.Unlock()
+		saveState()
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	var registered struct {
+		Status int `json:"status"`
+	}
+	handleRegister(client, map[string]interface{}{"channelID": channelID})
+	if err := selftestReceive(client, timer.C, &registered); err != nil {
+		return fmt.Errorf("register: %v", err)
+	}
+	if registered.Status != 200 {
+		return fmt.Errorf("register: got status %d", registered.Status)
+	}
+
+	gServerState.Lock()
+	channel := gServerState.ChannelIDToChannel[channelID]
+	previous := *channel
+	channel.Version++
+	sent := *channel
+	gServerState.Unlock()
+	if err := deliverChannels([]*Channel{channel}, []Channel{previous}, []uint64{sent.Version}); err != nil {
+		return fmt.Errorf("notify: %v", err)
+	}
+
+	var notification struct {
+		Updates []Channel `json:"updates"`
+	}
+	if err := selftestReceive(client, timer.C, &notification); err != nil {
+		return fmt.Errorf("delivery: %v", err)
+	}
+	if len(notification.Updates) != 1 || notification.Updates[0] != sent {
+		return fmt.Errorf("delivery: got %+v", notification.Updates)
+	}
+
+	// the delivery loop takes the ack off ackChan itself
+	acked := make(chan bool)
+	go func() {
+		handleAck(client, map[string]interface{}{"updates": []interface{}{
+			map[string]interface{}{"channelID": channelID, "version": float64(sent.Version)},
+		}})
+		close(acked)
+	}()
+	select {
+	case <-acked:
+	case <-timer.C:
+		return errors.New("ack: timed out waiting for the delivery loop")
+	}
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSelftestPassesOnHealthyServer(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+
+	notifyChan = make(chan Notification)
+	ackChan = make(chan []Ack)
+	startTestDelivery(t, notifyChan, ackChan)
+
+	w := httptest.NewRecorder()
+	adminSelftest(w, adminRequest("POST", "/admin/selftest", "secret"))
+
+	var response struct {
+		OK    bool   `json:"ok"`
+		Error string `json:"error"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if w.Code != http.StatusOK || !response.OK {
+		t.Fatalf("selftest got %d %s", w.Code, w.Body.String())
+	}
+
+	if len(gServerState.ChannelIDToChannel) != 0 || len(gServerState.ConnectedClients) != 0 {
+		t.Fatalf("selftest left its channel or client behind")
+	}
+}
@@ -1,16 +1,32 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
+	"crypto/subtle"
+	"crypto/tls"
+	"embed"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"go.net/websocket"
 	"io/ioutil"
 	"log"
+	"math"
+	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"text/template"
 	"time"
 	"uuid"
@@ -23,187 +39,1142 @@ type ServerConfig struct {
 	UseTLS       bool   `json:"useTLS"`
 	CertFilename string `json:"certFilename"`
 	KeyFilename  string `json:"keyFilename"`
+	TemplatesDir string `json:"templatesDir"`
+
+	// Certificates for other hostnames this server answers to, by
+	// hostname. Clients connecting to one of them also get notify URLs
+	// with that hostname.
+	Certificates map[string]CertificateFiles `json:"certificates"`
+
+	// The oldest TLS version accepted, "1.0" to "1.3", and the cipher
+	// suites offered, by their crypto/tls names. Default to "1.2" and
+	// Go's own choice of suites.
+	TLSMinVersion       string   `json:"tlsMinVersion"`
+	CipherSuites        []string `json:"cipherSuites"`
+	PreferServerCiphers bool     `json:"preferServerCiphers"`
+
+	// Serving without TLS is only allowed when explicitly asked for
+	AllowInsecure bool `json:"allowInsecure"`
+
+	// Where to listen: "tcp", the default, on ListenAddress or else
+	// Hostname:Port, or "unix" on the socket file at ListenAddress,
+	// for a reverse proxy on the same machine
+	ListenNetwork string `json:"listenNetwork"`
+	ListenAddress string `json:"listenAddress"`
+
+	// Bearer token required by the admin actions under /admin/.
+	// They are disabled when this is empty.
+	AdminToken string `json:"adminToken"`
+
+	// Bearer token app servers must send to notify. Anyone can notify
+	// when this is empty.
+	NotifyToken string `json:"notifyToken"`
+
+	// Notifies a second each channel may get on average, in bursts of
+	// up to NotifyBurst, which defaults to the rate. Zero is no limit.
+	NotifyRate  float64 `json:"notifyRate"`
+	NotifyBurst int     `json:"notifyBurst"`
+
+	// Seconds of outbound silence after which a connection is sent an
+	// application-level heartbeat message. Zero disables heartbeats.
+	HeartbeatInterval float64 `json:"heartbeatInterval"`
+
+	// Seconds between websocket pings. A connection that hasn't
+	// answered one with a pong for PongTimeout seconds on top of that
+	// (10 by default) is closed. Zero disables pings.
+	PingInterval float64 `json:"pingInterval"`
+	PongTimeout  float64 `json:"pongTimeout"`
+
+	// Don't gzip admin responses even when the client accepts it
+	DisableCompression bool `json:"disableCompression"`
+
+	// What to do when a hello claims a UAID that is already connected:
+	// "evict" (the default) closes the older connection, "reject"
+	// refuses the newer one
+	DuplicateHelloPolicy string `json:"duplicateHelloPolicy"`
+
+	// URLs POSTed to when a client says hello or disconnects
+	ConnectWebhook    string `json:"connectWebhook"`
+	DisconnectWebhook string `json:"disconnectWebhook"`
+	// URL POSTed to when the oldest notification awaiting an ack has
+	// been waiting more than PendingAgeAlert seconds for
+	// PendingAgeAlertFor seconds in a row, and again when it recovers.
+	// Zero PendingAgeAlert disables the alert.
+	PendingAgeWebhook  string  `json:"pendingAgeWebhook"`
+	PendingAgeAlert    float64 `json:"pendingAgeAlert"`
+	PendingAgeAlertFor float64 `json:"pendingAgeAlertFor"`
+	// How many webhook requests may be in flight at once, and how many
+	// more may wait for a free slot before new ones are dropped
+	WebhookWorkers   int `json:"webhookWorkers"`
+	WebhookQueueSize int `json:"webhookQueueSize"`
+
+	// Seconds an outbound request (webhooks, forwarded notifies, Redis
+	// commands) may spend connecting, including the TLS handshake, and
+	// in total. Default to 5 and 10.
+	OutboundConnectTimeout float64 `json:"outboundConnectTimeout"`
+	OutboundTimeout        float64 `json:"outboundTimeout"`
+
+	// Seconds an outgoing websocket message may wait to be written along
+	// with others; zero writes every message immediately. Waiting
+	// messages are written early once WriteFlushSize bytes pile up.
+	WriteFlushDelay float64 `json:"writeFlushDelay"`
+	WriteFlushSize  int     `json:"writeFlushSize"`
+
+	// Seconds a new connection has to send its hello before
+	// it is closed. Defaults to 10.
+	HandshakeTimeout float64 `json:"handshakeTimeout"`
+
+	// Seconds a connection may go without sending anything, pongs
+	// included, before it is closed. A client that can't be woken up
+	// over UDP is then forgotten. Zero, the default, lets connections
+	// idle forever; set PingInterval too, or quiet clients will be cut
+	// off.
+	IdleTimeout float64 `json:"idleTimeout"`
+
+	// Seconds a client that can be woken up over UDP may go without
+	// sending anything before its connection is closed in favor of
+	// wakeups. Defaults to 15.
+	WakeupIdleTimeout float64 `json:"wakeupIdleTimeout"`
+
+	// Seconds after which a connection is closed and the client asked
+	// to reconnect, so that long-lived connections get moved around
+	// now and then. Zero keeps connections open indefinitely.
+	MaxConnectionAge float64 `json:"maxConnectionAge"`
+
+	// Seconds a write to a client may take before the connection is
+	// given up on, so a client that went away without closing can't
+	// hold its goroutines forever. Defaults to 10.
+	WriteTimeout float64 `json:"writeTimeout"`
+
+	// Seconds a shutdown waits for requests to finish and for the
+	// pending notifications. Defaults to 5.
+	ShutdownTimeout float64 `json:"shutdownTimeout"`
+
+	// Base URLs of every instance in the cluster, including this one,
+	// which is SelfURL. UAIDs are spread over the instances with a
+	// consistent hash, and notifies for clients that aren't connected
+	// here are forwarded to the instance owning their UAID. The
+	// instances have to share "redis" storage, so that each can find
+	// the UAID of a channel registered on another.
+	Peers   []string `json:"peers"`
+	SelfURL string   `json:"selfURL"`
+
+	// File every change to the state is recorded in, as JSON lines or,
+	// with an AuditFormat of "text", space separated fields.
+	// Empty disables auditing.
+	AuditLog    string `json:"auditLog"`
+	AuditFormat string `json:"auditFormat"`
+
+	// How many UDP wakeups may be in progress at once. Defaults to 16.
+	MaxConcurrentWakeups int `json:"maxConcurrentWakeups"`
+	// Seconds after waking a client during which it is left to reconnect
+	// rather than woken again. Defaults to 10.
+	WakeupReconnectWindow float64 `json:"wakeupReconnectWindow"`
+	// Seconds to wait before waking a client again after a failed
+	// wakeup, doubling with each further failure up to an hour, and
+	// how many failures in a row to give up after. Default to 30 and 10.
+	WakeupRetryBackoff float64 `json:"wakeupRetryBackoff"`
+	MaxWakeupFailures  int     `json:"maxWakeupFailures"`
+	// What a wakeup sends, as a template that can use {{.UAID}} and
+	// {{.ChannelID}}. Defaults to "push".
+	WakeupPayload string `json:"wakeupPayload"`
+	// The UDP port to wake clients on, instead of the one they sent in
+	// their hello. Zero uses theirs.
+	WakeupPort int `json:"wakeupPort"`
+	// Never wake clients over UDP; the wakeup_hostport in their hellos
+	// is ignored, and idle connections are left open.
+	DisableUDPWakeup bool `json:"disableUDPWakeup"`
+	// Accept wakeup addresses other than the one the client connected
+	// from, for clients behind a proxy, as long as they're public. Off
+	// by default, so that a client can't have the server send wakeups
+	// to somebody else.
+	AllowForeignWakeupIP bool `json:"allowForeignWakeupIP"`
+
+	// How many notifications a UAID may have waiting for an ack before
+	// notifications for its other channels are dropped. Zero means no
+	// limit.
+	MaxInFlightPerUAID int `json:"maxInFlightPerUAID"`
+
+	// Order in which notifications waiting for an ack are retried:
+	// "fifo" (the default) for the longest waiting first, or "lifo" for
+	// the most recent first
+	DeliveryOrder string `json:"deliveryOrder"`
+
+	// Seconds to wait before sending a notification that hasn't been
+	// acked again, doubling with each attempt up to the cap, and how
+	// many attempts to give up after. Default to 15, 600 and no limit.
+	RedeliveryBackoff    float64 `json:"redeliveryBackoff"`
+	RedeliveryBackoffCap float64 `json:"redeliveryBackoffCap"`
+	MaxDeliveryAttempts  int     `json:"maxDeliveryAttempts"`
+	// Seconds between looks for notifications that are due to be sent
+	// again, and for strict channels whose ack is overdue. Defaults to 1.
+	RedeliverySweepInterval float64 `json:"redeliverySweepInterval"`
+
+	// How many state saves notifies may run at once, and how many
+	// seconds a notify waits for its save before it is refused with a
+	// 503. Default to 4 and 2.
+	MaxConcurrentSaves int     `json:"maxConcurrentSaves"`
+	SaveTimeout        float64 `json:"saveTimeout"`
+
+	// Changes made over websockets are saved together, at most once
+	// every SaveInterval seconds. Defaults to 1.
+	SaveInterval float64 `json:"saveInterval"`
+
+	// Platforms clients may report in their hello. Metrics are labeled
+	// with these; any other platform is counted as "other".
+	Platforms []string `json:"platforms"`
+
+	// Only log one in this many of each routine event, such as incoming
+	// messages and delivery attempts. Errors are always logged. Zero or
+	// one logs everything.
+	LogSampleRate int `json:"logSampleRate"`
+
+	// Events below this level, one of "debug", "info", "warn" and
+	// "error", are not logged. Empty logs everything.
+	LogLevel string `json:"logLevel"`
+
+	// "text", the default, or "json" to write each log line as a JSON
+	// object
+	LogFormat string `json:"logFormat"`
+
+	// Minimum seconds between notifications sent for a channel, unless
+	// the client asked for another interval when registering it. Faster
+	// updates are coalesced and the latest sent when the interval is up.
+	MinNotifyInterval float64 `json:"minNotifyInterval"`
+
+	// Seconds to wait for the ack of a version of a strict channel
+	// before sending the next one anyway. Defaults to 30.
+	StrictAckTimeout float64 `json:"strictAckTimeout"`
+	// How many versions of a strict channel may wait behind the one in
+	// flight before the oldest are dropped. Defaults to 100.
+	StrictQueueLimit int `json:"strictQueueLimit"`
+
+	// How many of the latest versions of each channel to keep for
+	// clients that ask for the history on hello. Zero keeps none.
+	HistorySize int `json:"historySize"`
+
+	// Seconds a channel may go without a register, notify or hello
+	// before it's unregistered. Zero keeps channels forever.
+	ChannelTTL float64 `json:"channelTTLSeconds"`
+
+	// Most channels a UAID may register; further registers get a 507.
+	// Zero means no limit.
+	MaxChannelsPerUAID int `json:"maxChannelsPerUAID"`
+
+	// Largest payload, in bytes, a notify may carry in its "data"
+	// field. Defaults to 4096.
+	MaxDataSize int `json:"maxDataSize"`
+
+	// Secret poll tokens are derived from; polling is disabled when
+	// it's empty. Polls return empty-handed after PollTimeout seconds,
+	// 30 by default.
+	PollSecret  string  `json:"pollSecret"`
+	PollTimeout float64 `json:"pollTimeout"`
+
+	// Whether a UAID can have a poll or event stream next to its
+	// websocket, and which of them get its notifications: "" (the
+	// default) allows one transport per UAID, "primary" delivers to
+	// one of them, the websocket if there is one, and "all" to every
+	// one. Either way a notification is pending until any of them
+	// acks it.
+	DeliveryPolicy string `json:"deliveryPolicy"`
+
+	// How many notifications can wait for the delivery loop, and what
+	// a notify does when they can't; see notifyqueue.go. The timeout is
+	// in seconds and defaults to 1.
+	NotifyQueueSize    int     `json:"notifyQueueSize"`
+	NotifyQueuePolicy  string  `json:"notifyQueuePolicy"`
+	NotifyQueueTimeout float64 `json:"notifyQueueTimeout"`
+
+	// Where the state is kept: "file", the default, for serverstate.json,
+	// or "redis" to share it with other servers through the Redis at
+	// RedisAddress
+	Storage       string `json:"storage"`
+	RedisAddress  string `json:"redisAddress"`
+	RedisPassword string `json:"redisPassword"`
+
+	// How serverstate.json is encoded: "json", the default, or "gob",
+	// which is smaller and quicker to save and load. Files in either
+	// format are loaded whatever this says.
+	StateFormat string `json:"stateFormat"`
+	// The state file, with its journal and the notifications left
+	// pending at shutdown kept next to it. Defaults to
+	// serverstate.json in the working directory.
+	StateFilename string `json:"stateFilename"`
+
+	// Field names used by other generations of clients. Each profile
+	// maps field names in our messages to the ones its clients expect,
+	// and a client picks a profile by name in its hello.
+	Profiles map[string]map[string]string `json:"profiles"`
 }
 
 var gServerConfig ServerConfig
 
+// Durations in the config are given in (possibly fractional) seconds
+func configDuration(seconds float64) time.Duration {
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// The default templates are compiled into the binary so that the admin
+// page works even when the server is run away from its source tree.
+// A template of the same name in TemplatesDir takes precedence.
+//
+//go:embed templates/*.template
+var defaultTemplates embed.FS
+
+// Status codes we close client websockets with
+const (
+	closeNormal    = 1000
+	closeWakeup    = 4774 // the client should wait for a UDP wakeup
+	closeReplaced  = 4775 // another connection took over the UAID
+	closeReconnect = 4776 // the connection is old, the client should reconnect now
+	closeEvicted   = 4777 // an admin kicked the client off
+)
+
+// Once a client is in ConnectedClients, its Websocket, UAID, hostport,
+// LastContact, platform and attached fields are only touched under
+// gServerState's lock
 type Client struct {
 	Websocket   *websocket.Conn `json:"-"`
 	UAID        string          `json:"uaid"`
 	Ip          string          `json:"ip"`
 	Port        float64         `json:"port"`
 	LastContact time.Time       `json:"-"`
+	ConnectedAt time.Time       `json:"-"`
+	// Where the connection actually came from, as "ip:port"; Ip and
+	// Port are only what the client claims in its hello
+	RemoteAddr string `json:"remoteAddr"`
+	// When the client was last sent a UDP wakeup
+	LastWakeup time.Time `json:"-"`
+	// How many wakeups in a row failed, and when to try again
+	wakeupFailures int
+	wakeupRetryAt  time.Time
+	// Guards the wakeup fields, which wakeups update in the background
+	wakeupLock sync.Mutex
+
+	// Messages waiting to be written to Websocket. Only the
+	// clientWriter goroutine writes to the socket, so that
+	// concurrent senders can't interleave their frames.
+	outgoing chan string
+	// Closed when the connection goes away
+	done chan struct{}
+	// Hostname the client connected to, for its notify URLs
+	host string
+	// What the client says it runs on, for metrics
+	platform string
+	// Which of the configured Profiles names its messages' fields
+	profile string
+	// The protocol version agreed on in the hello
+	protocolVersion int
+	// Set for clients reached through a long-poll rather than Websocket
+	attached bool
+	// When Websocket last answered a ping, or connected
+	lastPong time.Time
+	// Set by pushHandler when the client said nothing for IdleTimeout
+	idle bool
+}
+
+func newClient(ws *websocket.Conn) *Client {
+	if ws != nil {
+		// set before the reader and writer goroutines start, since
+		// the pongs the reader sends look at it too
+		ws.DeferFlush = configDuration(gServerConfig.WriteFlushDelay) > 0
+	}
+	return &Client{
+		Websocket:   ws,
+		LastContact: time.Now(),
+		ConnectedAt: time.Now(),
+		lastPong:    time.Now(),
+		outgoing:    make(chan string, 16),
+		done:        make(chan struct{}),
+	}
+}
+
+// Whether messages sent to the client reach it right away
+func (client *Client) online() bool {
+	return client != nil && (client.Websocket != nil || client.attached)
+}
+
+// Queue a message to be written to the client's websocket.
+func sendToClient(client *Client, message string) {
+	select {
+	case client.outgoing <- message:
+	case <-client.done:
+		log.Println("Dropping message for closed connection ", client.UAID)
+	}
+}
+
+func writeTimeout() time.Duration {
+	timeout := configDuration(gServerConfig.WriteTimeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return timeout
+}
+
+// Close a client's socket, giving up on the close frame if the client
+// doesn't take it in time
+func closeClientSocket(ws *websocket.Conn, status int, timeout time.Duration) {
+	ws.SetWriteDeadline(time.Now().Add(timeout))
+	ws.CloseWithStatus(status)
+}
+
+func clientWriter(client *Client, ws *websocket.Conn) {
+	// a nil channel never fires, so this stays quiet
+	// unless heartbeats are configured
+	var heartbeat <-chan time.Time
+	interval := configDuration(gServerConfig.HeartbeatInterval)
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		heartbeat = ticker.C
+	}
+
+	// With a flush delay, frames are left in the write buffer and go out
+	// together once flushSize bytes are waiting or the delay runs out
+	flushDelay := configDuration(gServerConfig.WriteFlushDelay)
+	flushSize := gServerConfig.WriteFlushSize
+	if flushSize <= 0 {
+		flushSize = 4096
+	}
+	timeout := writeTimeout()
+	var flush <-chan time.Time
+	buffered := 0
+
+	var ping <-chan time.Time
+	if pingInterval := configDuration(gServerConfig.PingInterval); pingInterval > 0 {
+		ticker := time.NewTicker(pingInterval)
+		defer ticker.Stop()
+		ping = ticker.C
+	}
+
+	// Old connections are closed somewhere in the last tenth of
+	// MaxConnectionAge, so that clients that connected together
+	// don't all come back together
+	var expire <-chan time.Time
+	if maxAge := configDuration(gServerConfig.MaxConnectionAge); maxAge > 0 {
+		age := maxAge - time.Duration(rand.Int63n(int64(maxAge/10)+1))
+		timer := time.NewTimer(time.Until(client.ConnectedAt.Add(age)))
+		defer timer.Stop()
+		expire = timer.C
+	}
+
+	lastSent := time.Now()
+	write := func(message string) {
+		ws.SetWriteDeadline(time.Now().Add(timeout))
+		if err := websocket.Message.Send(ws, message); err != nil {
+			// we could not send the message to a peer
+			log.Println("Could not send message to ", ws.Request().RemoteAddr, err.Error())
+		}
+		lastSent = time.Now()
+
+		if !ws.DeferFlush {
+			return
+		}
+		buffered += len(message)
+		if buffered >= flushSize {
+			ws.Flush()
+			buffered = 0
+			flush = nil
+		} else if flush == nil {
+			flush = time.After(flushDelay)
+		}
+	}
+
+	for {
+		select {
+		case message := <-client.outgoing:
+			write(message)
+
+		case <-heartbeat:
+			// clients that are getting notifications know we're alive
+			if time.Since(lastSent) >= interval {
+				write(`{"messageType":"heartbeat"}`)
+			}
+
+		case <-ping:
+			ws.SetWriteDeadline(time.Now().Add(timeout))
+			if err := ws.WritePing(nil); err != nil {
+				log.Println("Could not ping ", ws.Request().RemoteAddr, err.Error())
+			}
+
+		case <-flush:
+			ws.SetWriteDeadline(time.Now().Add(timeout))
+			if err := ws.Flush(); err != nil {
+				log.Println("Could not flush messages to ", ws.Request().RemoteAddr, err.Error())
+			}
+			buffered = 0
+			flush = nil
+
+		case <-expire:
+			log.Println("Connection from ", ws.Request().RemoteAddr, " is too old, asking it to reconnect")
+			closeClientSocket(ws, closeReconnect, timeout)
+
+		case <-client.done:
+			return
+		}
+	}
 }
 
 type Channel struct {
 	UAID      string `json:"uaid"`
 	ChannelID string `json:"channelID"`
 	Version   uint64 `json:"version"`
+	// The payload the app server sent along with this version, if any
+	Data string `json:"data,omitempty"`
+	// Unix time of the last register, notify or hello that touched
+	// the channel, for ChannelTTL
+	Updated int64 `json:"updated,omitempty"`
+	// The newest version its client has acked since this server
+	// started, for /admin/channel
+	Acked uint64 `json:"-"`
 }
 
 type ChannelIDSet map[string]*Channel
 
 type ServerState struct {
+	// Guards the maps below, the Version, Data and Acked of every
+	// Channel in them and the connection fields of every Client. It is held only
+	// to look things up or change them, never while waiting on I/O.
+	sync.RWMutex
+
 	// Mapping from a UAID to the Client object
 	// json field is "-" to prevent serialization
 	// since the connectedness of a client means nothing
 	// across sessions
 	ConnectedClients map[string]*Client `json:"-"`
 
+	// Polls and event streams attached to a UAID next to its entry in
+	// ConnectedClients, in the order they attached. Only used when the
+	// DeliveryPolicy allows several transports.
+	Transports map[string][]*Client `json:"-"`
+
 	// Mapping from a UAID to all channelIDs owned by that UAID
 	// where channelIDs are represented as a map-backed set
 	UAIDToChannelIDs map[string]ChannelIDSet `json:"uaidToChannels"`
 
 	// Mapping from a ChannelID to the cooresponding Channel
 	ChannelIDToChannel ChannelIDSet `json:"channelIDToChannel"`
+
+	// Mapping from a broadcast topic to the set of UAIDs subscribed to it
+	TopicToUAIDs map[string]map[string]bool `json:"topicToUAIDs"`
+
+	// Minimum seconds between notifications for the channels whose
+	// clients asked for one when registering
+	MinNotifyIntervals map[string]float64 `json:"minNotifyIntervals"`
+
+	// Channels whose clients asked for every version, in order
+	StrictChannels map[string]bool `json:"strictChannels"`
+
+	// The latest versions of each channel, oldest first, when
+	// HistorySize is set
+	History map[string][]HistoryEntry `json:"history"`
 }
 
 var gServerState ServerState
 
+// Changes to the channel maps go through the methods below,
+// so that UAIDToChannelIDs and ChannelIDToChannel always agree.
+// Callers hold the lock.
+
+func (state *ServerState) addChannel(channel *Channel) {
+	if state.UAIDToChannelIDs[channel.UAID] == nil {
+		state.UAIDToChannelIDs[channel.UAID] = make(ChannelIDSet)
+	}
+	state.UAIDToChannelIDs[channel.UAID][channel.ChannelID] = channel
+	state.ChannelIDToChannel[channel.ChannelID] = channel
+}
+
+func (state *ServerState) removeChannel(channelID string) {
+	channel, ok := state.ChannelIDToChannel[channelID]
+	if !ok {
+		return
+	}
+	delete(state.UAIDToChannelIDs[channel.UAID], channelID)
+	delete(state.ChannelIDToChannel, channelID)
+	delete(state.MinNotifyIntervals, channelID)
+	delete(state.StrictChannels, channelID)
+	delete(state.History, channelID)
+}
+
+// JSON has no pointers, so a freshly loaded state has separate copies
+// of each channel in the two maps. Point both maps at one Channel again,
+// preferring ChannelIDToChannel's copy since that is what notify updates.
+func (state *ServerState) relinkChannels() {
+	owned := state.UAIDToChannelIDs
+	channels := state.ChannelIDToChannel
+
+	state.UAIDToChannelIDs = make(map[string]ChannelIDSet)
+	state.ChannelIDToChannel = make(ChannelIDSet)
+	for uaid, set := range owned {
+		state.UAIDToChannelIDs[uaid] = make(ChannelIDSet)
+		for _, channel := range set {
+			if channel != nil {
+				state.addChannel(channel)
+			}
+		}
+	}
+	for _, channel := range channels {
+		if channel == nil {
+			continue
+		}
+		// not removeChannel, which would also drop the channel's
+		// interval and strictness
+		if previous, ok := state.ChannelIDToChannel[channel.ChannelID]; ok {
+			delete(state.UAIDToChannelIDs[previous.UAID], channel.ChannelID)
+		}
+		state.addChannel(channel)
+	}
+}
+
+// Forget a UAID along with every channel it owns
+func (state *ServerState) removeUAID(uaid string) {
+	for channelID := range state.UAIDToChannelIDs[uaid] {
+		delete(state.ChannelIDToChannel, channelID)
+		delete(state.MinNotifyIntervals, channelID)
+		delete(state.StrictChannels, channelID)
+		delete(state.History, channelID)
+	}
+	delete(state.UAIDToChannelIDs, uaid)
+	state.unsubscribeAll(uaid)
+}
+
+// Move everything owned by one UAID over to another, unused one
+func (state *ServerState) renameUAID(from, to string) {
+	if transports, ok := state.Transports[from]; ok {
+		for _, transport := range transports {
+			transport.UAID = to
+		}
+		state.Transports[to] = transports
+		delete(state.Transports, from)
+	}
+	if channels, ok := state.UAIDToChannelIDs[from]; ok {
+		for _, channel := range channels {
+			channel.UAID = to
+		}
+		state.UAIDToChannelIDs[to] = channels
+		delete(state.UAIDToChannelIDs, from)
+	}
+	for _, uaids := range state.TopicToUAIDs {
+		if uaids[from] {
+			delete(uaids, from)
+			uaids[to] = true
+		}
+	}
+}
+
 type Notification struct {
 	UAID    string
 	Channel *Channel
+	// When this version of the channel started waiting for an ack
+	Queued time.Time
+	// How many times this version was sent, and when it's due to be
+	// sent again
+	Attempts    int
+	NextAttempt time.Time
 }
 
 type Ack struct {
 	ChannelID string
 	Version   uint64
+	// Clients may report that they couldn't process an update with a
+	// status other than 200, optionally explaining why
+	Status int
+	Error  string
+	// The sending client's platform, for metrics
+	Platform string
 }
 
 var notifyChan chan Notification
-var ackChan chan Ack
+
+// The acks in one message from a client arrive together, and the
+// delivery loop applies them all before doing anything else
+var ackChan chan []Ack
+
+// UAIDs whose pending notifications should be retried right away,
+// because they just became reachable
+var redeliverChan chan string
+
+// Migrations for the delivery loop to move pending notifications along
+// with, which can't be dropped the way redeliveries can
+type uaidMigration struct {
+	from, to string
+}
+
+var uaidMigrations chan uaidMigration
+
+func migratePending(from, to string) {
+	if uaidMigrations != nil {
+		uaidMigrations <- uaidMigration{from, to}
+	}
+}
+
+// The same notification, for a channel that now belongs to uaid
+func (notification Notification) movedTo(uaid string) Notification {
+	snapshot := *notification.Channel
+	snapshot.UAID = uaid
+	notification.UAID = uaid
+	notification.Channel = &snapshot
+	return notification
+}
+
+func requestRedelivery(uaid string) {
+	select {
+	case redeliverChan <- uaid:
+	default:
+		// the sweep will get to it
+	}
+}
+
+var configSource = flag.String("config", "config.json",
+	"config file, \"-\" for stdin, or an http(s) URL to fetch it from; defaults to PUSH_CONFIG")
 
 func readConfig() {
+	source := *configSource
+	if env := os.Getenv("PUSH_CONFIG"); env != "" && !flagWasSet(flag.CommandLine, "config") {
+		source = env
+	}
+	if err := loadConfig(source); err != nil {
+		log.Println("Not configured. ", err)
+		os.Exit(-1)
+	}
+	if err := applyConfigOverrides(flag.CommandLine); err != nil {
+		log.Println("Not configured. ", err)
+		os.Exit(-1)
+	}
+	if problems := gServerConfig.validate(); len(problems) > 0 {
+		log.Println("Invalid config:")
+		for _, problem := range problems {
+			log.Println("  ", problem)
+		}
+		os.Exit(-1)
+	}
+	gWakeupPayload, _ = parseWakeupPayload(gServerConfig.WakeupPayload)
+}
+
+// The paths the server handles whatever the config says, which
+// NotifyPrefix can't take over
+var fixedPrefixes = []string{"/", "/uaid/", "/poll/", "/events/", "/metrics", "/admin"}
+
+// Everything wrong with the config that would otherwise only show up
+// once the server is running
+func (config *ServerConfig) validate() []error {
+	var problems []error
+	for _, field := range []struct{ name, value string }{
+		{"hostname", config.Hostname},
+		{"port", config.Port},
+		{"notifyPrefix", config.NotifyPrefix},
+	} {
+		if field.value == "" {
+			problems = append(problems, fmt.Errorf("%s is missing", field.name))
+		}
+	}
+
+	if prefix := config.NotifyPrefix; prefix != "" {
+		if !strings.HasPrefix(prefix, "/") || !strings.HasSuffix(prefix, "/") {
+			problems = append(problems, fmt.Errorf("notifyPrefix %q must start and end with /", prefix))
+		}
+		for _, fixed := range fixedPrefixes {
+			taken := prefix == fixed
+			if fixed != "/" {
+				taken = strings.HasPrefix(prefix, strings.TrimSuffix(fixed, "/")+"/")
+			}
+			if taken {
+				problems = append(problems, fmt.Errorf("notifyPrefix %q is taken by %s", prefix, fixed))
+			}
+		}
+	}
+
+	if config.UseTLS {
+		checkFiles := func(what string, files CertificateFiles) {
+			for _, filename := range []string{files.CertFilename, files.KeyFilename} {
+				if filename == "" {
+					problems = append(problems, fmt.Errorf("useTLS is set, but %s are missing", what))
+					return
+				}
+				if _, err := os.Stat(filename); err != nil {
+					problems = append(problems, fmt.Errorf("useTLS is set, but %s can't be read: %v", what, err))
+				}
+			}
+		}
+		checkFiles("certFilename and keyFilename", CertificateFiles{config.CertFilename, config.KeyFilename})
+		names := make([]string, 0, len(config.Certificates))
+		for name := range config.Certificates {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			checkFiles("the certificate files for "+name, config.Certificates[name])
+		}
+	}
+
+	if _, err := parseWakeupPayload(config.WakeupPayload); err != nil {
+		problems = append(problems, fmt.Errorf("wakeupPayload is not a valid template: %v", err))
+	}
+	if len(config.Peers) > 1 && config.Storage != "redis" {
+		problems = append(problems, errors.New(`peers need the shared "redis" storage`))
+	}
+	return problems
+}
 
+// Read the configuration from a file, stdin ("-") or an http(s) URL
+func loadConfig(source string) error {
 	var data []byte
 	var err error
 
-	data, err = ioutil.ReadFile("config.json")
+	switch {
+	case source == "-":
+		data, err = ioutil.ReadAll(os.Stdin)
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		data, err = fetchConfig(source)
+	default:
+		data, err = ioutil.ReadFile(source)
+	}
 	if err != nil {
-		log.Println("Not configured.  Could not find config.json")
-		os.Exit(-1)
+		return fmt.Errorf("could not read config from %s: %v", source, err)
+	}
+
+	if err = json.Unmarshal(data, &gServerConfig); err != nil {
+		return fmt.Errorf("could not unmarshal config from %s: %v", source, err)
 	}
+	return nil
+}
 
-	err = json.Unmarshal(data, &gServerConfig)
+func fetchConfig(url string) ([]byte, error) {
+	// the configured client can't be built before the config is loaded,
+	// but one with the default timeouts will do
+	resp, err := newOutboundClient().Get(url)
 	if err != nil {
-		log.Println("Could not unmarshal config.json", err)
-		os.Exit(-1)
-		return
+		return nil, err
 	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("got %s", resp.Status)
+	}
+	return ioutil.ReadAll(resp.Body)
 }
 
 func openState() {
-	var data []byte
-	var err error
+	gServerState.Lock()
+	defer gServerState.Unlock()
 
-	data, err = ioutil.ReadFile("serverstate.json")
+	err := gStorage.Load(&gServerState)
 	if err == nil {
-		err = json.Unmarshal(data, &gServerState)
-		if err == nil {
-			gServerState.ConnectedClients = make(map[string]*Client)
-			return
+		gServerState.relinkChannels()
+		gServerState.ConnectedClients = make(map[string]*Client)
+		gServerState.Transports = make(map[string][]*Client)
+		// state saved by older versions lacks these
+		if gServerState.TopicToUAIDs == nil {
+			gServerState.TopicToUAIDs = make(map[string]map[string]bool)
+		}
+		if gServerState.MinNotifyIntervals == nil {
+			gServerState.MinNotifyIntervals = make(map[string]float64)
+		}
+		if gServerState.StrictChannels == nil {
+			gServerState.StrictChannels = make(map[string]bool)
+		}
+		if gServerState.History == nil {
+			gServerState.History = make(map[string][]HistoryEntry)
 		}
+		return
+	}
+	if err != errNoSavedState {
+		log.Println("Could not load the server state: ", err)
 	}
 
 	log.Println(" -> creating new server state")
 	gServerState.UAIDToChannelIDs = make(map[string]ChannelIDSet)
 	gServerState.ChannelIDToChannel = make(ChannelIDSet)
+	gServerState.TopicToUAIDs = make(map[string]map[string]bool)
+	gServerState.MinNotifyIntervals = make(map[string]float64)
+	gServerState.StrictChannels = make(map[string]bool)
+	gServerState.History = make(map[string][]HistoryEntry)
 	gServerState.ConnectedClients = make(map[string]*Client)
+	gServerState.Transports = make(map[string][]*Client)
 }
 
-func saveState() {
-	log.Println(" -> saving state..")
+// Best-effort load of a state file that doesn't unmarshal as a whole.
+// Entries are decoded one at a time so that a bad one only costs us
+// that entry; if the file is syntactically broken, we keep whatever
+// came before the damage.
+func recoverState(state *ServerState, data []byte) {
+	state.UAIDToChannelIDs = make(map[string]ChannelIDSet)
+	state.ChannelIDToChannel = make(ChannelIDSet)
+	state.TopicToUAIDs = make(map[string]map[string]bool)
+	state.MinNotifyIntervals = make(map[string]float64)
+	state.StrictChannels = make(map[string]bool)
+	state.History = make(map[string][]HistoryEntry)
+
+	dec := json.NewDecoder(bytes.NewReader(data))
+	err := decodeEntries(dec, func(key string) error {
+		switch key {
+		case "uaidToChannels":
+			return decodeEntries(dec, func(uaid string) error {
+				var channels ChannelIDSet
+				return decodeEntry(dec, "channels of UAID "+uaid, &channels, func() {
+					state.UAIDToChannelIDs[uaid] = channels
+				})
+			})
+
+		case "channelIDToChannel":
+			return decodeEntries(dec, func(channelID string) error {
+				var channel *Channel
+				return decodeEntry(dec, "channel "+channelID, &channel, func() {
+					state.ChannelIDToChannel[channelID] = channel
+				})
+			})
+
+		case "topicToUAIDs":
+			return decodeEntries(dec, func(topic string) error {
+				var uaids map[string]bool
+				return decodeEntry(dec, "subscribers of topic "+topic, &uaids, func() {
+					state.TopicToUAIDs[topic] = uaids
+				})
+			})
+
+		case "minNotifyIntervals":
+			return decodeEntries(dec, func(channelID string) error {
+				var interval float64
+				return decodeEntry(dec, "interval of channel "+channelID, &interval, func() {
+					state.MinNotifyIntervals[channelID] = interval
+				})
+			})
+
+		case "strictChannels":
+			return decodeEntries(dec, func(channelID string) error {
+				var strict bool
+				return decodeEntry(dec, "strictness of channel "+channelID, &strict, func() {
+					state.StrictChannels[channelID] = strict
+				})
+			})
+
+		case "history":
+			return decodeEntries(dec, func(channelID string) error {
+				var history []HistoryEntry
+				return decodeEntry(dec, "history of channel "+channelID, &history, func() {
+					state.History[channelID] = history
+				})
+			})
+		}
 
-	var data []byte
-	var err error
+		var ignored json.RawMessage
+		return dec.Decode(&ignored)
+	})
 
-	data, err = json.Marshal(gServerState)
 	if err != nil {
-		return
+		log.Println("Gave up recovering ", stateFilename(), ": ", err)
+	}
+	log.Println(" -> recovered", len(state.UAIDToChannelIDs), "UAIDs and",
+		len(state.ChannelIDToChannel), "channels")
+}
+
+// Walk a JSON object, calling decodeValue to consume the value of each key
+func decodeEntries(dec *json.Decoder, decodeValue func(key string) error) error {
+	if tok, err := dec.Token(); err != nil {
+		return err
+	} else if tok != json.Delim('{') {
+		return fmt.Errorf("expected an object, got %v", tok)
+	}
+
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := tok.(string)
+		if err = decodeValue(key); err != nil {
+			return err
+		}
+	}
+
+	_, err := dec.Token()
+	return err
+}
+
+// Decode the next value into v and call keep, unless the value is
+// well-formed JSON that doesn't fit v, in which case it is skipped
+func decodeEntry(dec *json.Decoder, what string, v interface{}, keep func()) error {
+	var raw json.RawMessage
+	if err := dec.Decode(&raw); err != nil {
+		return err
+	}
+	if err := json.Unmarshal(raw, v); err != nil {
+		log.Println("Dropping", what+":", err)
+		return nil
+	}
+	keep()
+	return nil
+}
+
+// Saves take turns, so that an older state is never written over a
+// newer one
+var saveLock sync.Mutex
+
+var stateSaves = newCounter("push_state_saves_total",
+	"Full saves of the server state")
+var stateSaveTime = newCounter("push_state_save_milliseconds_total",
+	"Time spent on full saves; divide by push_state_saves_total for the mean")
+var lastStateSaveTime = newGauge("push_state_last_save_milliseconds",
+	"How long the latest full save took")
+
+func saveState() error {
+	logSampled(" -> saving state..")
+
+	saveLock.Lock()
+	defer saveLock.Unlock()
+
+	start := time.Now()
+	err := gStorage.Save(&gServerState)
+	elapsed := time.Since(start).Milliseconds()
+	stateSaves.Inc()
+	stateSaveTime.Add(uint64(elapsed))
+	lastStateSaveTime.Set(elapsed)
+	if err != nil {
+		log.Println("Could not save server state ", err)
+		return err
 	}
-	ioutil.WriteFile("serverstate.json", data, 0644)
+	return nil
 }
 
-func makeNotifyURL(suffix string) string {
+// The notify URL ending in suffix on host, or on the configured
+// Hostname if host is empty
+func makeNotifyURL(host, suffix string) string {
 	var scheme string
 	if gServerConfig.UseTLS {
 		scheme = "https://"
 	} else {
 		scheme = "http://"
 	}
+	if host == "" {
+		host = gServerConfig.Hostname
+	}
 
-	return scheme + gServerConfig.Hostname + ":" + gServerConfig.Port + gServerConfig.NotifyPrefix + suffix
+	return scheme + host + ":" + gServerConfig.Port + gServerConfig.NotifyPrefix + suffix
 }
 
+var registrations = newCounter("push_registrations_total",
+	"Channels registered")
+
+// The outcome of registering one channel
+type RegisterResult struct {
+	Status       int    `json:"status"`
+	PushEndpoint string `json:"pushEndpoint"`
+	ChannelID    string `json:"channelID"`
+	// The channel's current version, so that a client can tell
+	// whether it missed any updates without waiting for the next
+	Version uint64 `json:"version"`
+}
+
+// A register carries either one "channelID", or a "channelIDs" array
+// to register many at once. The latter is answered with the result for
+// each channel, in order, so that a conflict only fails its channel.
 func handleRegister(client *Client, f map[string]interface{}) {
 	type RegisterResponse struct {
-		Name         string `json:"messageType"`
-		Status       int    `json:"status"`
-		PushEndpoint string `json:"pushEndpoint"`
-		ChannelID    string `json:"channelID"`
+		Name string `json:"messageType"`
+		RegisterResult
+	}
+	type BatchRegisterResponse struct {
+		Name     string           `json:"messageType"`
+		Status   int              `json:"status"`
+		Channels []RegisterResult `json:"channels"`
+	}
+
+	var response interface{}
+	if channelIDs, ok := f["channelIDs"].([]interface{}); ok {
+		batch := BatchRegisterResponse{"register", 200, make([]RegisterResult, 0, len(channelIDs))}
+		gServerState.Lock()
+		for _, channelID := range channelIDs {
+			if channelID, ok := channelID.(string); ok && channelID != "" {
+				batch.Channels = append(batch.Channels, registerChannel(client, channelID, f))
+			} else {
+				batch.Channels = append(batch.Channels, RegisterResult{Status: 400})
+			}
+		}
+		gServerState.Unlock()
+		response = batch
+	} else {
+		var fields fieldReader
+		channelID := fields.string(f, "channelID", true)
+		if fields.err != nil {
+			sendFieldError(client, "register", fields.err)
+			return
+		}
+
+		gServerState.Lock()
+		register := RegisterResponse{"register", registerChannel(client, channelID, f)}
+		gServerState.Unlock()
+		response = register
 	}
 
-	if f["channelID"] == nil {
-		log.Println("channelID is missing!")
+	j, err := marshalFor(client.profile, response)
+	if err != nil {
+		log.Println("Could not convert register response to json ", err)
 		return
 	}
 
-	var channelID = f["channelID"].(string)
+	sendToClient(client, string(j))
+}
 
-	register := RegisterResponse{"register", 0, "", channelID}
+// Register one channel with the options in f. Called with the lock held.
+func registerChannel(client *Client, channelID string, f map[string]interface{}) RegisterResult {
+	register := RegisterResult{ChannelID: channelID}
 
 	prevEntry, exists := gServerState.ChannelIDToChannel[channelID]
+	maxChannels := gServerConfig.MaxChannelsPerUAID
 	if exists && prevEntry.UAID != client.UAID {
 		register.Status = 409
+	} else if !exists && maxChannels > 0 && len(gServerState.UAIDToChannelIDs[client.UAID]) >= maxChannels {
+		logEvent(levelWarn, "register_refused", "uaid", client.UAID, "channelID", channelID,
+			"reason", "too many channels", "maxChannels", maxChannels)
+		register.Status = 507
 	} else {
 
-		channel := &Channel{client.UAID, channelID, 0}
+		if exists {
+			// registering again keeps the channel as it is
+			register.Version = prevEntry.Version
+			prevEntry.Updated = time.Now().Unix()
+		} else {
+			gServerState.addChannel(&Channel{UAID: client.UAID, ChannelID: channelID, Updated: time.Now().Unix()})
+			audit(client.UAID, "register", channelID)
+			registrations.Inc()
+			logEvent(levelInfo, "register", "uaid", client.UAID, "channelID", channelID)
+		}
 
-		if gServerState.UAIDToChannelIDs[client.UAID] == nil {
-			gServerState.UAIDToChannelIDs[client.UAID] = make(ChannelIDSet)
+		if interval, ok := f["minInterval"].(float64); ok && interval > 0 {
+			gServerState.MinNotifyIntervals[channelID] = interval
+		}
+		if strict, ok := f["strict"].(bool); ok && strict {
+			gServerState.StrictChannels[channelID] = true
 		}
-		gServerState.UAIDToChannelIDs[client.UAID][channelID] = channel
-		gServerState.ChannelIDToChannel[channelID] = channel
 
 		register.Status = 200
-		register.PushEndpoint = makeNotifyURL(channelID)
+		register.PushEndpoint = makeNotifyURL(client.host, channelID)
 	}
 
 	if register.Status == 0 {
 		panic("Register(): status field was left unset when replying to client")
 	}
-
-	j, err := json.Marshal(register)
-	if err != nil {
-		log.Println("Could not convert register response to json %s", err)
-		return
-	}
-
-	if err = websocket.Message.Send(client.Websocket, string(j)); err != nil {
-		// we could not send the message to a peer
-		log.Println("Could not send message to ", client.Websocket, err.Error())
-	}
+	return register
 }
 
 func handleUnregister(client *Client, f map[string]interface{}) {
 
-	if f["channelID"] == nil {
-		log.Println("channelID is missing!")
+	var fields fieldReader
+	channelID := fields.string(f, "channelID", true)
+	if fields.err != nil {
+		sendFieldError(client, "unregister", fields.err)
 		return
 	}
 
-	var channelID = f["channelID"].(string)
-	_, ok := gServerState.ChannelIDToChannel[channelID]
-	if ok {
-		// only delete if UA owns this channel
-		_, owns := gServerState.UAIDToChannelIDs[client.UAID][channelID]
-		if owns {
-			// remove ownership
-			delete(gServerState.UAIDToChannelIDs[client.UAID], channelID)
-			// delete the channel itself
-			delete(gServerState.ChannelIDToChannel, channelID)
-		}
+	// only delete if UA owns this channel
+	gServerState.Lock()
+	if _, owns := gServerState.UAIDToChannelIDs[client.UAID][channelID]; owns {
+		gServerState.removeChannel(channelID)
+		audit(client.UAID, "unregister", channelID)
+		logEvent(levelInfo, "unregister", "uaid", client.UAID, "channelID", channelID)
 	}
+	gServerState.Unlock()
 
 	type UnregisterResponse struct {
 		Name      string `json:"messageType"`
@@ -215,393 +1186,2222 @@ func handleUnregister(client *Client, f map[string]interface{}) {
 
 	j, err := json.Marshal(unregister)
 	if err != nil {
-		log.Println("Could not convert unregister response to json %s", err)
+		log.Println("Could not convert unregister response to json ", err)
 		return
 	}
 
-	if err = websocket.Message.Send(client.Websocket, string(j)); err != nil {
-		// we could not send the message to a peer
-		log.Println("Could not send message to ", client.Websocket, err.Error())
+	sendToClient(client, string(j))
+}
+
+// The versions of the wire protocol this server speaks. A hello may ask
+// for one with "protocolVersion"; clients that don't are on version 1.
+const (
+	minProtocolVersion = 1
+	maxProtocolVersion = 1
+)
+
+// The protocol version a hello asks for, or why it can't be spoken
+func negotiateProtocol(requested interface{}) (int, string) {
+	if requested == nil {
+		return minProtocolVersion, ""
+	}
+	version, ok := requested.(float64)
+	if !ok || version != float64(int(version)) {
+		return 0, "protocolVersion must be an integer"
 	}
+	if version < minProtocolVersion || version > maxProtocolVersion {
+		return 0, fmt.Sprintf("protocolVersion %g is not supported; this server speaks %d to %d",
+			version, minProtocolVersion, maxProtocolVersion)
+	}
+	return int(version), ""
 }
 
 func handleHello(client *Client, f map[string]interface{}) {
+	type HelloResponse struct {
+		Name   string `json:"messageType"`
+		Status int    `json:"status"`
+		UAID   string `json:"uaid"`
+		// Lets the client long-poll for this UAID when it can't
+		// keep a websocket open
+		PollToken string `json:"pollToken,omitempty"`
+		// The newest protocol version the server speaks, and why
+		// the client's version was refused, if it was
+		ProtocolVersion int    `json:"protocolVersion"`
+		Reason          string `json:"reason,omitempty"`
+	}
+
+	var fields fieldReader
+	requestedUAID := fields.uaid(f, "uaid", false)
+	channelIDs := fields.strings(f, "channelIDs")
+	var ip string
+	var port float64
+	if hostport := fields.object(f, "wakeup_hostport"); hostport != nil {
+		ip = fields.string(hostport, "ip", true)
+		port = fields.number(hostport, "port", true)
+	}
+	if gServerConfig.DisableUDPWakeup {
+		ip, port = "", 0
+	} else if ip != "" && fields.err == nil {
+		if err := checkWakeupHostport(client, ip, port); err != nil {
+			// the client still gets its connection, it just won't
+			// be woken up
+			logEvent(levelWarn, "wakeup_hostport_ignored", "ip", ip, "port", port,
+				"remoteAddr", client.RemoteAddr, "error", err)
+			ip, port = "", 0
+		}
+	}
+
+	version, reason := negotiateProtocol(f["protocolVersion"])
+	if reason == "" && fields.err != nil {
+		reason = fields.err.Error()
+	}
+	if reason != "" {
+		logEvent(levelWarn, "hello_refused", "reason", reason)
+		profile, _ := f["profile"].(string)
+		j, err := marshalFor(profile, HelloResponse{Name: "hello", Status: 400,
+			ProtocolVersion: maxProtocolVersion, Reason: reason})
+		if err != nil {
+			log.Println("Could not convert hello response to json ", err)
+			return
+		}
+		sendToClient(client, string(j))
+		return
+	}
+	// only read by the handlers of the client's own messages
+	client.protocolVersion = version
 
 	status := 200
 
-	if f["uaid"] == nil {
+	gServerState.Lock()
+	if requestedUAID == "" {
 		uaid, err := uuid.GenUUID()
 		if err != nil {
 			status = 400
-			log.Println("GenUUID error %s", err)
+			log.Println("GenUUID error ", err)
 		}
 		client.UAID = uaid
 	} else {
-		client.UAID = f["uaid"].(string)
+		client.UAID = requestedUAID
 
 		resetClient := false
+		var unknownChannelID string
 
-		if f["channelIDs"] != nil {
-			for _, foo := range f["channelIDs"].([]interface{}) {
-				channelID := foo.(string)
-
+		if channelIDs != nil {
+			for _, channelID := range channelIDs {
 				if gServerState.UAIDToChannelIDs[client.UAID] == nil {
-					gServerState.UAIDToChannelIDs[client.UAID] = make(ChannelIDSet)
 					// since we don't have any channelIDs, don't bother looping any more
 					resetClient = true
+					unknownChannelID = channelID
 					break
 				}
 
 				if _, ok := gServerState.UAIDToChannelIDs[client.UAID][channelID]; !ok {
 					resetClient = true
+					unknownChannelID = channelID
 					break
 				}
 			}
 		}
 
 		if resetClient {
+			logEvent(levelWarn, "uaid_reset", "uaid", client.UAID, "channelID", unknownChannelID)
+			clientResets.Inc()
+
 			// delete the older connection
 			delete(gServerState.ConnectedClients, client.UAID)
-			delete(gServerState.UAIDToChannelIDs, client.UAID)
-			// TODO(nsm) clear up ChannelIDToChannels which now has extra
-			// channelIDs not associated with any client
+			gServerState.removeUAID(client.UAID)
+			audit(client.UAID, "reset", client.UAID)
 
 			uaid, err := uuid.GenUUID()
 			if err != nil {
 				status = 400
-				log.Println("GenUUID error %s", err)
+				log.Println("GenUUID error ", err)
 			}
 			client.UAID = uaid
 		}
 	}
 
-	gServerState.ConnectedClients[client.UAID] = client
+	uaid := client.UAID
+
+	// closed once the lock is released
+	var evicted *websocket.Conn
+	previous, connected := gServerState.ConnectedClients[uaid]
+	if connected && previous != client && previous.attached && gServerConfig.DeliveryPolicy != "" {
+		// the poll or stream carries on next to the websocket
+		gServerState.Transports[uaid] = append(gServerState.Transports[uaid], previous)
+	} else if connected && previous != client && previous.Websocket != nil {
+		if gServerConfig.DuplicateHelloPolicy == "reject" {
+			logEvent(levelWarn, "hello_rejected", "uaid", uaid, "reason", "already connected")
+			status = 409
+		} else {
+			logEvent(levelInfo, "connection_evicted", "uaid", uaid)
+			evicted = previous.Websocket
+			previous.Websocket = nil
+		}
+	}
+
+	client.profile, _ = f["profile"].(string)
 
-	if f["wakeup_hostport"] != nil {
-		m := f["wakeup_hostport"].(map[string]interface{})
-		client.Ip = m["ip"].(string)
-		client.Port = m["port"].(float64)
-		log.Println("Got hostport pair ", client.Ip, client.Port)
+	if status == 409 {
+		// leave the connection unregistered; it can say hello again
+		client.UAID = ""
 	} else {
-		log.Println("No hostport ", f)
+		gServerState.ConnectedClients[uaid] = client
+		fireWebhook(gServerConfig.ConnectWebhook, "connect", uaid)
+
+		// the client is still around to use its channels
+		now := time.Now().Unix()
+		for _, channel := range gServerState.UAIDToChannelIDs[uaid] {
+			channel.Updated = now
+		}
+
+		client.platform, _ = f["platform"].(string)
+
+		if ip != "" {
+			client.Ip = ip
+			client.Port = port
+		}
 	}
+	gServerState.Unlock()
+	logEvent(levelInfo, "hello", "uaid", uaid, "status", status, "platform", client.platform,
+		"wakeupIP", client.Ip, "wakeupPort", client.Port)
 
-	type HelloResponse struct {
-		Name   string `json:"messageType"`
-		Status int    `json:"status"`
-		UAID   string `json:"uaid"`
+	if evicted != nil {
+		closeClientSocket(evicted, closeReplaced, writeTimeout())
 	}
 
-	hello := HelloResponse{"hello", status, client.UAID}
+	hello := HelloResponse{Name: "hello", Status: status, UAID: uaid, ProtocolVersion: maxProtocolVersion}
+	if status == 200 {
+		hello.PollToken = pollToken(uaid)
+	}
 
-	j, err := json.Marshal(hello)
+	j, err := marshalFor(client.profile, hello)
 	if err != nil {
-		log.Println("Could not convert hello response to json %s", err)
+		log.Println("Could not convert hello response to json ", err)
 		return
 	}
 
-	if err = websocket.Message.Send(client.Websocket, string(j)); err != nil {
-		log.Println("Could not send message to ", client.Websocket, err.Error())
-	}
-}
+	sendToClient(client, string(j))
 
-func handleAck(client *Client, f map[string]interface{}) {
-	for _, update := range f["updates"].([]interface{}) {
-		typeConverted := update.(map[string]interface{})
-		version := uint64(typeConverted["version"].(float64))
-		ack := Ack{typeConverted["channelID"].(string), version}
-		log.Println(ack)
-		ackChan <- ack
+	if wantsHistory, _ := f["history"].(bool); wantsHistory && status == 200 {
+		sendHistory(client)
 	}
 }
 
-func pushHandler(ws *websocket.Conn) {
+// Move the client's channels to a new UAID. The client proves it owns
+// the old UAID with the token its hello handed out, so migrating needs
+// a PollSecret. Notifications still waiting for the old UAID move with
+// it.
+func handleMigrate(client *Client, f map[string]interface{}) {
+	type MigrateResponse struct {
+		Name   string `json:"messageType"`
+		Status int    `json:"status"`
+		UAID   string `json:"uaid"`
+	}
 
-	client := &Client{ws, "", "", 0, time.Now()}
+	var fields fieldReader
+	newUAID := fields.uaid(f, "newUAID", true)
+	token := fields.string(f, "token", true)
+	if fields.err != nil {
+		sendFieldError(client, "migrate", fields.err)
+		return
+	}
 
-	for {
-		var f map[string]interface{}
+	gServerState.Lock()
+	from := client.UAID
+	response := MigrateResponse{"migrate", 200, from}
+
+	_, known := gServerState.UAIDToChannelIDs[newUAID]
+	_, connected := gServerState.ConnectedClients[newUAID]
+	want := pollToken(from)
+	if from == "" || want == "" || subtle.ConstantTimeCompare([]byte(token), []byte(want)) != 1 {
+		logEvent(levelWarn, "migrate_refused", "uaid", from, "newUAID", newUAID, "reason", "bad token")
+		response.Status = 401
+	} else if known || connected {
+		logEvent(levelWarn, "migrate_refused", "uaid", from, "newUAID", newUAID, "reason", "UAID in use")
+		response.Status = 409
+	} else {
+		logEvent(levelInfo, "migrate", "uaid", from, "newUAID", newUAID)
+		audit(from, "migrate", newUAID)
+		gServerState.renameUAID(from, newUAID)
+		delete(gServerState.ConnectedClients, from)
+		gServerState.ConnectedClients[newUAID] = client
+		client.UAID = newUAID
+		response.UAID = newUAID
+	}
+	gServerState.Unlock()
 
-		var err error
-		if err = websocket.JSON.Receive(ws, &f); err != nil {
-			log.Println("Websocket Disconnected.", err.Error())
-			break
-		}
+	if response.Status == 200 {
+		migratePending(from, newUAID)
+	}
 
-		client.LastContact = time.Now()
-		log.Println("pushHandler msg: ", f["messageType"])
+	j, err := marshalFor(client.profile, response)
+	if err != nil {
+		log.Println("Could not convert migrate response to json ", err)
+		return
+	}
 
-		switch f["messageType"] {
-		case "hello":
-			handleHello(client, f)
-			break
+	sendToClient(client, string(j))
+}
 
-		case "register":
-			handleRegister(client, f)
-			break
+// Reply to an ack some of whose updates were rejected
+type AckResult struct {
+	ChannelID string `json:"channelID,omitempty"`
+	Status    int    `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
 
-		case "unregister":
-			handleUnregister(client, f)
-			break
+// The ack in one update of an ack message, or why it's malformed
+func parseAck(update interface{}, platform string) (Ack, string) {
+	fields, ok := update.(map[string]interface{})
+	if !ok {
+		return Ack{}, "update is not an object"
+	}
+	channelID, ok := fields["channelID"].(string)
+	if !ok || channelID == "" {
+		return Ack{}, "channelID is missing"
+	}
+	version, ok := fields["version"].(float64)
+	if !ok || version < 0 || version != math.Trunc(version) || version >= math.MaxUint64 {
+		return Ack{ChannelID: channelID}, "version is not a valid version"
+	}
 
-		case "ack":
-			handleAck(client, f)
+	ack := Ack{ChannelID: channelID, Version: uint64(version), Platform: platform}
+	if status, ok := fields["status"]; ok {
+		code, ok := status.(float64)
+		if !ok || code != math.Trunc(code) {
+			return ack, "status is not a number"
+		}
+		ack.Status = int(code)
+	}
+	if reason, ok := fields["error"].(string); ok {
+		ack.Error = reason
+	}
+	return ack, ""
+}
+
+// Note the versions uaid acked on its own channels. Acks for versions
+// the server never had count as acks for the current one.
+func recordAcks(uaid string, acks []Ack) {
+	gServerState.Lock()
+	defer gServerState.Unlock()
+	for _, ack := range acks {
+		channel, ok := gServerState.ChannelIDToChannel[ack.ChannelID]
+		if !ok || channel.UAID != uaid || ack.Status != 0 && ack.Status != 200 {
+			continue
+		}
+		version := ack.Version
+		if version > channel.Version {
+			version = channel.Version
+		}
+		if version > channel.Acked {
+			channel.Acked = version
+		}
+	}
+}
+
+// Malformed updates are left out, and if there are any, the client is
+// told which with a status for each update
+func handleAck(client *Client, f map[string]interface{}) {
+	updates, ok := f["updates"].([]interface{})
+	if !ok {
+		logEvent(levelWarn, "ack_rejected", "uaid", client.UAID, "reason", "updates are missing")
+		invalidAcks.Inc()
+		sendAckResults(client, []AckResult{})
+		return
+	}
+
+	var acks []Ack
+	results := make([]AckResult, 0, len(updates))
+	rejected := false
+	for _, update := range updates {
+		ack, reason := parseAck(update, client.platform)
+		if reason != "" {
+			logEvent(levelWarn, "ack_rejected", "uaid", client.UAID, "channelID", ack.ChannelID,
+				"reason", reason)
+			invalidAcks.Inc()
+			results = append(results, AckResult{ack.ChannelID, 400, reason})
+			rejected = true
+			continue
+		}
+		logEvent(levelDebug, "ack", "uaid", client.UAID, "channelID", ack.ChannelID,
+			"version", ack.Version, "status", ack.Status)
+		results = append(results, AckResult{ChannelID: ack.ChannelID, Status: 200})
+		acks = append(acks, ack)
+	}
+
+	if len(acks) > 0 {
+		recordAcks(client.UAID, acks)
+		ackChan <- acks
+	}
+	if rejected {
+		sendAckResults(client, results)
+	}
+}
+
+func sendAckResults(client *Client, results []AckResult) {
+	type AckResponse struct {
+		Name    string      `json:"messageType"`
+		Status  int         `json:"status"`
+		Updates []AckResult `json:"updates"`
+	}
+
+	j, err := marshalFor(client.profile, AckResponse{"ack", 400, results})
+	if err != nil {
+		log.Println("Could not convert ack response to json ", err)
+		return
+	}
+
+	sendToClient(client, string(j))
+}
+
+type messageHandler struct {
+	handle func(client *Client, f map[string]interface{})
+	// whether the message changes the state that is saved; acks
+	// only touch pending notifications, which aren't
+	dirty bool
+}
+
+var messageHandlers = map[string]messageHandler{
+	"hello":      {handleHello, true},
+	"register":   {handleRegister, true},
+	"unregister": {handleUnregister, true},
+	"ack":        {handleAck, false},
+	"subscribe":  {handleSubscribe, true},
+	"migrate":    {handleMigrate, true},
+}
+
+var handlerPanics = newCounter("push_handler_panics_total",
+	"Client messages whose handler panicked")
+
+// Handle one message from client, returning false if the handler
+// panicked. The panic is logged and the client told, and the connection
+// carries on. A handler that panics with the state locked still leaves
+// it locked, so handlers keep their locked sections simple.
+func handleMessage(client *Client, messageType string, handler messageHandler, f map[string]interface{}) (ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Println("Handling ", messageType, " from ", client.UAID, " panicked: ", r, "\n", string(debug.Stack()))
+			handlerPanics.Inc()
+			sendToClient(client, fmt.Sprintf(`{"messageType":%q,"status":500,"error":"internal error"}`, messageType))
+			ok = false
+		}
+	}()
+
+	handler.handle(client, f)
+	return true
+}
+
+func pushHandler(ws *websocket.Conn) {
+
+	client := newClient(ws)
+	client.host = notifyHost(ws.Request().Host)
+	client.RemoteAddr = ws.Request().RemoteAddr
+	writerDone := make(chan bool)
+	go func() {
+		clientWriter(client, ws)
+		close(writerDone)
+	}()
+	// deferred, so that a message that makes a handler panic
+	// doesn't leave the writer or the socket behind
+	defer closeClient(client, ws, writerDone)
+
+	// once the client has said hello, anything it sends
+	// buys it another IdleTimeout
+	idleTimeout := configDuration(gServerConfig.IdleTimeout)
+	extendDeadline := func() {
+		if client.UAID == "" {
+			return
+		}
+		if idleTimeout > 0 {
+			ws.SetReadDeadline(time.Now().Add(idleTimeout))
+		} else {
+			ws.SetReadDeadline(time.Time{})
+		}
+	}
+
+	ws.PongHandler = func() {
+		gServerState.Lock()
+		client.lastPong = time.Now()
+		gServerState.Unlock()
+		extendDeadline()
+	}
+
+	// give up on clients that don't say hello in time
+	handshakeTimeout := configDuration(gServerConfig.HandshakeTimeout)
+	if handshakeTimeout <= 0 {
+		handshakeTimeout = 10 * time.Second
+	}
+	ws.SetReadDeadline(time.Now().Add(handshakeTimeout))
+
+	for {
+		var f map[string]interface{}
+
+		var err error
+		if err = websocket.JSON.Receive(ws, &f); err != nil {
+			logSampled("Websocket Disconnected.", err.Error())
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && client.UAID != "" {
+				client.idle = true
+			}
 			break
+		}
+		extendDeadline()
+
+		gServerState.Lock()
+		client.LastContact = time.Now()
+		gServerState.Unlock()
+		logSampled("pushHandler msg: ", f["messageType"])
+
+		if client.UAID == "" && f["messageType"] != "hello" {
+			log.Println(" -> Ignoring message before hello", f)
+			continue
+		}
+
+		messageType, _ := f["messageType"].(string)
+		handler, ok := messageHandlers[messageType]
+		if !ok {
+			log.Println(" -> Unknown", f)
+			continue
+		}
+		if handleMessage(client, messageType, handler, f) && handler.dirty {
+			markStateDirty()
+		}
+		// a hello starts the idle timeout
+		extendDeadline()
+	}
+
+}
+
+func closeClient(client *Client, ws *websocket.Conn, writerDone chan bool) {
+	logSampled("Closing Websocket!")
+	close(client.done)
+	// don't close the socket under a write
+	<-writerDone
+	closeClientSocket(ws, closeNormal, writeTimeout())
+
+	if client.UAID == "" {
+		incompleteHandshakes.Inc()
+	}
+
+	// if a client disconnected before completing the handshake
+	// it'll have an empty UAID, and if another connection took
+	// over its UAID, that one's websocket is none of our business
+	gServerState.Lock()
+	if client.UAID != "" && gServerState.ConnectedClients[client.UAID] == client {
+		client.Websocket = nil
+		if client.idle && client.Ip == "" {
+			// there's no reaching it until it comes back
+			log.Println("Forgetting idle client ", client.UAID)
+			delete(gServerState.ConnectedClients, client.UAID)
+		}
+		fireWebhook(gServerConfig.DisconnectWebhook, "disconnect", client.UAID)
+	}
+	gServerState.Unlock()
+}
+
+func notifyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "PUT" {
+		log.Println("NOT A PUT")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Method must be PUT."))
+		return
+	}
+	if !notifyAuthorized(w, r) {
+		return
+	}
+
+	// Percent-encoding can triple the size of the data, and the rest
+	// of the form is small. The limit goes on before anything reads
+	// the body, forwarding included.
+	maxData := gServerConfig.MaxDataSize
+	if maxData <= 0 {
+		maxData = 4096
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, int64(3*maxData+1024))
+
+	channelID := strings.Replace(r.URL.Path, gServerConfig.NotifyPrefix, "", 1)
+
+	if strings.Contains(channelID, "/") {
+		log.Println("Could not find a valid channelID")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Could not find a valid channelID."))
+		return
+	}
+
+	if ok, wait := gNotifyLimiter.allow(channelID, time.Now()); !ok {
+		logEvent(levelDebug, "notify_limited", "channelID", channelID, "retryAfter", wait.Seconds())
+		notifiesLimited.Inc()
+		w.Header().Set("Retry-After", fmt.Sprint(int(math.Ceil(wait.Seconds()))))
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte("Too many notifies for this channel."))
+		return
+	}
+
+	gServerState.RLock()
+	channel, found := gServerState.ChannelIDToChannel[channelID]
+	var uaid string
+	if found {
+		uaid = channel.UAID
+	}
+	gServerState.RUnlock()
+	if !found {
+		channel, found = loadSharedChannel(channelID)
+		if found {
+			uaid = channel.UAID
+		}
+	}
+	if !found {
+		logEvent(levelWarn, "notify_unknown_channel", "channelID", channelID)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Could not find channel."))
+		return
+	}
+
+	if forwardToOwner(w, r, uaid) {
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		log.Println("Could not parse notify body: ", err)
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Could not read the body; it may be too large."))
+		return
+	}
+
+	if r.FormValue("dryRun") == "true" {
+		reportNotifyTargets(w, []*Channel{channel})
+		return
+	}
+
+	data := r.PostFormValue("data")
+	if len(data) > maxData {
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		w.Write([]byte("Data is too large."))
+		return
+	}
+
+	// The app server sends the new version as "version=N" in a
+	// form-encoded body, or "delta=N" to add N to the current version,
+	// but not both. If it sends neither, just bump the current version.
+	// A "data" field is delivered along with the version.
+	//
+	// Sending the version makes a notify safe to retry: the same
+	// version again is just delivered again. A bump or delta only
+	// counts once the notification is queued; a notify refused with a
+	// 503 leaves the version as it was, so retrying it doesn't skip one.
+	// A save that timed out may finish later, and is then saved over
+	// with the version as it was.
+	var version uint64
+	var delta uint64 = 1
+	v, d := r.FormValue("version"), r.FormValue("delta")
+	if v != "" && d != "" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Send either a version or a delta, not both."))
+		return
+	}
+	if v != "" {
+		ret, err := fmt.Sscanf(v, "%d", &version)
+		if ret != 1 || err != nil {
+			log.Println("Could not parse version string: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Could not parse version string"))
+			return
+		}
+	}
+	if d != "" {
+		ret, err := fmt.Sscanf(d, "%d", &delta)
+		if ret != 1 || err != nil || delta == 0 {
+			log.Println("Could not parse delta string: ", err)
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte("Could not parse delta string"))
+			return
+		}
+	}
+
+	gServerState.Lock()
+	overflow := v == "" && channel.Version > math.MaxUint64-delta
+	if v == "" && !overflow {
+		version = channel.Version + delta
+	}
+	stale := version < channel.Version
+	previous := []Channel{*channel}
+	if !stale && !overflow {
+		channel.Version = version
+		channel.Data = data
+		channel.Updated = time.Now().Unix()
+	}
+	gServerState.Unlock()
+
+	if overflow {
+		logEvent(levelWarn, "notify_overflow", "uaid", uaid, "channelID", channelID)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Version would overflow."))
+		return
+	}
+	if stale {
+		// might be an old message, just ignore
+		return
+	}
+
+	audit(r.RemoteAddr, "notify", channelID, fmt.Sprint(version))
+	logEvent(levelInfo, "notify", "uaid", uaid, "channelID", channelID, "version", version)
+	if err := deliverChannels([]*Channel{channel}, previous, []uint64{version}); err != nil {
+		writeDeliveryError(w, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+// Notifies save the channels they bump before returning, so a slow
+// disk slows them down. At most MaxConcurrentSaves of those saves run
+// at once, and a notify whose save can't finish within SaveTimeout is
+// turned away rather than left waiting. The save itself carries on in
+// the background, still holding its slot, and once it's done the
+// channels are saved again as they were before the notify.
+var saveSlots chan bool
+
+// Swapped out by tests
+var storeState = saveState
+var storeChannels = saveChannels
+
+// Save the new versions of some channels, without saving the rest of
+// the state
+func saveChannels(channels []*Channel) error {
+	if err := gStorage.PutChannels(&gServerState, channels); err != nil {
+		log.Println("Could not save channel versions ", err)
+		return err
+	}
+	// so the state writer folds them into a full save before long
+	markStateDirty()
+	return nil
+}
+
+var errSaveTimeout = errors.New("timed out saving the state")
+
+var notifiesShed = newCounter("push_notifies_shed_total",
+	"Notifies refused because saving the state took too long or the queue was full")
+
+func startSaves() {
+	limit := gServerConfig.MaxConcurrentSaves
+	if limit <= 0 {
+		limit = 4
+	}
+	saveSlots = make(chan bool, limit)
+}
+
+// Save channels with storeChannels, unless that takes longer than
+// timeout. When it times out with the save under way, it also returns
+// where the save's result goes once it's done.
+func saveWithin(timeout time.Duration, channels []*Channel) (<-chan error, error) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	slots, store := saveSlots, storeChannels
+	select {
+	case slots <- true:
+	case <-timer.C:
+		return nil, errSaveTimeout
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		defer func() { <-slots }()
+		done <- store(channels)
+	}()
+
+	select {
+	case err := <-done:
+		return nil, err
+	case <-timer.C:
+		return done, errSaveTimeout
+	}
+}
+
+var notificationsReceived = newCounter("push_notifications_received_total",
+	"Channel updates accepted from app servers")
+
+// Persist the new versions of some channels, which a notify changed
+// from previous to applied, and queue them for delivery. Fails having
+// queued nothing if saving failed, with errSaveTimeout if it took too
+// long, or with errQueueFull if the NotifyQueuePolicy shed the rest
+// once the queue filled up. The channels that weren't queued are
+// reverted.
+func deliverChannels(channels []*Channel, previous []Channel, applied []uint64) error {
+	timeout := configDuration(gServerConfig.SaveTimeout)
+	if timeout <= 0 {
+		timeout = 2 * time.Second
+	}
+	if stored, err := saveWithin(timeout, channels); err == errSaveTimeout {
+		log.Println("Saving the state is too slow, shedding notify")
+		notifiesShed.Inc()
+		revertChannels(channels, previous, applied, stored)
+		return err
+	} else if err != nil {
+		revertChannels(channels, previous, applied, nil)
+		return err
+	}
+
+	if gServerConfig.HistorySize > 0 {
+		gServerState.Lock()
+		gServerState.recordHistory(channels, time.Now())
+		gServerState.Unlock()
+	}
+
+	// later notifies bump the same Channels, so each notification
+	// carries a copy of the version it is for
+	gServerState.RLock()
+	notifications := make([]Notification, 0, len(channels))
+	for _, channel := range channels {
+		snapshot := *channel
+		notifications = append(notifications, Notification{UAID: snapshot.UAID, Channel: &snapshot})
+	}
+	gServerState.RUnlock()
+
+	for i, notification := range notifications {
+		if err := queueNotification(notification); err != nil {
+			log.Println("Notification queue is full, shedding notify")
+			notifiesShed.Inc()
+			// the ones already queued may be on their way to the
+			// client, so they keep their new versions
+			revertChannels(channels[i:], previous[i:], applied[i:], nil)
+			return err
+		}
+		notificationsReceived.Inc()
+	}
+	return nil
+}
+
+// Put channels back as they were in previous, before a notify that was
+// refused set their versions to applied, unless another notify changed
+// them since. The new versions may already be saved, so the reverted
+// channels are saved again over them; if stored is set, once the save
+// that stored reports on is done, so that it can't come after.
+func revertChannels(channels []*Channel, previous []Channel, applied []uint64, stored <-chan error) {
+	var reverted []*Channel
+	var from []uint64
+	gServerState.Lock()
+	for i, channel := range channels {
+		if channel.Version == applied[i] {
+			prev := previous[i]
+			channel.Version, channel.Data, channel.Updated = prev.Version, prev.Data, prev.Updated
+			reverted = append(reverted, channel)
+			from = append(from, applied[i])
+		}
+	}
+	gServerState.Unlock()
+	if len(reverted) == 0 {
+		return
+	}
+
+	storage := gStorage
+	save := func() {
+		if err := revertSavedChannels(storage, reverted, from); err != nil {
+			log.Println("Could not save reverted channels ", err)
+		}
+		markStateDirty()
+	}
+	if stored == nil {
+		save()
+		return
+	}
+	go func() {
+		<-stored
+		save()
+	}()
+}
+
+// Reply to a notify that was shed because the server is overloaded
+func writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Server is overloaded."))
+}
+
+// Reply to a notify that deliverChannels failed with err
+func writeDeliveryError(w http.ResponseWriter, err error) {
+	if err == errSaveTimeout || err == errQueueFull {
+		writeOverloaded(w)
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte("Could not save the notification."))
+}
+
+// Handles PUT /uaid/<uaid>/notify, which bumps the version of every
+// channel owned by the UAID
+func uaidHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/uaid/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] != "notify" {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found."))
+		return
+	}
+	uaid := parts[0]
+
+	if r.Method != "PUT" {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Method must be PUT."))
+		return
+	}
+	if !notifyAuthorized(w, r) {
+		return
+	}
+
+	gServerState.Lock()
+	channelIDSet, found := gServerState.UAIDToChannelIDs[uaid]
+	// bump none of the channels if any of them can't be bumped
+	overflow := ""
+	for channelID, channel := range channelIDSet {
+		if channel.Version == math.MaxUint64 {
+			overflow = channelID
+			break
+		}
+	}
+	var channels []*Channel
+	var previous []Channel
+	var applied []uint64
+	if overflow == "" {
+		for _, channel := range channelIDSet {
+			previous = append(previous, *channel)
+			// the payload was for the previous version
+			channel.Version++
+			channel.Data = ""
+			channel.Updated = time.Now().Unix()
+			channels = append(channels, channel)
+			applied = append(applied, channel.Version)
+		}
+	}
+	gServerState.Unlock()
+
+	if !found {
+		log.Println("Could not find UAID " + uaid)
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Could not find UAID."))
+		return
+	}
+	if overflow != "" {
+		logEvent(levelWarn, "notify_overflow", "uaid", uaid, "channelID", overflow)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Version would overflow."))
+		return
+	}
+	audit(r.RemoteAddr, "notify-uaid", uaid)
+	logEvent(levelInfo, "notify_uaid", "uaid", uaid, "channels", len(channels))
+	if err := deliverChannels(channels, previous, applied); err != nil {
+		writeDeliveryError(w, err)
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Notified int `json:"notified"`
+	}{len(channels)})
+	if err != nil {
+		log.Println("Could not convert UAID notify response to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+// Tell the app server who a notify would reach, without sending anything
+func reportNotifyTargets(w http.ResponseWriter, channels []*Channel) {
+	type Target struct {
+		UAID      string `json:"uaid"`
+		ChannelID string `json:"channelID"`
+		Online    bool   `json:"online"`
+	}
+
+	type DryRunResponse struct {
+		Targets []Target `json:"targets"`
+	}
+
+	response := DryRunResponse{[]Target{}}
+	gServerState.RLock()
+	for _, channel := range channels {
+		client, connected := gServerState.ConnectedClients[channel.UAID]
+		online := connected && client.online()
+		response.Targets = append(response.Targets, Target{channel.UAID, channel.ChannelID, online})
+	}
+	gServerState.RUnlock()
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Could not convert dry run response to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
+
+var wakeupsSent = newCounter("push_wakeups_sent_total",
+	"UDP wakeups sent to clients")
+
+// The address to send wakeups for ip and port to, if a wakeup could
+// sensibly go there
+func wakeupAddress(ip string, port float64) (*net.UDPAddr, error) {
+	addr := &net.UDPAddr{IP: net.ParseIP(ip).To4(), Port: int(port)}
+	if addr.IP == nil || addr.IP.IsUnspecified() || addr.IP.IsMulticast() || addr.IP.Equal(net.IPv4bcast) {
+		return nil, fmt.Errorf("bad wakeup address %q", ip)
+	}
+	if port != math.Trunc(port) || port < 1 || port > 65535 {
+		return nil, fmt.Errorf("bad wakeup port %g", port)
+	}
+	return addr, nil
+}
+
+// Whether the wakeup_hostport a client sent in its hello can be kept.
+// It has to be the address the client connected from, unless
+// AllowForeignWakeupIP is set, and even then it can't be a loopback,
+// private or link-local address, so that clients can't point wakeups
+// at the server itself or the network it sits on.
+func checkWakeupHostport(client *Client, ip string, port float64) error {
+	addr, err := wakeupAddress(ip, port)
+	if err != nil {
+		return err
+	}
+	host, _, _ := net.SplitHostPort(client.RemoteAddr)
+	if remote := net.ParseIP(host); remote != nil && remote.Equal(addr.IP) {
+		return nil
+	}
+	if !gServerConfig.AllowForeignWakeupIP {
+		return fmt.Errorf("wakeup address %s is not where the client connected from", ip)
+	}
+	if addr.IP.IsLoopback() || addr.IP.IsPrivate() || addr.IP.IsLinkLocalUnicast() {
+		return fmt.Errorf("wakeup address %s is not a public address", ip)
+	}
+	return nil
+}
+
+// The WakeupPayload template, parsed once the config is read. Nil
+// sends the default.
+var gWakeupPayload *template.Template
+
+func parseWakeupPayload(payload string) (*template.Template, error) {
+	if payload == "" {
+		return nil, nil
+	}
+	return template.New("wakeup").Parse(payload)
+}
+
+// The address and payload to wake client up with, for a notification
+// on channelID
+func wakeupMessage(client *Client, channelID string) (*net.UDPAddr, []byte, error) {
+	gServerState.RLock()
+	ip, port := client.Ip, client.Port
+	gServerState.RUnlock()
+	if gServerConfig.WakeupPort > 0 {
+		port = float64(gServerConfig.WakeupPort)
+	}
+
+	if gServerConfig.DisableUDPWakeup {
+		return nil, nil, errors.New("UDP wakeups are disabled")
+	}
+	addr, err := wakeupAddress(ip, port)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if gWakeupPayload == nil {
+		return addr, []byte("push"), nil
+	}
+	var message bytes.Buffer
+	err = gWakeupPayload.Execute(&message, struct{ UAID, ChannelID string }{client.UAID, channelID})
+	if err != nil {
+		return nil, nil, fmt.Errorf("bad wakeupPayload: %v", err)
+	}
+	return addr, message.Bytes(), nil
+}
+
+func wakeupClient(client *Client, channelID string) error {
+	addr, message, err := wakeupMessage(client, channelID)
+	if err != nil {
+		logEvent(levelError, "wakeup_failed", "uaid", client.UAID, "error", err)
+		return err
+	}
+
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		logEvent(levelError, "wakeup_failed", "uaid", client.UAID, "address", addr, "error", err)
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(message)
+	if err != nil {
+		logEvent(levelError, "wakeup_failed", "uaid", client.UAID, "address", addr, "error", err)
+		return err
+	}
+	logEvent(levelInfo, "wakeup", "uaid", client.UAID, "channelID", channelID, "address", addr)
+	wakeupsSent.Inc()
+	return nil
+}
+
+// Wakeups run in the background, at most MaxConcurrentWakeups at a
+// time. When they're all busy, further wakeups are dropped; the
+// notification stays pending, so it'll be retried on the next sweep.
+var wakeupSlots chan bool
+
+// Swapped out by tests
+var wakeup = wakeupClient
+
+var wakeupsDropped = newCounter("push_wakeups_dropped_total",
+	"Wakeups dropped because too many were already in progress")
+
+func startWakeups() {
+	limit := gServerConfig.MaxConcurrentWakeups
+	if limit <= 0 {
+		limit = 16
+	}
+	wakeupSlots = make(chan bool, limit)
+}
+
+var wakeupsSuppressed = newCounter("push_wakeups_suppressed_total",
+	"Wakeups skipped because the client was woken moments ago")
+
+var wakeupsAbandoned = newCounter("push_wakeups_abandoned_total",
+	"Clients given up on after too many failed wakeups in a row")
+
+// Wake client up for a notification on channelID
+func requestWakeup(client *Client, channelID string) {
+	// a client that was just woken is most likely reconnecting already;
+	// the notification stays pending until it's back
+	window := configDuration(gServerConfig.WakeupReconnectWindow)
+	if window <= 0 {
+		window = 10 * time.Second
+	}
+	maxFailures := gServerConfig.MaxWakeupFailures
+	if maxFailures <= 0 {
+		maxFailures = 10
+	}
+
+	client.wakeupLock.Lock()
+	recent := time.Since(client.LastWakeup) < window
+	backingOff := time.Now().Before(client.wakeupRetryAt)
+	abandoned := client.wakeupFailures >= maxFailures
+	client.wakeupLock.Unlock()
+
+	if abandoned || backingOff {
+		return
+	}
+	if recent {
+		logEvent(levelDebug, "wakeup_suppressed", "uaid", client.UAID, "reason", "woken moments ago")
+		wakeupsSuppressed.Inc()
+		return
+	}
+
+	slots, wake := wakeupSlots, wakeup
+	select {
+	case slots <- true:
+		client.wakeupLock.Lock()
+		client.LastWakeup = time.Now()
+		client.wakeupLock.Unlock()
+		go func() {
+			defer func() { <-slots }()
+			wakeupFinished(client, wake(client, channelID), maxFailures)
+		}()
+	default:
+		logEvent(levelWarn, "wakeup_dropped", "uaid", client.UAID, "reason", "too many in progress")
+		wakeupsDropped.Inc()
+	}
+}
+
+// Clients whose wakeups keep failing, say because of a bad address,
+// are retried less and less often, and eventually given up on until
+// they reconnect and say hello again
+func wakeupFinished(client *Client, err error, maxFailures int) {
+	client.wakeupLock.Lock()
+	defer client.wakeupLock.Unlock()
+
+	if err == nil {
+		client.wakeupFailures = 0
+		client.wakeupRetryAt = time.Time{}
+		return
+	}
+
+	// a client that wasn't reached isn't reconnecting
+	client.LastWakeup = time.Time{}
+	client.wakeupFailures++
+	if client.wakeupFailures >= maxFailures {
+		logEvent(levelWarn, "wakeup_abandoned", "uaid", client.UAID, "failures", client.wakeupFailures)
+		wakeupsAbandoned.Inc()
+		return
+	}
+
+	backoff := configDuration(gServerConfig.WakeupRetryBackoff)
+	if backoff <= 0 {
+		backoff = 30 * time.Second
+	}
+	backoff <<= uint(client.wakeupFailures - 1)
+	if backoff > time.Hour || backoff <= 0 {
+		backoff = time.Hour
+	}
+	client.wakeupRetryAt = time.Now().Add(backoff)
+	logEvent(levelInfo, "wakeup_retry", "uaid", client.UAID, "failures", client.wakeupFailures,
+		"retryIn", backoff.Seconds())
+}
+
+func sendNotificationToClient(client *Client, channel *Channel) {
+
+	type NotificationResponse struct {
+		Name     string    `json:"messageType"`
+		Channels []Channel `json:"updates"`
+	}
+
+	var channels []Channel
+	channels = append(channels, *channel)
+
+	notification := NotificationResponse{"notification", channels}
+
+	gServerState.RLock()
+	platform, profile := client.platform, client.profile
+	gServerState.RUnlock()
+
+	j, err := marshalFor(profile, notification)
+	if err != nil {
+		log.Println("Could not convert hello response to json ", err)
+		return
+	}
+
+	sendToClient(client, string(j))
+	notificationsSent.Inc(platformLabel(platform))
+}
+
+// Close the websocket of uaid's client, if it has one, with status.
+// With forget, the client is also dropped from ConnectedClients, along
+// with its other transports, so it isn't delivered to or woken up until
+// it says hello again. Returns whether the client was known.
+func disconnectClient(uaid string, status int, forget bool) bool {
+	gServerState.Lock()
+	var ws *websocket.Conn
+	// it may have gone since whoever called us looked
+	client := gServerState.ConnectedClients[uaid]
+	if client != nil {
+		ws = client.Websocket
+		client.Websocket = nil
+	}
+	if forget {
+		delete(gServerState.ConnectedClients, uaid)
+		delete(gServerState.Transports, uaid)
+		if client != nil {
+			fireWebhook(gServerConfig.DisconnectWebhook, "disconnect", uaid)
+		}
+	}
+	gServerState.Unlock()
+
+	if ws != nil {
+		closeClientSocket(ws, status, writeTimeout())
+	}
+	return client != nil
+}
+
+// The connections a notification for uaid goes out on, as the
+// DeliveryPolicy has it. Called with the lock held.
+func deliveryTargets(uaid string) []*Client {
+	var targets []*Client
+	if client := gServerState.ConnectedClients[uaid]; client.online() {
+		targets = append(targets, client)
+	}
+	targets = append(targets, gServerState.Transports[uaid]...)
+
+	if len(targets) > 1 && gServerConfig.DeliveryPolicy != "all" {
+		targets = targets[:1]
+	}
+	return targets
+}
+
+func pongTimeout() time.Duration {
+	timeout := configDuration(gServerConfig.PongTimeout)
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return timeout
+}
+
+// Close the connections of clients that have gone quiet: those that
+// can be woken up over UDP, so they don't hold a connection for
+// nothing, and with pings on, those that stopped answering them.
+func reapConnections(now time.Time) {
+	pingInterval := configDuration(gServerConfig.PingInterval)
+	deadAfter := pingInterval + pongTimeout()
+	wakeupIdleTimeout := configDuration(gServerConfig.WakeupIdleTimeout)
+	if wakeupIdleTimeout <= 0 {
+		wakeupIdleTimeout = 15 * time.Second
+	}
+
+	// the sockets are taken while the lock is held, so that a client
+	// that reconnects meanwhile keeps its new connection
+	var idle, dead []*websocket.Conn
+	gServerState.Lock()
+	for uaid, client := range gServerState.ConnectedClients {
+		if client == nil || client.Websocket == nil {
+			continue
+		}
+		if pingInterval > 0 && now.Sub(client.lastPong) > deadAfter {
+			log.Println("No pong from ", uaid, ". closing connection")
+			dead = append(dead, client.Websocket)
+			client.Websocket = nil
+		} else if now.Sub(client.LastContact) > wakeupIdleTimeout && client.Ip != "" {
+			log.Println("Will wake up ", client.Ip, ". closing connection")
+			idle = append(idle, client.Websocket)
+			client.Websocket = nil
+		}
+	}
+	gServerState.Unlock()
 
-		default:
-			log.Println(" -> Unknown", f)
-			break
+	for _, ws := range dead {
+		closeClientSocket(ws, closeNormal, writeTimeout())
+	}
+	for _, ws := range idle {
+		closeClientSocket(ws, closeWakeup, writeTimeout())
+	}
+}
+
+func attemptDelivery(notification Notification) {
+	gServerState.RLock()
+	client, ok := gServerState.ConnectedClients[notification.UAID]
+	targets := deliveryTargets(notification.UAID)
+	gServerState.RUnlock()
+
+	channel := notification.Channel
+	if len(targets) > 0 {
+		logEvent(levelDebug, "deliver", "uaid", notification.UAID, "channelID", channel.ChannelID,
+			"version", channel.Version, "attempt", notification.Attempts, "transports", len(targets))
+		for _, target := range targets {
+			sendNotificationToClient(target, channel)
 		}
+	} else if !ok {
+		logEvent(levelDebug, "deliver_unreachable", "uaid", notification.UAID, "channelID", channel.ChannelID,
+			"version", channel.Version, "attempt", notification.Attempts)
+	} else {
+		requestWakeup(client, channel.ChannelID)
+	}
 
-		saveState()
+}
+
+func processAck(pending map[string]Notification, ack Ack) {
+	if ack.Status != 0 && ack.Status != 200 {
+		// the client got the notification but couldn't handle it,
+		// so leave it pending to be delivered again
+		logEvent(levelWarn, "ack_failed", "channelID", ack.ChannelID, "version", ack.Version,
+			"status", ack.Status, "error", ack.Error, "platform", ack.Platform)
+		ackFailures.Inc()
+		ackFailuresByPlatform.Inc(platformLabel(ack.Platform))
+		return
 	}
 
-	log.Println("Closing Websocket!")
-	ws.Close()
+	entry, ok := pending[ack.ChannelID]
+	if ok {
+		// if Version < ack.Version
+		//   the client acked a version it was never sent, which
+		//   is a bad client, but there's no point in delivering
+		//   it any more
+		// if Version > ack.Version
+		//   the client acknowledged an old notification, ignore
+		if entry.Channel.Version < ack.Version {
+			logEvent(levelWarn, "ack_violation", "uaid", entry.UAID, "channelID", ack.ChannelID,
+				"version", ack.Version, "pending", entry.Channel.Version)
+			ackProtocolViolations.Inc()
+		}
+		if entry.Channel.Version <= ack.Version {
+			logEvent(levelDebug, "delivered", "uaid", entry.UAID, "channelID", ack.ChannelID,
+				"version", entry.Channel.Version, "attempts", entry.Attempts)
+			delete(pending, entry.Channel.ChannelID)
+
+			platform := platformLabel(ack.Platform)
+			acksByPlatform.Inc(platform)
+			ackLatency.Add(platform, uint64(time.Since(entry.Queued)/time.Millisecond))
+		}
+	}
+}
 
-	// if a client disconnected before completing the handshake
-	// it'll have an empty UAID
-	if client.UAID != "" {
-		gServerState.ConnectedClients[client.UAID].Websocket = nil
+var notificationsDropped = newCounter("push_notifications_dropped_total",
+	"Notifications dropped because their UAID had too many awaiting an ack")
+
+// Add notification to pending, unless its UAID already has
+// MaxInFlightPerUAID other channels waiting for an ack. A new version
+// for a channel that is already pending always replaces the old one.
+// Returns whether the notification was added.
+func addPending(pending map[string]Notification, notification Notification) bool {
+	channelID := notification.Channel.ChannelID
+	limit := gServerConfig.MaxInFlightPerUAID
+	if _, ok := pending[channelID]; !ok && limit > 0 {
+		inFlight := 0
+		gServerState.RLock()
+		for otherID := range gServerState.UAIDToChannelIDs[notification.UAID] {
+			if _, ok := pending[otherID]; ok {
+				inFlight++
+			}
+		}
+		gServerState.RUnlock()
+		if inFlight >= limit {
+			logEvent(levelWarn, "notification_dropped", "uaid", notification.UAID, "channelID", channelID,
+				"reason", "too many in flight", "inFlight", inFlight)
+			notificationsDropped.Inc()
+			return false
+		}
 	}
+
+	notification.Queued = time.Now()
+	pending[channelID] = notification
+	return true
 }
 
-func notifyHandler(w http.ResponseWriter, r *http.Request) {
-	log.Println("Got notification from app server ", r.URL)
+// The pending notifications in the order they should be retried:
+// oldest first, or newest first if DeliveryOrder is "lifo"
+func orderedPending(pending map[string]Notification) []Notification {
+	ordered := make([]Notification, 0, len(pending))
+	for _, notification := range pending {
+		ordered = append(ordered, notification)
+	}
 
-	if r.Method != "PUT" {
-		log.Println("NOT A PUT")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Method must be PUT."))
-		return
+	lifo := gServerConfig.DeliveryOrder == "lifo"
+	sort.Slice(ordered, func(i, j int) bool {
+		a, b := ordered[i], ordered[j]
+		if !a.Queued.Equal(b.Queued) {
+			return a.Queued.Before(b.Queued) != lifo
+		}
+		return a.Channel.ChannelID < b.Channel.ChannelID
+	})
+	return ordered
+}
+
+// What /admin/pending shows of a pending notification
+type pendingInfo struct {
+	ChannelID string  `json:"channelID"`
+	UAID      string  `json:"uaid"`
+	Version   uint64  `json:"version"`
+	Age       float64 `json:"age"`
+	Attempts  int     `json:"attempts"`
+	// Left out while delivery is paused, and for strict channels,
+	// whose versions go out one after the other
+	NextAttempt *time.Time `json:"nextAttempt,omitempty"`
+	// For strict channels, "inFlight" or "waiting"
+	Strict string `json:"strict,omitempty"`
+}
+
+// The delivery loop answers with a dump of its pending notifications
+var pendingDumps chan chan []pendingInfo
+
+// Describe the pending notifications, in the order they're retried,
+// followed by the versions of strict channels. Unless its channel's
+// interval holds it back, each is sent again once its backoff is up,
+// or sooner if its client reconnects.
+func dumpPending(pending map[string]Notification, throttle *throttle, strict *strictQueue) []pendingInfo {
+	now := time.Now()
+	paused := deliveryPaused()
+	dump := make([]pendingInfo, 0, len(pending))
+	for _, notification := range orderedPending(pending) {
+		info := pendingInfo{
+			ChannelID: notification.Channel.ChannelID,
+			UAID:      notification.UAID,
+			Version:   notification.Channel.Version,
+			Age:       now.Sub(notification.Queued).Seconds(),
+			Attempts:  notification.Attempts,
+		}
+		if !paused {
+			next := notification.NextAttempt
+			if release, held := throttle.releaseAt(info.ChannelID); held {
+				next = release
+			}
+			info.NextAttempt = &next
+		}
+		dump = append(dump, info)
 	}
+	for _, notification := range strict.pending() {
+		info := pendingInfo{
+			ChannelID: notification.Channel.ChannelID,
+			UAID:      notification.UAID,
+			Version:   notification.Channel.Version,
+			Age:       now.Sub(notification.Queued).Seconds(),
+			Attempts:  notification.Attempts,
+			Strict:    "waiting",
+		}
+		if inFlight, ok := strict.inFlight[info.ChannelID]; ok && inFlight.Channel == notification.Channel {
+			info.Strict = "inFlight"
+		}
+		dump = append(dump, info)
+	}
+	return dump
+}
 
-	channelID := strings.Replace(r.URL.Path, gServerConfig.NotifyPrefix, "", 1)
+// While delivery is paused, notifications are still accepted and
+// stored, but wait in pending until it resumes
+var gDeliveryPaused int32
 
-	if strings.Contains(channelID, "/") {
-		log.Println("Could not find a valid channelID")
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Could not find a valid channelID."))
-		return
+// Tells the delivery loop that delivery resumed
+var deliveryResumed = make(chan bool, 1)
+
+func setDeliveryPaused(paused bool) {
+	var value int32
+	if paused {
+		value = 1
+	}
+	if atomic.SwapInt32(&gDeliveryPaused, value) == 1 && !paused {
+		select {
+		case deliveryResumed <- true:
+		default:
+		}
 	}
+}
 
-	channel, found := gServerState.ChannelIDToChannel[channelID]
-	if !found {
-		log.Println("Could not find channel " + channelID)
-		return
+func deliveryPaused() bool {
+	return atomic.LoadInt32(&gDeliveryPaused) == 1
+}
+
+// The minimum time between notifications for a channel, as asked for
+// when it was registered or else as configured
+func minNotifyInterval(channelID string) time.Duration {
+	gServerState.RLock()
+	interval, ok := gServerState.MinNotifyIntervals[channelID]
+	gServerState.RUnlock()
+	if ok {
+		return configDuration(interval)
 	}
+	return configDuration(gServerConfig.MinNotifyInterval)
+}
 
-	var version uint64
-	ret, err := fmt.Sscanf(r.FormValue("version"), "%d", &version)
-	if ret != 1 || err != nil {
-		log.Println("Could not parse version string: ", err)
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("Could parse version string"))
+// Spaces out the notifications sent for each channel. One that comes
+// too soon after the last is held back, and once the channel's interval
+// is up, its latest version is sent instead.
+type throttle struct {
+	lastSent map[string]time.Time
+	held     map[string]bool
+}
+
+func newThrottle() *throttle {
+	return &throttle{make(map[string]time.Time), make(map[string]bool)}
+}
+
+// Send the pending notification if its channel's interval allows, or
+// hold it
+func (t *throttle) attempt(pending map[string]Notification, notification Notification) {
+	channelID := notification.Channel.ChannelID
+	interval := minNotifyInterval(channelID)
+	if interval > 0 && time.Since(t.lastSent[channelID]) < interval {
+		t.held[channelID] = true
 		return
 	}
+	if interval > 0 {
+		delete(t.held, channelID)
+		t.lastSent[channelID] = time.Now()
+	}
 
-	if version < channel.Version {
-		// might be an old message, just ignore
-		return
+	attemptDelivery(notification)
+	notification.Attempts++
+	notification.NextAttempt = time.Now().Add(redeliveryBackoff(notification.Attempts))
+	pending[channelID] = notification
+}
+
+// When a held notification is due, if it's held
+func (t *throttle) releaseAt(channelID string) (time.Time, bool) {
+	if !t.held[channelID] {
+		return time.Time{}, false
 	}
+	return t.lastSent[channelID].Add(minNotifyInterval(channelID)), true
+}
 
-	channel.Version = version
+// When the first held notification is due, if any are held
+func (t *throttle) nextRelease() (time.Time, bool) {
+	var next time.Time
+	for channelID := range t.held {
+		if release, _ := t.releaseAt(channelID); next.IsZero() || release.Before(next) {
+			next = release
+		}
+	}
+	return next, !next.IsZero()
+}
 
-	saveState()
+// Send the held notifications that are due, and forget channels that
+// have been quiet for longer than their interval
+func (t *throttle) release(pending map[string]Notification) {
+	for channelID := range t.held {
+		if notification, ok := pending[channelID]; ok {
+			t.attempt(pending, notification)
+		} else {
+			delete(t.held, channelID)
+		}
+	}
+	for channelID, sent := range t.lastSent {
+		if !t.held[channelID] && time.Since(sent) > minNotifyInterval(channelID) {
+			delete(t.lastSent, channelID)
+		}
+	}
+}
 
-	notifyChan <- Notification{channel.UAID, channel}
+// Strict channels have at most one version in flight. Each version is
+// sent only once the one before it is acked, or its ack is more than
+// StrictAckTimeout late, so the client sees every version in order
+// instead of just the latest.
+type strictQueue struct {
+	// versions not sent yet, oldest first
+	waiting  map[string][]Notification
+	inFlight map[string]Notification
+	sentAt   map[string]time.Time
+}
 
-	w.WriteHeader(http.StatusOK)
-	w.Write([]byte("OK"))
+func newStrictQueue() *strictQueue {
+	return &strictQueue{
+		make(map[string][]Notification),
+		make(map[string]Notification),
+		make(map[string]time.Time),
+	}
 }
 
-func wakeupClient(client *Client) {
-	log.Println("wakeupClient: ", client)
-	service := fmt.Sprintf("%s:%g", client.Ip, client.Port)
+var strictVersionsDropped = newCounter("push_strict_versions_dropped_total",
+	"Versions of strict channels dropped because too many were waiting")
 
-	udpAddr, err := net.ResolveUDPAddr("udp4", service)
-	if err != nil {
-		log.Println("ResolveUDPAddr error ", err.Error())
-		return
+var strictAcksTimedOut = newCounter("push_strict_ack_timeouts_total",
+	"Versions of strict channels moved on from without an ack")
+
+func strictQueueLimit() int {
+	limit := gServerConfig.StrictQueueLimit
+	if limit <= 0 {
+		limit = 100
 	}
+	return limit
+}
 
-	conn, err := net.DialUDP("udp", nil, udpAddr)
-	if err != nil {
-		log.Println("DialUDP error ", err.Error())
-		return
+func (q *strictQueue) add(notification Notification) {
+	notification.Queued = time.Now()
+
+	channelID := notification.Channel.ChannelID
+	waiting := append(q.waiting[channelID], notification)
+	if excess := len(waiting) - strictQueueLimit(); excess > 0 {
+		logEvent(levelWarn, "strict_versions_dropped", "uaid", notification.UAID, "channelID", channelID,
+			"dropped", excess, "version", waiting[excess-1].Channel.Version)
+		strictVersionsDropped.Add(uint64(excess))
+		waiting = append([]Notification(nil), waiting[excess:]...)
 	}
+	q.waiting[channelID] = waiting
+	if !deliveryPaused() {
+		q.flush()
+	}
+}
 
-	_, err = conn.Write([]byte("push"))
-	if err != nil {
-		log.Println("UDP Write error ", err.Error())
-		return
+// Everything in flight or waiting, channel by channel, each channel's
+// versions in the order they're to be sent
+func (q *strictQueue) pending() []Notification {
+	channelIDs := make([]string, 0, len(q.waiting)+len(q.inFlight))
+	for channelID := range q.inFlight {
+		channelIDs = append(channelIDs, channelID)
+	}
+	for channelID := range q.waiting {
+		if _, ok := q.inFlight[channelID]; !ok {
+			channelIDs = append(channelIDs, channelID)
+		}
 	}
+	sort.Strings(channelIDs)
 
+	var notifications []Notification
+	for _, channelID := range channelIDs {
+		if inFlight, ok := q.inFlight[channelID]; ok {
+			notifications = append(notifications, inFlight)
+		}
+		notifications = append(notifications, q.waiting[channelID]...)
+	}
+	return notifications
 }
 
-func sendNotificationToClient(client *Client, channel *Channel) {
+func (q *strictQueue) ack(ack Ack) {
+	inFlight, ok := q.inFlight[ack.ChannelID]
+	if !ok || ack.Status != 0 && ack.Status != 200 || ack.Version < inFlight.Channel.Version {
+		return
+	}
+	delete(q.inFlight, ack.ChannelID)
+	delete(q.sentAt, ack.ChannelID)
+	if !deliveryPaused() {
+		q.flush()
+	}
+}
 
-	type NotificationResponse struct {
-		Name     string    `json:"messageType"`
-		Channels []Channel `json:"updates"`
+func (q *strictQueue) migrate(from, to string) {
+	for channelID, waiting := range q.waiting {
+		for i, notification := range waiting {
+			if notification.UAID == from {
+				waiting[i] = notification.movedTo(to)
+			}
+		}
+		q.waiting[channelID] = waiting
 	}
+	for channelID, inFlight := range q.inFlight {
+		if inFlight.UAID == from {
+			q.inFlight[channelID] = inFlight.movedTo(to)
+		}
+	}
+}
 
-	var channels []Channel
-	channels = append(channels, *channel)
+// Send the versions in flight for uaid again, now that it's reachable
+func (q *strictQueue) retry(uaid string) {
+	for channelID, inFlight := range q.inFlight {
+		if inFlight.UAID == uaid {
+			q.sentAt[channelID] = time.Now()
+			attemptDelivery(inFlight)
+		}
+	}
+}
 
-	notification := NotificationResponse{"notification", channels}
+// Send the next version of every channel that has nothing in flight,
+// giving up on acks that are overdue
+func (q *strictQueue) flush() {
+	timeout := configDuration(gServerConfig.StrictAckTimeout)
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
 
-	j, err := json.Marshal(notification)
-	if err != nil {
-		log.Println("Could not convert hello response to json %s", err)
-		return
+	for channelID, sent := range q.sentAt {
+		if time.Since(sent) > timeout {
+			inFlight := q.inFlight[channelID]
+			logEvent(levelWarn, "strict_ack_timeout", "uaid", inFlight.UAID, "channelID", channelID,
+				"version", inFlight.Channel.Version)
+			strictAcksTimedOut.Inc()
+			delete(q.inFlight, channelID)
+			delete(q.sentAt, channelID)
+		}
 	}
 
-	if err = websocket.Message.Send(client.Websocket, string(j)); err != nil {
-		log.Println("Could not send message to ", channel, err.Error())
+	for channelID, waiting := range q.waiting {
+		if _, busy := q.inFlight[channelID]; busy {
+			continue
+		}
+		next := waiting[0]
+		if len(waiting) == 1 {
+			delete(q.waiting, channelID)
+		} else {
+			q.waiting[channelID] = waiting[1:]
+		}
+		q.inFlight[channelID] = next
+		q.sentAt[channelID] = time.Now()
+		attemptDelivery(next)
 	}
 }
 
-func disconnectUDPClient(uaid string) {
-	if gServerState.ConnectedClients[uaid].Websocket == nil {
-		return
+func redeliverySweepInterval() time.Duration {
+	interval := configDuration(gServerConfig.RedeliverySweepInterval)
+	if interval <= 0 {
+		interval = time.Second
 	}
-	gServerState.ConnectedClients[uaid].Websocket.CloseWithStatus(4774)
-	gServerState.ConnectedClients[uaid].Websocket = nil
+	return interval
 }
 
-func attemptDelivery(notification Notification) {
-	log.Println("AttemptDelivery ", notification)
-	client, ok := gServerState.ConnectedClients[notification.UAID]
-	if !ok {
-		log.Println("no connected/wake-capable client for the channel.")
-	} else if client.Websocket == nil {
-		wakeupClient(client)
-	} else {
-		sendNotificationToClient(client, notification.Channel)
+// How long to wait before sending a notification again after its
+// attempts-th attempt
+func redeliveryBackoff(attempts int) time.Duration {
+	base := configDuration(gServerConfig.RedeliveryBackoff)
+	if base <= 0 {
+		base = 15 * time.Second
+	}
+	limit := configDuration(gServerConfig.RedeliveryBackoffCap)
+	if limit <= 0 {
+		limit = 10 * time.Minute
+	}
+
+	backoff := base
+	for i := 1; i < attempts && backoff < limit; i++ {
+		backoff *= 2
+	}
+	if backoff > limit {
+		backoff = limit
 	}
+	return backoff
+}
 
+var notificationsAbandoned = newCounter("push_notifications_abandoned_total",
+	"Notifications given up on after maxDeliveryAttempts without an ack")
+
+// Send again the pending notifications that are due, or all of them,
+// and give up on those that have had all their attempts
+func redeliver(pending map[string]Notification, throttle *throttle, all bool) {
+	now := time.Now()
+	maxAttempts := gServerConfig.MaxDeliveryAttempts
+	for _, notification := range orderedPending(pending) {
+		if !all && now.Before(notification.NextAttempt) {
+			continue
+		}
+		if maxAttempts > 0 && notification.Attempts >= maxAttempts {
+			logEvent(levelWarn, "notification_abandoned", "uaid", notification.UAID,
+				"channelID", notification.Channel.ChannelID, "version", notification.Channel.Version,
+				"attempts", notification.Attempts)
+			delete(pending, notification.Channel.ChannelID)
+			notificationsAbandoned.Inc()
+			continue
+		}
+		throttle.attempt(pending, notification)
+	}
 }
 
-func deliverNotifications(notifyChan chan Notification, ackChan chan Ack) {
+func deliverNotifications(notifyChan chan Notification, ackChan chan []Ack) {
 	// indexed by channelID so that new notifications
 	// automatically remove old ones
 	// if a new version comes in for a 'pending' channelID
 	// that's ok, because if the client gives an ack for an older
 	// version we just ignore it and try to deliver the new version
 	pending := make(map[string]Notification, 0)
-	lastAttempt := time.Now()
+	throttle := newThrottle()
+	strict := newStrictQueue()
+	sweep := time.NewTicker(redeliverySweepInterval())
+	defer sweep.Stop()
+	samples := time.NewTicker(time.Second)
+	defer samples.Stop()
 	for {
+		// wake up when the first held notification is due
+		var release <-chan time.Time
+		if next, held := throttle.nextRelease(); held && !deliveryPaused() {
+			release = time.After(time.Until(next))
+		}
+
 		select {
-		case newPending := <-notifyChan:
-			log.Println("Got new notification to deliver ", newPending)
-			pending[newPending.Channel.ChannelID] = newPending
-			attemptDelivery(newPending)
-
-		case newAck := <-ackChan:
-			log.Println("Got new ACK ", newAck)
-			entry, ok := pending[newAck.ChannelID]
-			if ok {
-				// if Version < newAck.Version
-				//   the client acknowledged a future notification, bad client
-				// if Version > newAck.Version
-				//   the client acknowledged an old notification, ignore
-				if entry.Channel.Version == newAck.Version {
-					log.Println("Deleting from pending")
-					delete(pending, entry.Channel.ChannelID)
+		case newPending, ok := <-notifyChan:
+			if !ok {
+				return
+			}
+			logEvent(levelDebug, "queued", "uaid", newPending.UAID, "channelID", newPending.Channel.ChannelID,
+				"version", newPending.Channel.Version)
+			gServerState.RLock()
+			isStrict := gServerState.StrictChannels[newPending.Channel.ChannelID]
+			// queued before its UAID migrated
+			if channel, ok := gServerState.ChannelIDToChannel[newPending.Channel.ChannelID]; ok && channel.UAID != newPending.UAID {
+				newPending = newPending.movedTo(channel.UAID)
+			}
+			gServerState.RUnlock()
+			if isStrict {
+				strict.add(newPending)
+			} else if addPending(pending, newPending) && !deliveryPaused() {
+				throttle.attempt(pending, pending[newPending.Channel.ChannelID])
+			}
+
+		case uaid := <-redeliverChan:
+			if deliveryPaused() {
+				break
+			}
+			for _, notification := range orderedPending(pending) {
+				if notification.UAID == uaid {
+					throttle.attempt(pending, notification)
 				}
 			}
+			strict.retry(uaid)
 
-		case <-time.After(10 * time.Millisecond):
-			if time.Since(lastAttempt).Seconds() > 15 {
-				lastAttempt = time.Now()
-				log.Println("Attempting to deliver ", len(pending), " pending notifications")
-				for _, notification := range pending {
-					attemptDelivery(notification)
+		case migration := <-uaidMigrations:
+			for channelID, notification := range pending {
+				if notification.UAID == migration.from {
+					pending[channelID] = notification.movedTo(migration.to)
 				}
 			}
+			strict.migrate(migration.from, migration.to)
+			requestRedelivery(migration.to)
+
+		case reply := <-pendingSnapshots:
+			reply <- append(orderedPending(pending), strict.pending()...)
+
+		case reply := <-pendingDumps:
+			reply <- dumpPending(pending, throttle, strict)
+
+		case acks := <-ackChan:
+			for _, newAck := range acks {
+				processAck(pending, newAck)
+				strict.ack(newAck)
+			}
+
+		case <-deliveryResumed:
+			// retry everything as soon as delivery resumes
+			if !deliveryPaused() {
+				redeliver(pending, throttle, true)
+				strict.flush()
+			}
+
+		case <-sweep.C:
+			if !deliveryPaused() {
+				logEvent(levelDebug, "redeliver", "pending", len(pending))
+				redeliver(pending, throttle, false)
+				strict.flush()
+			}
+			// forgets the channels that have gone quiet
+			throttle.release(pending)
+
+		case <-release:
+			throttle.release(pending)
+
+		case now := <-samples.C:
+			samplePendingAges(pending, now)
 		}
 	}
 }
 
-func admin(w http.ResponseWriter, r *http.Request) {
+// What the admin page shows, and /admin/api returns as JSON
+type adminUser struct {
+	UAID      string     `json:"uaid"`
+	Connected bool       `json:"connected"`
+	Topics    []string   `json:"topics"`
+	Channels  []*Channel `json:"channels"`
+	// Where the client connected from, and where it asked to be
+	// woken up, as "ip:port"
+	RemoteAddr string `json:"remoteAddr,omitempty"`
+	WakeupAddr string `json:"wakeupAddr,omitempty"`
+}
+
+type adminOverview struct {
+	PushEndpointPrefix string      `json:"pushEndpointPrefix"`
+	TotalMemory        uint64      `json:"totalMemory"`
+	Users              []adminUser `json:"users"`
+}
 
+func snapshotAdminOverview() adminOverview {
 	memstats := new(runtime.MemStats)
 	runtime.ReadMemStats(memstats)
 
-	totalMemory := memstats.Alloc
-	type User struct {
-		UAID      string
-		Connected bool
-		Channels  []*Channel
+	overview := adminOverview{makeNotifyURL("", ""), memstats.Alloc, []adminUser{}}
+
+	// copy the channels, so that notifies can go on while we render
+	gServerState.RLock()
+	topics := make(map[string][]string)
+	for topic, uaids := range gServerState.TopicToUAIDs {
+		for uaid := range uaids {
+			topics[uaid] = append(topics[uaid], topic)
+		}
 	}
+	for uaid, channelIDSet := range gServerState.UAIDToChannelIDs {
+		client := gServerState.ConnectedClients[uaid]
+		connected := client.online()
+		channels := []*Channel{}
+		for _, channel := range channelIDSet {
+			snapshot := *channel
+			channels = append(channels, &snapshot)
+		}
+		sort.Slice(channels, func(i, j int) bool { return channels[i].ChannelID < channels[j].ChannelID })
 
-	type Arguments struct {
-		PushEndpointPrefix string
-		TotalMemory        uint64
-		Users              []User
+		u := adminUser{UAID: uaid, Connected: connected, Topics: append([]string{}, topics[uaid]...), Channels: channels}
+		if client != nil {
+			u.RemoteAddr = client.RemoteAddr
+			if client.Ip != "" {
+				u.WakeupAddr = net.JoinHostPort(client.Ip, fmt.Sprint(client.Port))
+			}
+		}
+		sort.Strings(u.Topics)
+		overview.Users = append(overview.Users, u)
 	}
+	gServerState.RUnlock()
 
-	arguments := Arguments{makeNotifyURL(""), totalMemory, nil}
+	sort.Slice(overview.Users, func(i, j int) bool { return overview.Users[i].UAID < overview.Users[j].UAID })
+	return overview
+}
 
-	for uaid, channelIDSet := range gServerState.UAIDToChannelIDs {
-		connected := gServerState.ConnectedClients[uaid].Websocket != nil
-		var channels []*Channel
-		for _, channel := range channelIDSet {
-			channels = append(channels, channel)
+func admin(w http.ResponseWriter, r *http.Request) {
+	if !adminAuthorized(w, r) {
+		return
+	}
+	if strings.Contains(r.Header.Get("Accept"), "application/json") {
+		adminAPI(w, r)
+		return
+	}
+
+	arguments := snapshotAdminOverview()
+	if err := gAdminTemplate.Execute(w, arguments); err != nil {
+		log.Println("Could not render admin template: ", err)
+	}
+}
+
+// The admin page's template, loaded once at startup
+var gAdminTemplate *template.Template
+
+func loadAdminTemplate() {
+	t, err := loadTemplate("users.template")
+	if err != nil {
+		log.Println("Could not load admin template: ", err)
+		os.Exit(-1)
+	}
+	gAdminTemplate = t
+}
+
+func loadTemplate(name string) (*template.Template, error) {
+	dir := gServerConfig.TemplatesDir
+	if dir == "" {
+		dir = "templates"
+	}
+
+	path := filepath.Join(dir, name)
+	if _, err := os.Stat(path); err == nil {
+		return template.ParseFiles(path)
+	}
+
+	log.Println("No template at", path, "using the built-in one")
+	return template.ParseFS(defaultTemplates, "templates/"+name)
+}
+
+type gzipResponseWriter struct {
+	http.ResponseWriter
+	gz *gzip.Writer
+}
+
+func (w gzipResponseWriter) Write(b []byte) (int, error) {
+	// sniff the type before compression makes everything look like gzip
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", http.DetectContentType(b))
+	}
+	return w.gz.Write(b)
+}
+
+func acceptsGzip(r *http.Request) bool {
+	for _, encoding := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		params := strings.Split(encoding, ";")
+		if strings.TrimSpace(params[0]) != "gzip" {
+			continue
+		}
+		for _, param := range params[1:] {
+			if strings.Replace(param, " ", "", -1) == "q=0" {
+				return false
+			}
 		}
-		u := User{uaid, connected, channels}
-		arguments.Users = append(arguments.Users, u)
+		return true
 	}
+	return false
+}
+
+// Wrap a handler so that its response is gzipped for clients that accept it
+func compressed(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if gServerConfig.DisableCompression || !acceptsGzip(r) {
+			handler(w, r)
+			return
+		}
 
-	t := template.New("users.template")
-	s1, _ := t.ParseFiles("templates/users.template")
-	s1.Execute(w, arguments)
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Header().Add("Vary", "Accept-Encoding")
+		gz := gzip.NewWriter(w)
+		defer gz.Close()
+		handler(gzipResponseWriter{w, gz}, r)
+	}
 }
 
 func main() {
 
+	registerConfigFlags(flag.CommandLine)
+	flag.Parse()
 	readConfig()
+	setupLogging()
+	loadAdminTemplate()
+
+	notifyChan = newNotifyChan()
+	ackChan = make(chan []Ack)
+	redeliverChan = make(chan string, 100)
+	uaidMigrations = make(chan uaidMigration, 16)
+	pendingSnapshots = make(chan chan []Notification)
+	pendingDumps = make(chan chan []pendingInfo)
+
+	http.HandleFunc("/readyz", readyz)
+	http.HandleFunc("/health", healthHandler)
+	http.Handle("/admin", whenReady(compressed(admin)))
+	http.Handle("/admin/flush", whenReady(http.HandlerFunc(adminFlush)))
+	http.HandleFunc("/admin/pause", adminPause)
+	http.HandleFunc("/admin/resume", adminResume)
+	http.Handle("/admin/broadcast/", whenReady(http.HandlerFunc(adminBroadcast)))
+	http.Handle("/admin/api", whenReady(compressed(adminAPI)))
+	http.Handle("/admin/evict", whenReady(http.HandlerFunc(adminEvict)))
+	http.Handle("/admin/channel/", whenReady(compressed(adminChannel)))
+	http.Handle("/admin/selftest", whenReady(http.HandlerFunc(adminSelftest)))
+	http.HandleFunc("/admin/peers", adminPeers)
+	http.Handle("/admin/pending", whenReady(compressed(adminPending)))
+	http.Handle("/admin/orphans", whenReady(http.HandlerFunc(adminOrphans)))
+	http.Handle("/admin/orphans/purge", whenReady(http.HandlerFunc(adminPurgeOrphans)))
+	http.HandleFunc("/metrics", compressed(metricsHandler))
+
+	http.Handle("/", whenReady(websocket.Handler(pushHandler)))
+
+	http.Handle(gServerConfig.NotifyPrefix, whenReady(http.HandlerFunc(notifyHandler)))
+	http.Handle("/uaid/", whenReady(http.HandlerFunc(uaidHandler)))
+	http.Handle("/poll/", whenReady(http.HandlerFunc(pollHandler)))
+	http.Handle("/events/", whenReady(http.HandlerFunc(eventsHandler)))
+
+	startOutbound()
+	startWebhooks()
+
+	startAudit()
+
+	startWakeups()
+	startStorage()
+	startSaves()
+	startStateWriter()
+
+	setPeers(gServerConfig.Peers)
+
+	// Loading a big state can take a while, so do it while the
+	// server answers /readyz
+	go func() {
+		openState()
+
+		running := make(chan bool)
+		go func() {
+			running <- true
+			deliverNotifications(notifyChan, ackChan)
+		}()
+		<-running
+		loadPendingNotifications()
+
+		go func() {
+			// often enough to close dead connections in time
+			interval := 10 * time.Second
+			if pongTimeout := pongTimeout(); gServerConfig.PingInterval > 0 && pongTimeout < interval {
+				interval = pongTimeout
+			}
+			for now := range time.Tick(interval) {
+				reapConnections(now)
+			}
+		}()
 
-	openState()
+		setReady()
+		startExpiry()
+	}()
 
-	notifyChan = make(chan Notification)
-	ackChan = make(chan Ack)
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		log.Println("Got ", <-signals, ", exiting")
+		gracefulShutdown()
+	}()
 
-	http.HandleFunc("/admin", admin)
+	err := listenAndServe()
+	if err == http.ErrServerClosed {
+		// gracefulShutdown exits once it's done
+		select {}
+	}
+	log.Println("Exiting... ", err)
+	shutdown(-1)
+}
 
-	http.Handle("/", websocket.Handler(pushHandler))
+// Set once the state is loaded and notifications are being delivered.
+// Until then, handlers that need those answer 503.
+var gReady int32
 
-	http.HandleFunc(gServerConfig.NotifyPrefix, notifyHandler)
+func setReady() {
+	atomic.StoreInt32(&gReady, 1)
+	log.Println("Ready")
+}
 
-	go deliverNotifications(notifyChan, ackChan)
+func isReady() bool {
+	return atomic.LoadInt32(&gReady) == 1
+}
 
-	go func() {
-		c := time.Tick(10 * time.Second)
-		for now := range c {
-			for uaid, client := range gServerState.ConnectedClients {
-				if now.Sub(client.LastContact).Seconds() > 15 && client.Ip != "" {
-					log.Println("Will wake up ", client.Ip, ". closing connection")
-					disconnectUDPClient(uaid)
-				}
-			}
+func whenReady(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !isReady() {
+			w.Header().Set("Retry-After", "1")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("Server is starting."))
+			return
 		}
-	}()
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func readyz(w http.ResponseWriter, r *http.Request) {
+	if !isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("starting"))
+		return
+	}
+	w.Write([]byte("ready"))
+}
 
-	log.Println("Listening on", gServerConfig.Hostname+":"+gServerConfig.Port)
+var gStartTime = time.Now()
 
-	var err error
+type health struct {
+	Uptime           float64 `json:"uptime"`
+	Ready            bool    `json:"ready"`
+	ConnectedClients int     `json:"connectedClients"`
+	Storage          string  `json:"storage"`
+}
+
+// For load balancers: 200 while the state can be saved, 503 when the
+// storage can't be reached
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	gServerState.RLock()
+	status := health{
+		Uptime:           time.Since(gStartTime).Seconds(),
+		Ready:            isReady(),
+		ConnectedClients: len(gServerState.ConnectedClients),
+		Storage:          "ok",
+	}
+	gServerState.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	if err := gStorage.Check(); err != nil {
+		status.Storage = err.Error()
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
+
+var errInsecure = errors.New("refusing to serve without TLS; set useTLS, or allowInsecure to run anyway")
+
+func listenAndServe() error {
+	if !gServerConfig.UseTLS && !gServerConfig.AllowInsecure {
+		return errInsecure
+	}
+
+	var tlsConfig *tls.Config
 	if gServerConfig.UseTLS {
-		err = http.ListenAndServeTLS(gServerConfig.Hostname+":"+gServerConfig.Port,
-			gServerConfig.CertFilename,
-			gServerConfig.KeyFilename,
-			nil)
-	} else {
-		for i := 0; i < 5; i++ {
-			log.Println("This is a really unsafe way to run the push server.  Really.  Don't do this in production.")
+		var err error
+		if tlsConfig, err = loadCertificates(); err != nil {
+			return err
 		}
-		err = http.ListenAndServe(gServerConfig.Hostname+":"+gServerConfig.Port, nil)
 	}
 
-	log.Println("Exiting... ", err)
+	listener, err := listen()
+	if err != nil {
+		return err
+	}
+	log.Println("Listening on", listener.Addr())
+
+	if gServerConfig.UseTLS {
+		gHTTPServer.TLSConfig = tlsConfig
+		return gHTTPServer.ServeTLS(listener, "", "")
+	}
+	log.Println("Warning: serving without TLS because allowInsecure is set. Don't do this in production.")
+	return gHTTPServer.Serve(listener)
+}
+
+// Open the listener ListenNetwork and ListenAddress ask for
+func listen() (net.Listener, error) {
+	address := gServerConfig.ListenAddress
+	switch gServerConfig.ListenNetwork {
+	case "", "tcp":
+		if address == "" {
+			address = gServerConfig.Hostname + ":" + gServerConfig.Port
+		}
+		return net.Listen("tcp", address)
+	case "unix":
+		if address == "" {
+			return nil, errors.New("listening on a unix socket needs a listenAddress")
+		}
+		if err := removeStaleSocket(address); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", address)
+	}
+	return nil, fmt.Errorf("unknown listenNetwork %q", gServerConfig.ListenNetwork)
+}
+
+// Remove the socket file at path if a server that didn't shut down
+// cleanly left it behind. Anything else there is left alone.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		return fmt.Errorf("%s is in use by another server", path)
+	}
+	log.Println("Removing stale socket ", path)
+	return os.Remove(path)
 }
@@ -0,0 +1,2427 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go.net/websocket"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"text/template"
+	"time"
+)
+
+// Give each test an empty server state and config, and run it
+// somewhere saveState can't clobber anything
+func setupTest(t testing.TB) {
+	t.Chdir(t.TempDir())
+
+	gServerConfig = ServerConfig{NotifyPrefix: "/notify/"}
+	gServerState.UAIDToChannelIDs = make(map[string]ChannelIDSet)
+	gServerState.ChannelIDToChannel = make(ChannelIDSet)
+	gServerState.TopicToUAIDs = make(map[string]map[string]bool)
+	gServerState.MinNotifyIntervals = make(map[string]float64)
+	gServerState.StrictChannels = make(map[string]bool)
+	gServerState.History = make(map[string][]HistoryEntry)
+	gServerState.ConnectedClients = make(map[string]*Client)
+	gServerState.Transports = make(map[string][]*Client)
+	gStorage = &FileStorage{Filename: "serverstate.json"}
+	gPendingAgeAlarm = pendingAgeAlarm{}
+	gWakeupPayload = nil
+	// left over by earlier tests' clients, they would set off
+	// redeliveries in this test's delivery loop
+	redeliverChan = nil
+	uaidMigrations = nil
+	atomic.StoreInt32(&gDeliveryPaused, 0)
+	deliveryResumed = make(chan bool, 1)
+	gAdminTemplate = template.Must(template.ParseFS(defaultTemplates, "templates/users.template"))
+	gLogSamples.Lock()
+	gLogSamples.counts = nil
+	gLogSamples.Unlock()
+	startSaves()
+}
+
+// Run a delivery loop until the test is over
+func startTestDelivery(t testing.TB, notifications chan Notification, acks chan []Ack) {
+	done := make(chan bool)
+	go func() {
+		deliverNotifications(notifications, acks)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		close(notifications)
+		<-done
+	})
+}
+
+// Put a channel straight into the server state
+func addTestChannel(uaid, channelID string, version uint64) *Channel {
+	channel := &Channel{UAID: uaid, ChannelID: channelID, Version: version}
+	if gServerState.UAIDToChannelIDs[uaid] == nil {
+		gServerState.UAIDToChannelIDs[uaid] = make(ChannelIDSet)
+	}
+	gServerState.UAIDToChannelIDs[uaid][channelID] = channel
+	gServerState.ChannelIDToChannel[channelID] = channel
+	return channel
+}
+
+func TestAdminUsesBuiltinTemplate(t *testing.T) {
+	setupTest(t)
+	gServerConfig.TemplatesDir = "no-such-dir"
+	gServerConfig.AdminToken = "secret"
+	loadAdminTemplate()
+
+	w := httptest.NewRecorder()
+	admin(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("admin page without a token got status %d, want 401", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	admin(w, adminRequest("GET", "/admin", "secret"))
+	if w.Code != http.StatusOK {
+		t.Fatalf("admin returned status %d", w.Code)
+	}
+	if !strings.Contains(w.Body.String(), "<h1>Users</h1>") {
+		t.Fatalf("admin did not render the built-in template: %s", w.Body.String())
+	}
+}
+
+func TestAdminShowsOfflineUAIDs(t *testing.T) {
+	setupTest(t)
+	addTestChannel("offline", "chan", 3)
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	// registered in an earlier run, and not back since
+	openState()
+	gServerConfig.AdminToken = "secret"
+
+	w := httptest.NewRecorder()
+	admin(w, adminRequest("GET", "/admin", "secret"))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "offline (Connected: false)") {
+		t.Fatalf("admin returned %d %s", w.Code, w.Body.String())
+	}
+}
+
+// How many pushHandlers the test servers are running. Those of earlier
+// tests are all done by the time the next one starts.
+var testHandlersRunning int32
+
+// Serve websockets with pushHandler until the test is over, and then
+// wait for every connection's handler to finish
+func startTestServer(t *testing.T) *httptest.Server {
+	var handlers sync.WaitGroup
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		handlers.Add(1)
+		atomic.AddInt32(&testHandlersRunning, 1)
+		defer handlers.Done()
+		defer atomic.AddInt32(&testHandlersRunning, -1)
+		pushHandler(ws)
+	}))
+	t.Cleanup(func() {
+		server.Close()
+		handlers.Wait()
+	})
+	return server
+}
+
+func dialTestServer(t *testing.T, server *httptest.Server) *websocket.Conn {
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		t.Fatalf("Dial error %s", err)
+	}
+	return ws
+}
+
+func TestConcurrentSendsAreSerialized(t *testing.T) {
+	const senders, messages = 8, 50
+
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		client := newClient(ws)
+		go clientWriter(client, ws)
+
+		var wg sync.WaitGroup
+		for i := 0; i < senders; i++ {
+			wg.Add(1)
+			go func(sender int) {
+				defer wg.Done()
+				for seq := 0; seq < messages; seq++ {
+					sendToClient(client, fmt.Sprintf(`{"sender":%d,"seq":%d}`, sender, seq))
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		// keep the connection open until the peer has read everything
+		var ignored string
+		websocket.Message.Receive(ws, &ignored)
+		close(client.done)
+	}))
+	defer server.Close()
+
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	next := make(map[int]int)
+	for i := 0; i < senders*messages; i++ {
+		var msg struct {
+			Sender int `json:"sender"`
+			Seq    int `json:"seq"`
+		}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			t.Fatalf("message %d was corrupted: %s", i, err)
+		}
+		if msg.Seq != next[msg.Sender] {
+			t.Fatalf("sender %d: got seq %d, want %d", msg.Sender, msg.Seq, next[msg.Sender])
+		}
+		next[msg.Sender]++
+	}
+	websocket.Message.Send(ws, "done")
+}
+
+// Count the heartbeats a client reads in the given time while the
+// server optionally keeps it busy with notifications
+func countHeartbeats(t *testing.T, busy bool, duration time.Duration) int {
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		client := newClient(ws)
+		go clientWriter(client, ws)
+		if busy {
+			go func() {
+				for {
+					select {
+					case <-time.After(10 * time.Millisecond):
+						sendToClient(client, `{"messageType":"notification"}`)
+					case <-client.done:
+						return
+					}
+				}
+			}()
+		}
+
+		var ignored string
+		websocket.Message.Receive(ws, &ignored)
+		close(client.done)
+	}))
+	defer server.Close()
+
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	heartbeats := 0
+	deadline := time.Now().Add(duration)
+	ws.SetReadDeadline(deadline)
+	for time.Now().Before(deadline) {
+		var msg map[string]interface{}
+		if err := websocket.JSON.Receive(ws, &msg); err != nil {
+			break
+		}
+		if msg["messageType"] == "heartbeat" {
+			heartbeats++
+		}
+	}
+	return heartbeats
+}
+
+func TestHeartbeats(t *testing.T) {
+	setupTest(t)
+	gServerConfig.HeartbeatInterval = 0.05
+
+	if n := countHeartbeats(t, false, 300*time.Millisecond); n < 2 {
+		t.Fatalf("idle client got %d heartbeats, want at least 2", n)
+	}
+	if n := countHeartbeats(t, true, 300*time.Millisecond); n != 0 {
+		t.Fatalf("busy client got %d heartbeats, want none", n)
+	}
+}
+
+// Issue a notify and return the notification it queued, if any
+func notify(t *testing.T, channelID, body string) (*httptest.ResponseRecorder, *Notification) {
+	notifyChan = make(chan Notification, 1)
+
+	r := httptest.NewRequest("PUT", "/notify/"+channelID, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	notifyHandler(w, r)
+
+	select {
+	case n := <-notifyChan:
+		return w, &n
+	default:
+		return w, nil
+	}
+}
+
+func TestNotifyVersionFromBody(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 3)
+
+	w, n := notify(t, "chan", "version=42")
+	if w.Code != http.StatusOK || n == nil {
+		t.Fatalf("notify failed with status %d", w.Code)
+	}
+	if channel.Version != 42 {
+		t.Fatalf("channel version is %d, want 42", channel.Version)
+	}
+
+	notify(t, "chan", "")
+	if channel.Version != 43 {
+		t.Fatalf("notify without a version left version at %d, want 43", channel.Version)
+	}
+
+	if w, _ := notify(t, "chan", "version=bogus"); w.Code != http.StatusBadRequest {
+		t.Fatalf("bad version got status %d, want 400", w.Code)
+	}
+}
+
+func TestNotifyToken(t *testing.T) {
+	setupTest(t)
+	gServerConfig.NotifyToken = "secret"
+	channel := addTestChannel("uaid", "chan", 1)
+	notifyChan = make(chan Notification, 2)
+
+	for _, path := range []string{"/notify/chan", "/uaid/uaid/notify"} {
+		handler := notifyHandler
+		if strings.HasPrefix(path, "/uaid/") {
+			handler = uaidHandler
+		}
+		for _, token := range []string{"", "wrong"} {
+			w := httptest.NewRecorder()
+			handler(w, adminRequest("PUT", path, token))
+			if w.Code != http.StatusUnauthorized {
+				t.Fatalf("%s with token %q got status %d, want 401", path, token, w.Code)
+			}
+		}
+		w := httptest.NewRecorder()
+		handler(w, adminRequest("PUT", path, "secret"))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s with the token got status %d", path, w.Code)
+		}
+	}
+	if channel.Version != 3 {
+		t.Fatalf("channel is at version %d, want only the authorized notifies counted", channel.Version)
+	}
+}
+
+func TestNotifyCarriesData(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxDataSize = 16
+	channel := addTestChannel("uaid", "chan", 1)
+
+	w, n := notify(t, "chan", "version=2&data=hello+there")
+	if w.Code != http.StatusOK || n == nil || n.Channel.Data != "hello there" {
+		t.Fatalf("notify with data got status %d and queued %+v", w.Code, n)
+	}
+
+	client := newClient(&websocket.Conn{})
+	sendNotificationToClient(client, n.Channel)
+	if msg := <-client.outgoing; !strings.Contains(msg, `"data":"hello there"`) {
+		t.Fatalf("notification %s is missing the data", msg)
+	}
+
+	// a reconnecting client gets the last payload from the saved state
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	var loaded ServerState
+	if err := gStorage.Load(&loaded); err != nil {
+		t.Fatal(err)
+	}
+	if saved := loaded.ChannelIDToChannel["chan"]; saved == nil || saved.Data != "hello there" {
+		t.Fatalf("saved channel is %+v, want its data kept", saved)
+	}
+
+	if w, _ := notify(t, "chan", "data="+strings.Repeat("x", 17)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized data got status %d, want 413", w.Code)
+	}
+	if channel.Version != 2 {
+		t.Fatalf("oversized notify bumped the version to %d", channel.Version)
+	}
+	// the limit holds for dry runs too, which read the body first
+	if w, _ := notify(t, "chan", "dryRun=true&data="+strings.Repeat("x", 1<<20)); w.Code != http.StatusRequestEntityTooLarge {
+		t.Fatalf("oversized dry run got status %d, want 413", w.Code)
+	}
+
+	if _, n := notify(t, "chan", ""); n == nil || n.Channel.Data != "" {
+		t.Fatalf("notify without data kept the old payload: %+v", n)
+	}
+}
+
+func TestNotifyVersionDelta(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 3)
+
+	w, n := notify(t, "chan", "delta=5")
+	if w.Code != http.StatusOK || n == nil || n.Channel.Version != 8 || channel.Version != 8 {
+		t.Fatalf("delta of 5 from 3 got status %d and version %d", w.Code, channel.Version)
+	}
+
+	for _, body := range []string{"delta=0", "delta=-1", "delta=bogus", "version=9&delta=1"} {
+		if w, _ := notify(t, "chan", body); w.Code != http.StatusBadRequest {
+			t.Fatalf("notify with %s got status %d, want 400", body, w.Code)
+		}
+	}
+
+	channel.Version = math.MaxUint64 - 2
+	if w, n := notify(t, "chan", "delta=3"); w.Code != http.StatusBadRequest || n != nil {
+		t.Fatalf("overflowing delta got status %d", w.Code)
+	}
+	if channel.Version != math.MaxUint64-2 {
+		t.Fatalf("overflowing delta changed the version to %d", channel.Version)
+	}
+	if w, _ := notify(t, "chan", "delta=2"); w.Code != http.StatusOK || channel.Version != math.MaxUint64 {
+		t.Fatalf("delta up to the largest version got status %d and version %d", w.Code, channel.Version)
+	}
+}
+
+// Check that UAIDToChannelIDs and ChannelIDToChannel describe the same channels
+func checkIndices(t *testing.T) {
+	owned := 0
+	for uaid, channels := range gServerState.UAIDToChannelIDs {
+		for channelID, channel := range channels {
+			owned++
+			if gServerState.ChannelIDToChannel[channelID] != channel {
+				t.Fatalf("channel %s of %s is missing from ChannelIDToChannel", channelID, uaid)
+			}
+			if channel.UAID != uaid {
+				t.Fatalf("channel %s is listed under %s but owned by %s", channelID, uaid, channel.UAID)
+			}
+		}
+	}
+	if owned != len(gServerState.ChannelIDToChannel) {
+		t.Fatalf("%d channels have owners but %d exist", owned, len(gServerState.ChannelIDToChannel))
+	}
+}
+
+func TestIndicesStayConsistent(t *testing.T) {
+	setupTest(t)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	other := newClient(nil)
+	other.UAID = "other"
+
+	handleRegister(client, map[string]interface{}{"channelID": "a"})
+	handleRegister(client, map[string]interface{}{"channelID": "b"})
+	handleRegister(other, map[string]interface{}{"channelID": "c"})
+	// conflicts with the channel owned by uaid
+	handleRegister(other, map[string]interface{}{"channelID": "a"})
+	checkIndices(t)
+	if gServerState.ChannelIDToChannel["a"].UAID != "uaid" {
+		t.Fatalf("conflicting register stole channel a")
+	}
+
+	// not owned by other, so this is a no-op
+	handleUnregister(other, map[string]interface{}{"channelID": "b"})
+	handleUnregister(client, map[string]interface{}{"channelID": "a"})
+	checkIndices(t)
+	if len(gServerState.ChannelIDToChannel) != 2 {
+		t.Fatalf("got %d channels after unregister, want 2", len(gServerState.ChannelIDToChannel))
+	}
+
+	// claiming a channel we don't know about resets the UAID
+	reconnected := newClient(nil)
+	handleHello(reconnected, map[string]interface{}{
+		"uaid":       "uaid",
+		"channelIDs": []interface{}{"b", "unknown"},
+	})
+	checkIndices(t)
+	if _, ok := gServerState.ChannelIDToChannel["b"]; ok {
+		t.Fatalf("channel b survived the reset of its UAID")
+	}
+}
+
+func TestResetLeavesNoOrphans(t *testing.T) {
+	setupTest(t)
+	gServerConfig.HistorySize = 2
+	client := newClient(nil)
+	handleHello(client, map[string]interface{}{"uaid": "uaid"})
+	<-client.outgoing
+	handleRegister(client, map[string]interface{}{"channelID": "chan", "minInterval": 5.0, "strict": true})
+	<-client.outgoing
+	gServerState.subscribe("uaid", "news")
+	gServerState.recordHistory([]*Channel{gServerState.ChannelIDToChannel["chan"]}, time.Now())
+	delete(gServerState.ConnectedClients, "uaid")
+
+	reconnected := newClient(nil)
+	handleHello(reconnected, map[string]interface{}{"uaid": "uaid", "channelIDs": []interface{}{"chan", "unknown"}})
+	<-reconnected.outgoing
+	if reconnected.UAID == "uaid" {
+		t.Fatalf("hello claiming an unknown channel kept its UAID")
+	}
+
+	report := gServerState.findOrphans()
+	if len(report.UnownedChannels)+len(report.MissingChannels)+len(report.StraySettings)+
+		len(report.EmptyTopics) != 0 || len(gServerState.ChannelIDToChannel) != 0 {
+		t.Fatalf("reset left behind %+v", report)
+	}
+
+	// the new UAID can take the channel back
+	handleRegister(reconnected, map[string]interface{}{"channelID": "chan"})
+	if register := receiveFields(t, reconnected); string(register["status"]) != "200" {
+		t.Fatalf("registering the reset channel again got status %s", register["status"])
+	}
+}
+
+func TestAdminIsCompressed(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+
+	r := adminRequest("GET", "/admin", "secret")
+	r.Header.Set("Accept-Encoding", "deflate, gzip")
+	w := httptest.NewRecorder()
+	compressed(admin)(w, r)
+
+	if w.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("got Content-Encoding %q, want gzip", w.Header().Get("Content-Encoding"))
+	}
+	if !strings.HasPrefix(w.Header().Get("Content-Type"), "text/html") {
+		t.Fatalf("got Content-Type %q, want text/html", w.Header().Get("Content-Type"))
+	}
+	gz, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("response is not gzipped: %s", err)
+	}
+	body, err := ioutil.ReadAll(gz)
+	if err != nil || !strings.Contains(string(body), "<h1>Users</h1>") {
+		t.Fatalf("could not decompress the admin page: %s", err)
+	}
+
+	gServerConfig.DisableCompression = true
+	w = httptest.NewRecorder()
+	compressed(admin)(w, r)
+	if w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("response was compressed with compression disabled")
+	}
+}
+
+func TestNotifyDryRun(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 3)
+
+	w, n := notify(t, "chan?dryRun=true", "version=42")
+	if w.Code != http.StatusOK {
+		t.Fatalf("dry run failed with status %d", w.Code)
+	}
+	if n != nil {
+		t.Fatalf("dry run queued a notification")
+	}
+	if channel.Version != 3 {
+		t.Fatalf("dry run changed the version to %d", channel.Version)
+	}
+
+	var response struct {
+		Targets []struct {
+			UAID      string `json:"uaid"`
+			ChannelID string `json:"channelID"`
+			Online    bool   `json:"online"`
+		} `json:"targets"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("could not parse dry run response: %s", err)
+	}
+	if len(response.Targets) != 1 || response.Targets[0].UAID != "uaid" ||
+		response.Targets[0].ChannelID != "chan" || response.Targets[0].Online {
+		t.Fatalf("unexpected dry run targets %+v", response.Targets)
+	}
+}
+
+// Send a message over ws and return the reply
+func exchange(t *testing.T, ws *websocket.Conn, msg map[string]interface{}) map[string]interface{} {
+	if err := websocket.JSON.Send(ws, msg); err != nil {
+		t.Fatalf("Send error %s", err)
+	}
+	var reply map[string]interface{}
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.JSON.Receive(ws, &reply); err != nil {
+		t.Fatalf("Receive error %s", err)
+	}
+	return reply
+}
+
+func hello(t *testing.T, ws *websocket.Conn, uaid string) float64 {
+	reply := exchange(t, ws, map[string]interface{}{"messageType": "hello", "uaid": uaid})
+	return reply["status"].(float64)
+}
+
+func TestMalformedMessagesAreRefused(t *testing.T) {
+	setupTest(t)
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	for _, hello := range []map[string]interface{}{
+		{"uaid": 7},
+		{"uaid": "uaid", "channelIDs": "chan"},
+		{"uaid": "uaid", "channelIDs": []interface{}{"chan", 1}},
+		{"uaid": "uaid", "wakeup_hostport": "10.0.0.1:5000"},
+		{"uaid": "uaid", "wakeup_hostport": map[string]interface{}{"ip": "10.0.0.1"}},
+		{"uaid": "uaid", "wakeup_hostport": map[string]interface{}{"ip": 10, "port": 5000}},
+	} {
+		hello["messageType"] = "hello"
+		if reply := exchange(t, ws, hello); reply["status"] != 400.0 || reply["reason"] == nil {
+			t.Fatalf("malformed hello %v got %v", hello, reply)
+		}
+	}
+
+	if status := hello(t, ws, "uaid"); status != 200 {
+		t.Fatalf("hello after the malformed ones got status %g", status)
+	}
+	for _, message := range []map[string]interface{}{
+		{"messageType": "register"},
+		{"messageType": "register", "channelID": []interface{}{"chan"}},
+		{"messageType": "unregister", "channelID": 5},
+	} {
+		if reply := exchange(t, ws, message); reply["messageType"] != message["messageType"] ||
+			reply["status"] != 400.0 || reply["error"] == nil {
+			t.Fatalf("malformed %v got %v", message, reply)
+		}
+	}
+
+	// the connection is still up
+	if reply := exchange(t, ws, map[string]interface{}{"messageType": "register", "channelID": "chan"}); reply["status"] != 200.0 {
+		t.Fatalf("register after the malformed messages got %v", reply)
+	}
+}
+
+func TestPanickingHandlerIsRecovered(t *testing.T) {
+	setupTest(t)
+	messageHandlers["explode"] = messageHandler{func(client *Client, f map[string]interface{}) {
+		var channels map[string]*Channel
+		channels["chan"].Version++
+	}, false}
+	defer delete(messageHandlers, "explode")
+
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+	if status := hello(t, ws, "uaid"); status != 200 {
+		t.Fatalf("hello got status %g", status)
+	}
+
+	panics := handlerPanics.Value()
+	if reply := exchange(t, ws, map[string]interface{}{"messageType": "explode"}); reply["status"] != 500.0 {
+		t.Fatalf("panicking handler replied %v", reply)
+	}
+	if handlerPanics.Value()-panics != 1 {
+		t.Fatalf("panic was not counted")
+	}
+
+	// the connection is still up
+	if reply := exchange(t, ws, map[string]interface{}{"messageType": "register", "channelID": "chan"}); reply["status"] != 200.0 {
+		t.Fatalf("register after the panic got %v", reply)
+	}
+}
+
+func testDuplicateHello(t *testing.T, policy string) (first, second *websocket.Conn) {
+	setupTest(t)
+	gServerConfig.DuplicateHelloPolicy = policy
+
+	server := startTestServer(t)
+
+	first = dialTestServer(t, server)
+	t.Cleanup(func() { first.Close() })
+	second = dialTestServer(t, server)
+	t.Cleanup(func() { second.Close() })
+
+	if status := hello(t, first, "uaid"); status != 200 {
+		t.Fatalf("first hello got status %g", status)
+	}
+	return first, second
+}
+
+func isClosed(ws *websocket.Conn) bool {
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	err := websocket.Message.Receive(ws, &msg)
+	return err != nil && !strings.Contains(err.Error(), "timeout")
+}
+
+func TestDuplicateHelloEvicts(t *testing.T) {
+	first, second := testDuplicateHello(t, "")
+
+	if status := hello(t, second, "uaid"); status != 200 {
+		t.Fatalf("second hello got status %g", status)
+	}
+	if !isClosed(first) {
+		t.Fatalf("first connection was not closed")
+	}
+
+	// the first connection going away must not disconnect the second
+	reply := exchange(t, second, map[string]interface{}{"messageType": "register", "channelID": "chan"})
+	if reply["status"].(float64) != 200 {
+		t.Fatalf("register on second connection got status %v", reply["status"])
+	}
+	w, _ := notify(t, "chan?dryRun=true", "")
+	if !strings.Contains(w.Body.String(), `"online":true`) {
+		t.Fatalf("second connection is not online: %s", w.Body.String())
+	}
+}
+
+func TestDuplicateHelloRejects(t *testing.T) {
+	first, second := testDuplicateHello(t, "reject")
+
+	if status := hello(t, second, "uaid"); status != 409 {
+		t.Fatalf("second hello got status %g, want 409", status)
+	}
+	if isClosed(first) {
+		t.Fatalf("first connection was closed")
+	}
+	reply := exchange(t, first, map[string]interface{}{"messageType": "register", "channelID": "chan"})
+	if reply["status"].(float64) != 200 {
+		t.Fatalf("register on first connection got status %v", reply["status"])
+	}
+}
+
+func TestResetIsCounted(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "chan", 0)
+	before := clientResets.Value()
+
+	handleHello(newClient(nil), map[string]interface{}{
+		"uaid":       "uaid",
+		"channelIDs": []interface{}{"chan"},
+	})
+	if clientResets.Value() != before {
+		t.Fatalf("a hello with known channels was counted as a reset")
+	}
+
+	handleHello(newClient(nil), map[string]interface{}{
+		"uaid":       "uaid",
+		"channelIDs": []interface{}{"chan", "unknown"},
+	})
+	if clientResets.Value() != before+1 {
+		t.Fatalf("got %d resets, want %d", clientResets.Value(), before+1)
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), fmt.Sprintf("push_client_resets_total %d\n", before+1)) {
+		t.Fatalf("reset count missing from metrics: %s", w.Body.String())
+	}
+}
+
+func TestInsecureNeedsExplicitFlag(t *testing.T) {
+	setupTest(t)
+	gServerConfig.Hostname = "localhost"
+	gServerConfig.Port = "0"
+
+	if err := listenAndServe(); err != errInsecure {
+		t.Fatalf("plain HTTP without allowInsecure got %v, want errInsecure", err)
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	setupTest(t)
+	gServerConfig.ListenNetwork = "unix"
+	gServerConfig.ListenAddress = "push.sock"
+
+	// left behind by a server that crashed
+	stale, err := net.Listen("unix", "push.sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	listener, err := listen()
+	if err != nil {
+		t.Fatalf("could not listen over a stale socket: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})}
+	go server.Serve(listener)
+
+	client := &http.Client{Transport: &http.Transport{
+		Dial: func(network, address string) (net.Conn, error) { return net.Dial("unix", "push.sock") },
+	}}
+	resp, err := client.Get("http://push/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("got %q over the unix socket", body)
+	}
+
+	// a live socket is left to its server
+	if _, err := listen(); err == nil {
+		t.Fatalf("took over a socket that is in use")
+	}
+	server.Close()
+	if _, err := os.Stat("push.sock"); !os.IsNotExist(err) {
+		t.Fatalf("socket file was left behind after closing")
+	}
+
+	ioutil.WriteFile("push.sock", []byte("data"), 0600)
+	if _, err := listen(); err == nil {
+		t.Fatalf("replaced a file that is not a socket")
+	}
+}
+
+func TestOpenStateRecoversFromCorruptEntry(t *testing.T) {
+	setupTest(t)
+	state := `{
+		"uaidToChannels": {
+			"good": {"a": {"uaid": "good", "channelID": "a", "version": 7}},
+			"bad": {"b": {"uaid": "bad", "channelID": "b", "version": "oops"}}
+		},
+		"channelIDToChannel": {
+			"a": {"uaid": "good", "channelID": "a", "version": 7},
+			"b": {"uaid": "bad", "channelID": "b", "version": "oops"}
+		}
+	}`
+	if err := ioutil.WriteFile("serverstate.json", []byte(state), 0644); err != nil {
+		t.Fatalf("WriteFile error %s", err)
+	}
+
+	openState()
+
+	channel := gServerState.ChannelIDToChannel["a"]
+	if channel == nil || channel.Version != 7 {
+		t.Fatalf("good channel was not recovered: %+v", channel)
+	}
+	if gServerState.UAIDToChannelIDs["good"]["a"] != channel {
+		t.Fatalf("good channel is not linked to its UAID")
+	}
+	if _, ok := gServerState.ChannelIDToChannel["b"]; ok {
+		t.Fatalf("corrupt channel was loaded")
+	}
+	checkIndices(t)
+}
+
+func TestOpenStateKeepsWhatPrecedesDamage(t *testing.T) {
+	setupTest(t)
+	state := `{"uaidToChannels": {}, "channelIDToChannel": {
+		"a": {"uaid": "good", "channelID": "a", "version": 7},
+		"b": {"uaid": "good", "channelID": "b", "vers`
+	if err := ioutil.WriteFile("serverstate.json", []byte(state), 0644); err != nil {
+		t.Fatalf("WriteFile error %s", err)
+	}
+
+	openState()
+
+	if gServerState.UAIDToChannelIDs["good"]["a"] == nil {
+		t.Fatalf("channel before the damage was not recovered")
+	}
+	checkIndices(t)
+}
+
+// Counts the writes made to the connections it accepts
+type countingListener struct {
+	net.Listener
+	writes *int64
+}
+
+type countingConn struct {
+	net.Conn
+	writes *int64
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, l.writes}, nil
+}
+
+func (c countingConn) Write(b []byte) (int, error) {
+	atomic.AddInt64(c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+// Keeps a copy of everything read from the connection
+type recordingConn struct {
+	net.Conn
+	read *bytes.Buffer
+}
+
+func (c recordingConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.read.Write(b[:n])
+	return n, err
+}
+
+func benchmarkWrites(b *testing.B, flushDelay float64) {
+	setupTest(b)
+	gServerConfig.WriteFlushDelay = flushDelay
+
+	var writes int64
+	server := httptest.NewUnstartedServer(websocket.Handler(func(ws *websocket.Conn) {
+		client := newClient(ws)
+		go clientWriter(client, ws)
+		for i := 0; i < b.N; i++ {
+			sendToClient(client, `{"messageType":"notification"}`)
+		}
+
+		var ignored string
+		websocket.Message.Receive(ws, &ignored)
+		close(client.done)
+	}))
+	server.Listener = countingListener{server.Listener, &writes}
+	server.Start()
+	defer server.Close()
+
+	url := strings.Replace(server.URL, "http://", "ws://", 1)
+	ws, err := websocket.Dial(url, "", server.URL)
+	if err != nil {
+		b.Fatalf("Dial error %s", err)
+	}
+	defer ws.Close()
+
+	for i := 0; i < b.N; i++ {
+		var msg string
+		if err := websocket.Message.Receive(ws, &msg); err != nil {
+			b.Fatalf("Receive error %s", err)
+		}
+	}
+	b.ReportMetric(float64(atomic.LoadInt64(&writes))/float64(b.N), "writes/op")
+	websocket.Message.Send(ws, "done")
+}
+
+func BenchmarkWritesImmediate(b *testing.B) {
+	benchmarkWrites(b, 0)
+}
+
+func BenchmarkWritesCoalesced(b *testing.B) {
+	benchmarkWrites(b, 0.001)
+}
+
+func TestBufferedWritesFlushInTime(t *testing.T) {
+	setupTest(t)
+	gServerConfig.WriteFlushDelay = 0.05
+
+	sent := make(chan time.Time, 1)
+	server := httptest.NewServer(websocket.Handler(func(ws *websocket.Conn) {
+		client := newClient(ws)
+		go clientWriter(client, ws)
+		sent <- time.Now()
+		sendToClient(client, `{"messageType":"notification"}`)
+
+		var ignored string
+		websocket.Message.Receive(ws, &ignored)
+		close(client.done)
+	}))
+	defer server.Close()
+
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(time.Second))
+	if err := websocket.Message.Receive(ws, &msg); err != nil {
+		t.Fatalf("buffered message was never flushed: %s", err)
+	}
+	if latency := time.Since(<-sent); latency > 500*time.Millisecond {
+		t.Fatalf("buffered message took %s to arrive", latency)
+	}
+	websocket.Message.Send(ws, "done")
+}
+
+func TestPongsWithFlushDelay(t *testing.T) {
+	setupTest(t)
+	gServerConfig.WriteFlushDelay = 0.05
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	// the reader goroutine answers the ping while the writer runs,
+	// and both look at whether writes are deferred
+	if err := ws.WritePing([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if status := hello(t, ws, "uaid"); status != 200 {
+		t.Fatalf("hello after a ping got status %v", status)
+	}
+}
+
+func TestNotifyUAID(t *testing.T) {
+	setupTest(t)
+	a := addTestChannel("uaid", "a", 1)
+	b := addTestChannel("uaid", "b", 5)
+	other := addTestChannel("other", "c", 1)
+	notifyChan = make(chan Notification, 10)
+
+	w := httptest.NewRecorder()
+	uaidHandler(w, httptest.NewRequest("PUT", "/uaid/uaid/notify", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"notified":2}` {
+		t.Fatalf("got %d %s, want 2 channels notified", w.Code, w.Body.String())
+	}
+	if a.Version != 2 || b.Version != 6 || other.Version != 1 {
+		t.Fatalf("got versions %d, %d, %d; want 2, 6, 1", a.Version, b.Version, other.Version)
+	}
+
+	queued := map[string]bool{}
+	for len(notifyChan) > 0 {
+		n := <-notifyChan
+		queued[n.Channel.ChannelID] = true
+	}
+	if len(queued) != 2 || !queued["a"] || !queued["b"] {
+		t.Fatalf("queued notifications for %v, want a and b", queued)
+	}
+
+	w = httptest.NewRecorder()
+	uaidHandler(w, httptest.NewRequest("PUT", "/uaid/nobody/notify", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("unknown UAID got status %d, want 404", w.Code)
+	}
+}
+
+func TestNotifyUAIDSkipsUnregisteredChannels(t *testing.T) {
+	setupTest(t)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	handleRegister(client, map[string]interface{}{"channelIDs": []interface{}{"kept", "gone"}})
+	<-client.outgoing
+	handleUnregister(client, map[string]interface{}{"channelID": "gone"})
+	<-client.outgoing
+	notifyChan = make(chan Notification, 10)
+
+	w := httptest.NewRecorder()
+	uaidHandler(w, httptest.NewRequest("PUT", "/uaid/uaid/notify", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"notified":1}` {
+		t.Fatalf("got %d %s, want 1 channel notified", w.Code, w.Body.String())
+	}
+	if n := <-notifyChan; n.Channel.ChannelID != "kept" || len(notifyChan) != 0 {
+		t.Fatalf("queued notifications for %s and %d more, want just kept", n.Channel.ChannelID, len(notifyChan))
+	}
+}
+
+func TestNotifyUAIDRefusesOverflow(t *testing.T) {
+	setupTest(t)
+	a := addTestChannel("uaid", "a", 1)
+	b := addTestChannel("uaid", "b", math.MaxUint64)
+	notifyChan = make(chan Notification, 10)
+
+	w := httptest.NewRecorder()
+	uaidHandler(w, httptest.NewRequest("PUT", "/uaid/uaid/notify", nil))
+	if w.Code != http.StatusBadRequest || w.Body.String() != "Version would overflow." {
+		t.Fatalf("got %d %s, want 400", w.Code, w.Body.String())
+	}
+	if a.Version != 1 || b.Version != math.MaxUint64 || len(notifyChan) != 0 {
+		t.Fatalf("refused notify left versions %d, %d and queued %d", a.Version, b.Version, len(notifyChan))
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	setupTest(t)
+	gServerConfig.HandshakeTimeout = 0.1
+	before := incompleteHandshakes.Value()
+
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+
+	// messages other than hello don't count
+	websocket.JSON.Send(ws, map[string]interface{}{"messageType": "register", "channelID": "chan"})
+
+	start := time.Now()
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := websocket.Message.Receive(ws, &msg); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("connection without hello was not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("connection was closed after %s", elapsed)
+	}
+
+	// let the handler finish its cleanup
+	for i := 0; i < 100 && incompleteHandshakes.Value() == before; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if incompleteHandshakes.Value() != before+1 {
+		t.Fatalf("incomplete handshake was not counted")
+	}
+	if len(gServerState.ChannelIDToChannel) != 0 {
+		t.Fatalf("register before hello created a channel")
+	}
+}
+
+func TestRequestsWaitForReadiness(t *testing.T) {
+	setupTest(t)
+	atomic.StoreInt32(&gReady, 0)
+	defer atomic.StoreInt32(&gReady, 0)
+	addTestChannel("uaid", "chan", 1)
+	notifyChan = make(chan Notification, 1)
+
+	handler := whenReady(http.HandlerFunc(notifyHandler))
+	request := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest("PUT", "/notify/chan", nil))
+		return w
+	}
+	ready := func() int {
+		w := httptest.NewRecorder()
+		readyz(w, httptest.NewRequest("GET", "/readyz", nil))
+		return w.Code
+	}
+
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Fatalf("/readyz got %d before startup finished, want 503", code)
+	}
+	if w := request(); w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("notify got %d before startup finished, want 503 with Retry-After", w.Code)
+	}
+	if len(notifyChan) != 0 {
+		t.Fatalf("notify was handled before startup finished")
+	}
+
+	setReady()
+	if code := ready(); code != http.StatusOK {
+		t.Fatalf("/readyz got %d when ready", code)
+	}
+	if w := request(); w.Code != http.StatusOK {
+		t.Fatalf("notify got %d when ready", w.Code)
+	}
+}
+
+func TestHealthReportsStorage(t *testing.T) {
+	setupTest(t)
+	gServerState.ConnectedClients["uaid"] = &Client{UAID: "uaid"}
+	check := func() (int, health) {
+		w := httptest.NewRecorder()
+		healthHandler(w, httptest.NewRequest("GET", "/health", nil))
+		var status health
+		if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+			t.Fatalf("bad /health body %q: %v", w.Body.String(), err)
+		}
+		return w.Code, status
+	}
+
+	if code, status := check(); code != http.StatusOK || status.Storage != "ok" || status.ConnectedClients != 1 {
+		t.Fatalf("/health got %d %+v with writable storage", code, status)
+	}
+	if matches, _ := filepath.Glob(".check*"); len(matches) != 0 {
+		t.Fatalf("/health left %v behind", matches)
+	}
+
+	gStorage = &FileStorage{Filename: "missing/serverstate.json"}
+	if code, status := check(); code != http.StatusServiceUnavailable || status.Storage == "ok" {
+		t.Fatalf("/health got %d %+v with unwritable storage, want 503", code, status)
+	}
+}
+
+func TestWakeupsAreCapped(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxConcurrentWakeups = 3
+	startWakeups()
+
+	var mu sync.Mutex
+	inProgress, maxInProgress, woken := 0, 0, 0
+	release := make(chan bool)
+	wakeup = func(client *Client, channelID string) error {
+		mu.Lock()
+		inProgress++
+		woken++
+		if inProgress > maxInProgress {
+			maxInProgress = inProgress
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		inProgress--
+		mu.Unlock()
+		return nil
+	}
+	defer func() { wakeup = wakeupClient }()
+
+	dropped := wakeupsDropped.Value()
+	for i := 0; i < 10; i++ {
+		requestWakeup(newClient(nil), "chan")
+	}
+	close(release)
+
+	if n := wakeupsDropped.Value() - dropped; n != 7 {
+		t.Fatalf("dropped %d wakeups, want 7", n)
+	}
+	for i := 0; i < 100 && len(wakeupSlots) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if woken != 3 || maxInProgress > 3 {
+		t.Fatalf("%d wakeups ran, up to %d at once; want 3", woken, maxInProgress)
+	}
+}
+
+func TestFailedAckKeepsNotificationPending(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 3)
+	pending := map[string]Notification{"chan": {UAID: "uaid", Channel: channel}}
+	failures := ackFailures.Value()
+
+	processAck(pending, Ack{ChannelID: "chan", Version: 3, Status: 500, Error: "decryption failed"})
+	if _, ok := pending["chan"]; !ok {
+		t.Fatalf("failed ack removed the pending notification")
+	}
+	if ackFailures.Value() != failures+1 {
+		t.Fatalf("failed ack was not counted")
+	}
+
+	processAck(pending, Ack{ChannelID: "chan", Version: 3, Status: 200})
+	if _, ok := pending["chan"]; ok {
+		t.Fatalf("successful ack left the notification pending")
+	}
+}
+
+func TestAckStatusIsParsed(t *testing.T) {
+	setupTest(t)
+	ackChan = make(chan []Ack, 1)
+
+	handleAck(newClient(nil), map[string]interface{}{
+		"updates": []interface{}{
+			map[string]interface{}{"channelID": "a", "version": 1.0},
+			map[string]interface{}{"channelID": "b", "version": 2.0, "status": 500.0, "error": "oops"},
+		},
+	})
+
+	acks := <-ackChan
+	if len(acks) != 2 {
+		t.Fatalf("ack message made %d acks, want 2", len(acks))
+	}
+	if ack := acks[0]; ack.Status != 0 || ack.Error != "" {
+		t.Fatalf("plain ack got status %d %q", ack.Status, ack.Error)
+	}
+	if ack := acks[1]; ack.Status != 500 || ack.Error != "oops" {
+		t.Fatalf("failed ack got status %d %q", ack.Status, ack.Error)
+	}
+}
+
+func TestMalformedAcksAreRejected(t *testing.T) {
+	setupTest(t)
+	ackChan = make(chan []Ack, 1)
+	client := newClient(nil)
+	client.UAID = "uaid"
+
+	invalid := invalidAcks.Value()
+	handleAck(client, map[string]interface{}{"messageType": "ack"})
+	if reply := <-client.outgoing; reply != `{"messageType":"ack","status":400,"updates":[]}` {
+		t.Fatalf("ack without updates got %s", reply)
+	}
+
+	handleAck(client, map[string]interface{}{
+		"updates": []interface{}{
+			map[string]interface{}{"channelID": "a", "version": 1.0},
+			map[string]interface{}{"version": 1.0},
+			map[string]interface{}{"channelID": "c", "version": "2"},
+			"d",
+		},
+	})
+	if acks := <-ackChan; len(acks) != 1 || acks[0].ChannelID != "a" {
+		t.Fatalf("ack message made acks %v, want just a", acks)
+	}
+	var reply struct {
+		Status  int
+		Updates []AckResult
+	}
+	json.Unmarshal([]byte(<-client.outgoing), &reply)
+	if reply.Status != 400 || len(reply.Updates) != 4 || reply.Updates[0].Status != 200 ||
+		reply.Updates[2].ChannelID != "c" || reply.Updates[2].Status != 400 || reply.Updates[3].Status != 400 {
+		t.Fatalf("ack reply %+v", reply)
+	}
+	if n := invalidAcks.Value() - invalid; n != 4 {
+		t.Fatalf("counted %d invalid acks, want 4", n)
+	}
+
+	// acking a version newer than the one sent
+	violations := ackProtocolViolations.Value()
+	pending := map[string]Notification{"a": {UAID: "uaid", Channel: &Channel{ChannelID: "a", Version: 2}}}
+	processAck(pending, Ack{ChannelID: "a", Version: 5})
+	if _, ok := pending["a"]; ok || ackProtocolViolations.Value()-violations != 1 {
+		t.Fatalf("ack of an unsent version was not counted as a violation")
+	}
+}
+
+func TestRegisterReportsVersion(t *testing.T) {
+	setupTest(t)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	addTestChannel("uaid", "existing", 7)
+
+	for channelID, want := range map[string]float64{"new": 0, "existing": 7} {
+		handleRegister(client, map[string]interface{}{"channelID": channelID})
+		var reply map[string]interface{}
+		if err := json.Unmarshal([]byte(<-client.outgoing), &reply); err != nil {
+			t.Fatal(err)
+		}
+		if reply["status"] != 200.0 || reply["version"] != want {
+			t.Fatalf("register of %s got %v", channelID, reply)
+		}
+	}
+	if gServerState.ChannelIDToChannel["existing"].Version != 7 {
+		t.Fatalf("registering again reset the version")
+	}
+}
+
+func TestHelloNegotiatesProtocolVersion(t *testing.T) {
+	setupTest(t)
+	hello := func(version interface{}) (*Client, map[string]interface{}) {
+		client := newClient(nil)
+		f := map[string]interface{}{"uaid": "uaid"}
+		if version != nil {
+			f["protocolVersion"] = version
+		}
+		handleHello(client, f)
+		var reply map[string]interface{}
+		if err := json.Unmarshal([]byte(<-client.outgoing), &reply); err != nil {
+			t.Fatal(err)
+		}
+		return client, reply
+	}
+
+	for _, version := range []interface{}{nil, 1.0} {
+		client, reply := hello(version)
+		if reply["status"] != 200.0 || reply["protocolVersion"] != float64(maxProtocolVersion) {
+			t.Fatalf("hello with version %v got %v", version, reply)
+		}
+		if client.protocolVersion != 1 {
+			t.Fatalf("hello with version %v agreed on %d", version, client.protocolVersion)
+		}
+		delete(gServerState.ConnectedClients, "uaid")
+	}
+
+	for _, version := range []interface{}{0.0, float64(maxProtocolVersion + 1), 1.5, "1"} {
+		client, reply := hello(version)
+		if reply["status"] != 400.0 || reply["reason"] == nil || client.UAID != "" {
+			t.Fatalf("hello with version %v got %v", version, reply)
+		}
+	}
+	if _, ok := gServerState.ConnectedClients["uaid"]; ok {
+		t.Fatalf("a refused hello connected the client")
+	}
+}
+
+func TestBatchRegister(t *testing.T) {
+	setupTest(t)
+	addTestChannel("other", "taken", 1)
+	addTestChannel("uaid", "mine", 4)
+	client := newClient(nil)
+	client.UAID = "uaid"
+
+	handleRegister(client, map[string]interface{}{
+		"channelIDs": []interface{}{"a", "taken", "mine", 7.0, "b"},
+		"strict":     true,
+	})
+	var reply struct {
+		Name     string
+		Status   int
+		Channels []RegisterResult
+	}
+	if err := json.Unmarshal([]byte(<-client.outgoing), &reply); err != nil {
+		t.Fatal(err)
+	}
+	want := []struct {
+		channelID string
+		status    int
+		version   uint64
+	}{{"a", 200, 0}, {"taken", 409, 0}, {"mine", 200, 4}, {"", 400, 0}, {"b", 200, 0}}
+	if reply.Status != 200 || len(reply.Channels) != len(want) {
+		t.Fatalf("batch register got %+v", reply)
+	}
+	for i, result := range reply.Channels {
+		if result.ChannelID != want[i].channelID || result.Status != want[i].status || result.Version != want[i].version {
+			t.Fatalf("result %d is %+v, want %+v", i, result, want[i])
+		}
+		if result.Status == 200 && !strings.HasSuffix(result.PushEndpoint, "/notify/"+result.ChannelID) {
+			t.Fatalf("%s got endpoint %q", result.ChannelID, result.PushEndpoint)
+		}
+	}
+
+	for _, channelID := range []string{"a", "b", "mine"} {
+		if channel := gServerState.ChannelIDToChannel[channelID]; channel == nil || channel.UAID != "uaid" {
+			t.Fatalf("%s was not registered to uaid", channelID)
+		}
+		if !gServerState.StrictChannels[channelID] {
+			t.Fatalf("%s did not get the batch's options", channelID)
+		}
+	}
+	if gServerState.ChannelIDToChannel["taken"].UAID != "other" {
+		t.Fatalf("a conflicting channel changed hands")
+	}
+	checkIndices(t)
+}
+
+func TestChannelsPerUAIDAreCapped(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxChannelsPerUAID = 2
+	client := newClient(nil)
+	client.UAID = "uaid"
+
+	register := func(channelID string) float64 {
+		handleRegister(client, map[string]interface{}{"channelID": channelID})
+		var reply map[string]interface{}
+		if err := json.Unmarshal([]byte(<-client.outgoing), &reply); err != nil {
+			t.Fatal(err)
+		}
+		return reply["status"].(float64)
+	}
+
+	for _, channelID := range []string{"a", "b"} {
+		if status := register(channelID); status != 200 {
+			t.Fatalf("register of %s got status %g", channelID, status)
+		}
+	}
+	if status := register("c"); status != 507 {
+		t.Fatalf("register past the limit got status %g, want 507", status)
+	}
+	if _, ok := gServerState.ChannelIDToChannel["c"]; ok || len(gServerState.UAIDToChannelIDs["uaid"]) != 2 {
+		t.Fatalf("register past the limit changed the state")
+	}
+	checkIndices(t)
+
+	// registering a channel again doesn't count against the limit
+	if status := register("a"); status != 200 {
+		t.Fatalf("registering again at the limit got status %g", status)
+	}
+}
+
+func TestInFlightPerUAIDIsBounded(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxInFlightPerUAID = 3
+	pending := map[string]Notification{}
+	dropped := notificationsDropped.Value()
+
+	for i := 0; i < 10; i++ {
+		channel := addTestChannel("uaid", fmt.Sprint("chan", i), 1)
+		addPending(pending, Notification{UAID: "uaid", Channel: channel})
+	}
+	if len(pending) != 3 {
+		t.Fatalf("%d notifications in flight, want 3", len(pending))
+	}
+	if n := notificationsDropped.Value() - dropped; n != 7 {
+		t.Fatalf("dropped %d notifications, want 7", n)
+	}
+
+	// newer versions of pending channels still get through, as do
+	// notifications for other UAIDs
+	channel := gServerState.ChannelIDToChannel["chan0"]
+	if !addPending(pending, Notification{UAID: "uaid", Channel: channel}) {
+		t.Fatalf("new version of a pending channel was dropped")
+	}
+	if !addPending(pending, Notification{UAID: "other", Channel: addTestChannel("other", "chan", 1)}) {
+		t.Fatalf("notification for another UAID was dropped")
+	}
+}
+
+func TestConfigFromURL(t *testing.T) {
+	setupTest(t)
+	source := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/config.json" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`{"hostname": "push.example.com", "port": "8443"}`))
+	}))
+	defer source.Close()
+
+	if err := loadConfig(source.URL + "/config.json"); err != nil {
+		t.Fatal(err)
+	}
+	if gServerConfig.Hostname != "push.example.com" || gServerConfig.Port != "8443" {
+		t.Fatalf("loaded config %+v", gServerConfig)
+	}
+
+	if err := loadConfig(source.URL + "/missing.json"); err == nil {
+		t.Fatalf("loading config from a missing URL succeeded")
+	}
+}
+
+func TestConfigIsValidated(t *testing.T) {
+	setupTest(t)
+	files := writeTestCertificate(t, "push.example.com")
+	valid := ServerConfig{Hostname: "push.example.com", Port: "443", NotifyPrefix: "/notify/",
+		UseTLS: true, CertFilename: files.CertFilename, KeyFilename: files.KeyFilename}
+	if problems := valid.validate(); len(problems) != 0 {
+		t.Fatalf("valid config has problems %v", problems)
+	}
+
+	for _, test := range []struct {
+		change   func(config *ServerConfig)
+		problems int
+	}{
+		{func(config *ServerConfig) { config.Hostname, config.Port = "", "" }, 2},
+		{func(config *ServerConfig) { config.NotifyPrefix = "" }, 1},
+		{func(config *ServerConfig) { config.NotifyPrefix = "notify" }, 1},
+		{func(config *ServerConfig) { config.NotifyPrefix = "/" }, 1},
+		{func(config *ServerConfig) { config.NotifyPrefix = "/uaid/" }, 1},
+		{func(config *ServerConfig) { config.NotifyPrefix = "/admin/notify/" }, 1},
+		{func(config *ServerConfig) { config.CertFilename = "" }, 1},
+		{func(config *ServerConfig) { config.KeyFilename = "missing.key" }, 1},
+		{func(config *ServerConfig) {
+			config.Certificates = map[string]CertificateFiles{"a.example.com": {"a.crt", "a.key"}}
+		}, 2},
+		{func(config *ServerConfig) { config.WakeupPayload = "{{.UAID" }, 1},
+		{func(config *ServerConfig) { config.WakeupPayload = "{{.UAID}} {{.ChannelID}}" }, 0},
+		{func(config *ServerConfig) { config.Peers = []string{"http://a", "http://b"} }, 1},
+		{func(config *ServerConfig) { config.Peers, config.Storage = []string{"http://a", "http://b"}, "redis" }, 0},
+		// nothing to check without TLS
+		{func(config *ServerConfig) { config.UseTLS, config.CertFilename = false, "" }, 0},
+	} {
+		config := valid
+		test.change(&config)
+		if problems := config.validate(); len(problems) != test.problems {
+			t.Fatalf("config %+v has problems %v, want %d", config, problems, test.problems)
+		}
+	}
+}
+
+func TestRedeliveryBacksOff(t *testing.T) {
+	setupTest(t)
+	gServerConfig.RedeliveryBackoff = 1
+	gServerConfig.RedeliveryBackoffCap = 5
+	gServerConfig.MaxDeliveryAttempts = 3
+
+	for i, want := range []time.Duration{1, 2, 4, 5, 5} {
+		if backoff := redeliveryBackoff(i + 1); backoff != want*time.Second {
+			t.Fatalf("backoff after %d attempts is %v, want %v", i+1, backoff, want*time.Second)
+		}
+	}
+
+	now := time.Now()
+	pending := make(map[string]Notification)
+	for _, n := range []Notification{
+		{UAID: "uaid", Channel: &Channel{ChannelID: "due"}, Attempts: 1, NextAttempt: now.Add(-time.Second)},
+		{UAID: "uaid", Channel: &Channel{ChannelID: "waiting"}, Attempts: 1, NextAttempt: now.Add(time.Minute)},
+		{UAID: "uaid", Channel: &Channel{ChannelID: "spent"}, Attempts: 3, NextAttempt: now.Add(-time.Second)},
+	} {
+		pending[n.Channel.ChannelID] = n
+	}
+
+	abandoned := notificationsAbandoned.Value()
+	redeliver(pending, newThrottle(), false)
+
+	if due := pending["due"]; due.Attempts != 2 || due.NextAttempt.Before(now.Add(2*time.Second)) {
+		t.Fatalf("due notification is at %d attempts, next at %v", due.Attempts, due.NextAttempt)
+	}
+	if waiting := pending["waiting"]; waiting.Attempts != 1 {
+		t.Fatalf("notification that wasn't due was sent again")
+	}
+	if _, ok := pending["spent"]; ok || notificationsAbandoned.Value()-abandoned != 1 {
+		t.Fatalf("notification out of attempts was kept")
+	}
+}
+
+func TestRedeliveryFollowsSweepInterval(t *testing.T) {
+	setupTest(t)
+	gServerConfig.RedeliverySweepInterval = 0.02
+	gServerConfig.RedeliveryBackoff = 0.02
+	channel := addTestChannel("uaid", "chan", 1)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.attached = true
+	gServerState.ConnectedClients["uaid"] = client
+
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	notifications <- Notification{UAID: "uaid", Channel: channel}
+
+	// sent, and sent again since it isn't acked
+	for i := 0; i < 2; i++ {
+		select {
+		case <-client.outgoing:
+		case <-time.After(time.Second):
+			t.Fatalf("notification was sent %d times, want it sent again", i)
+		}
+	}
+}
+
+func TestHeldNotificationIsReleasedBetweenSweeps(t *testing.T) {
+	setupTest(t)
+	gServerConfig.RedeliverySweepInterval = 60
+	gServerConfig.MinNotifyInterval = 0.05
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.attached = true
+	gServerState.ConnectedClients["uaid"] = client
+
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	for version := uint64(1); version <= 2; version++ {
+		notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: version}}
+	}
+
+	for version := uint64(1); version <= 2; version++ {
+		select {
+		case message := <-client.outgoing:
+			if !strings.Contains(message, fmt.Sprint(`"version":`, version)) {
+				t.Fatalf("got %s, want version %d", message, version)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("version %d was not sent", version)
+		}
+	}
+}
+
+func TestDeliveryOrder(t *testing.T) {
+	setupTest(t)
+	start := time.Now()
+	pending := map[string]Notification{}
+	for channelID, age := range map[string]int{"first": 3, "second": 2, "third": 1} {
+		pending[channelID] = Notification{
+			UAID:    "uaid",
+			Channel: addTestChannel("uaid", channelID, 1),
+			Queued:  start.Add(-time.Duration(age) * time.Second),
+		}
+	}
+
+	for order, want := range map[string]string{
+		"":     "first second third",
+		"fifo": "first second third",
+		"lifo": "third second first",
+	} {
+		gServerConfig.DeliveryOrder = order
+		var got []string
+		for _, notification := range orderedPending(pending) {
+			got = append(got, notification.Channel.ChannelID)
+		}
+		if strings.Join(got, " ") != want {
+			t.Fatalf("%q order delivered %v, want %s", order, got, want)
+		}
+	}
+}
+
+func TestDeliveryMetricsAreLabeledByPlatform(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 1)
+	client := newClient(&websocket.Conn{})
+	handleHello(client, map[string]interface{}{"uaid": "uaid", "platform": "android"})
+	<-client.outgoing
+
+	sent := notificationsSent.Value("android")
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	<-client.outgoing
+	if notificationsSent.Value("android") != sent+1 {
+		t.Fatalf("delivery was not counted for the android platform")
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	if !strings.Contains(w.Body.String(), `push_notifications_sent_total{platform="android"}`) {
+		t.Fatalf("platform label missing from metrics: %s", w.Body.String())
+	}
+
+	// made up platforms don't get a label of their own
+	if label := platformLabel("my-fridge"); label != "other" {
+		t.Fatalf("unknown platform got label %q", label)
+	}
+}
+
+func TestServerMetrics(t *testing.T) {
+	setupTest(t)
+	client := newClient(&websocket.Conn{})
+	handleHello(client, map[string]interface{}{"uaid": "uaid"})
+	<-client.outgoing
+
+	registered := registrations.Value()
+	handleRegister(client, map[string]interface{}{"channelID": "chan"})
+	<-client.outgoing
+	if registrations.Value() != registered+1 {
+		t.Fatalf("registration was not counted")
+	}
+
+	received := notificationsReceived.Value()
+	if w, _ := notify(t, "chan", "version=2"); w.Code != http.StatusOK {
+		t.Fatalf("notify got status %d", w.Code)
+	}
+	if notificationsReceived.Value() != received+1 {
+		t.Fatalf("notify was not counted")
+	}
+
+	saves := stateSaves.Value()
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if stateSaves.Value() != saves+1 {
+		t.Fatalf("save was not counted")
+	}
+
+	w := httptest.NewRecorder()
+	metricsHandler(w, httptest.NewRequest("GET", "/metrics", nil))
+	for _, want := range []string{"push_connected_clients 1\n", "push_registered_channels 1\n",
+		"push_pending_depth ", "push_wakeups_sent_total ", "push_state_last_save_milliseconds "} {
+		if !strings.Contains(w.Body.String(), want) {
+			t.Fatalf("%q missing from metrics: %s", want, w.Body.String())
+		}
+	}
+}
+
+func TestNoWakeupWhileReconnecting(t *testing.T) {
+	setupTest(t)
+	gServerConfig.WakeupReconnectWindow = 0.1
+	startWakeups()
+
+	woken := make(chan bool, 10)
+	wakeup = func(client *Client, channelID string) error {
+		woken <- true
+		return nil
+	}
+	defer func() { wakeup = wakeupClient }()
+
+	channel := addTestChannel("uaid", "chan", 1)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	gServerState.ConnectedClients["uaid"] = client
+
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	time.Sleep(20 * time.Millisecond)
+	if len(woken) != 1 {
+		t.Fatalf("client was woken %d times within the reconnect window", len(woken))
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	attemptDelivery(Notification{UAID: "uaid", Channel: channel})
+	time.Sleep(20 * time.Millisecond)
+	if len(woken) != 2 {
+		t.Fatalf("client was not woken again after the reconnect window")
+	}
+}
+
+func TestHigherVersionAckClearsPending(t *testing.T) {
+	setupTest(t)
+	channel := addTestChannel("uaid", "chan", 3)
+	pending := map[string]Notification{"chan": {UAID: "uaid", Channel: channel}}
+
+	processAck(pending, Ack{ChannelID: "chan", Version: 2})
+	if _, ok := pending["chan"]; !ok {
+		t.Fatalf("ack of an older version cleared the pending notification")
+	}
+
+	processAck(pending, Ack{ChannelID: "chan", Version: 5})
+	if _, ok := pending["chan"]; ok {
+		t.Fatalf("ack of a newer version left the notification pending")
+	}
+}
+
+func TestSlowSaveShedsNotify(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxConcurrentSaves = 1
+	gServerConfig.SaveTimeout = 0.1
+	startSaves()
+	addTestChannel("uaid", "chan", 1)
+
+	release := make(chan bool)
+	storeChannels = func([]*Channel) error {
+		<-release
+		return nil
+	}
+	defer func() { storeChannels = saveChannels }()
+	defer close(release)
+
+	start := time.Now()
+	w, n := notify(t, "chan", "version=2")
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("notify waited %s for a slow save", elapsed)
+	}
+	if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") == "" || n != nil {
+		t.Fatalf("notify with a slow save got %d and queued %v", w.Code, n)
+	}
+
+	// the stuck save still holds the only slot
+	if w, _ = notify(t, "chan", "version=3"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("notify without a free save slot got %d", w.Code)
+	}
+}
+
+func TestLateSaveOfRefusedNotifyIsReverted(t *testing.T) {
+	setupTest(t)
+	gServerConfig.SaveTimeout = 0.05
+	addTestChannel("uaid", "chan", 1)
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	release := make(chan bool)
+	storeChannels = func(channels []*Channel) error {
+		<-release
+		return saveChannels(channels)
+	}
+	defer func() { storeChannels = saveChannels }()
+
+	if w, _ := notify(t, "chan", "version=2"); w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("notify with a slow save got %d", w.Code)
+	}
+	// the save goes through after all, and is saved over
+	close(release)
+	deadline := time.Now().Add(time.Second)
+	for {
+		journal, _ := ioutil.ReadFile("serverstate.json.journal")
+		if strings.Count(string(journal), "\n") == 2 {
+			break
+		} else if time.Now().After(deadline) {
+			t.Fatalf("journal is %s, want the late save and its revert", journal)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var state ServerState
+	if err := (&FileStorage{Filename: "serverstate.json"}).Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if version := state.ChannelIDToChannel["chan"].Version; version != 1 {
+		t.Fatalf("refused notify left version %d saved, want 1", version)
+	}
+}
+
+func TestFailedSaveRevertsNotify(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "chan", 1)
+	storeChannels = func([]*Channel) error {
+		return errors.New("disk full")
+	}
+	defer func() { storeChannels = saveChannels }()
+
+	w, n := notify(t, "chan", "version=2")
+	if w.Code != http.StatusInternalServerError || n != nil {
+		t.Fatalf("notify with a failing save got %d and queued %v", w.Code, n)
+	}
+	if version := gServerState.ChannelIDToChannel["chan"].Version; version != 1 {
+		t.Fatalf("failed notify left version %d, want 1", version)
+	}
+}
+
+func TestMigrateMovesChannels(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PollSecret = "secret"
+	addTestChannel("old", "a", 3)
+	addTestChannel("old", "b", 7)
+	addTestChannel("taken", "c", 1)
+	client := newClient(nil)
+	client.UAID = "old"
+	client.attached = true
+	gServerState.ConnectedClients["old"] = client
+	token := pollToken("old")
+
+	var reply map[string]interface{}
+	for _, refused := range []struct {
+		f      map[string]interface{}
+		status float64
+	}{
+		{map[string]interface{}{"newUAID": "taken", "token": token}, 409},
+		{map[string]interface{}{"newUAID": "new", "token": pollToken("taken")}, 401},
+		{map[string]interface{}{"newUAID": "new"}, 400},
+		{map[string]interface{}{"newUAID": "../new", "token": token}, 400},
+	} {
+		handleMigrate(client, refused.f)
+		json.Unmarshal([]byte(<-client.outgoing), &reply)
+		if reply["status"] != refused.status || client.UAID != "old" {
+			t.Fatalf("migrating with %v got %v, want status %g", refused.f, reply, refused.status)
+		}
+	}
+
+	// a notification waiting for the old UAID follows it
+	uaidMigrations = make(chan uaidMigration, 1)
+	redeliverChan = make(chan string, 1)
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	gServerState.Lock()
+	delete(gServerState.ConnectedClients, "old")
+	gServerState.Unlock()
+	notifications <- Notification{UAID: "old", Channel: &Channel{UAID: "old", ChannelID: "a", Version: 3}}
+	gServerState.Lock()
+	gServerState.ConnectedClients["old"] = client
+	gServerState.Unlock()
+
+	handleMigrate(client, map[string]interface{}{"newUAID": "new", "token": token})
+	var notification map[string]interface{}
+	for i := 0; i < 2; i++ {
+		var message map[string]interface{}
+		json.Unmarshal([]byte(<-client.outgoing), &message)
+		if message["messageType"] == "migrate" {
+			reply = message
+		} else {
+			notification = message
+		}
+	}
+	if reply["status"] != 200.0 || reply["uaid"] != "new" || client.UAID != "new" {
+		t.Fatalf("migration got %v", reply)
+	}
+	if updates, _ := notification["updates"].([]interface{}); len(updates) != 1 || updates[0].(map[string]interface{})["uaid"] != "new" {
+		t.Fatalf("pending notification wasn't delivered after migrating: %v", notification)
+	}
+
+	gServerState.RLock()
+	defer gServerState.RUnlock()
+	checkIndices(t)
+	if _, ok := gServerState.UAIDToChannelIDs["old"]; ok {
+		t.Fatalf("old UAID still owns channels")
+	}
+	for channelID, version := range map[string]uint64{"a": 3, "b": 7} {
+		channel := gServerState.UAIDToChannelIDs["new"][channelID]
+		if channel == nil || channel.UAID != "new" || channel.Version != version {
+			t.Fatalf("channel %s after migration is %+v", channelID, channel)
+		}
+	}
+	if gServerState.ConnectedClients["new"] != client {
+		t.Fatalf("connection was not moved to the new UAID")
+	}
+}
+
+func TestThrottledChannelCoalescesNotifies(t *testing.T) {
+	setupTest(t)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.attached = true
+	gServerState.ConnectedClients["uaid"] = client
+	handleRegister(client, map[string]interface{}{"channelID": "chan", "minInterval": 0.2})
+	<-client.outgoing
+
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	notify := func(version uint64) {
+		notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: version}}
+	}
+
+	receive := func(timeout time.Duration) *Channel {
+		select {
+		case message := <-client.outgoing:
+			var n struct{ Updates []Channel }
+			json.Unmarshal([]byte(message), &n)
+			return &n.Updates[0]
+		case <-time.After(timeout):
+			return nil
+		}
+	}
+
+	notify(1)
+	if got := receive(100 * time.Millisecond); got == nil || got.Version != 1 {
+		t.Fatalf("first notify delivered %v", got)
+	}
+
+	// two more within the interval make one delivery of the latest
+	notify(2)
+	notify(3)
+	if got := receive(100 * time.Millisecond); got != nil {
+		t.Fatalf("version %d was delivered within the interval", got.Version)
+	}
+	if got := receive(300 * time.Millisecond); got == nil || got.Version != 3 {
+		t.Fatalf("after the interval got %v, want version 3", got)
+	}
+	if got := receive(300 * time.Millisecond); got != nil {
+		t.Fatalf("coalesced notifies were delivered again as version %d", got.Version)
+	}
+}
+
+func TestWakeupPayloadAndPort(t *testing.T) {
+	setupTest(t)
+	gWakeupPayload, _ = parseWakeupPayload(`{"uaid":"{{.UAID}}","channelID":"{{.ChannelID}}"}`)
+
+	listener, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	gServerConfig.WakeupPort = listener.LocalAddr().(*net.UDPAddr).Port
+
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.Ip = "127.0.0.1"
+	// overridden by WakeupPort
+	client.Port = 1
+	if err := wakeupClient(client, "chan"); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, 100)
+	listener.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := listener.ReadFromUDP(buf)
+	if want := `{"uaid":"uaid","channelID":"chan"}`; err != nil || string(buf[:n]) != want {
+		t.Fatalf("wakeup sent %q, %v; want %q", buf[:n], err, want)
+	}
+
+	for _, ip := range []string{"", "push.example.com", "0.0.0.0", "::1"} {
+		client.Ip = ip
+		if err := wakeupClient(client, "chan"); err == nil {
+			t.Fatalf("woke up client at bad address %q", ip)
+		}
+	}
+}
+
+func TestWakeupHostportIsChecked(t *testing.T) {
+	for _, test := range []struct {
+		ip       string
+		port     float64
+		allow    bool
+		disabled bool
+		kept     bool
+	}{
+		{"10.0.0.1", 5000, false, false, true},
+		{"10.0.0.2", 5000, false, false, false},
+		{"10.0.0.2", 5000, true, false, false},
+		{"127.0.0.1", 5000, true, false, false},
+		{"169.254.0.1", 5000, true, false, false},
+		{"203.0.113.5", 5000, true, false, true},
+		{"10.0.0.1", 5000, true, false, true},
+		{"224.0.0.1", 5000, true, false, false},
+		{"255.255.255.255", 5000, true, false, false},
+		{"10.0.0.1", 0, false, false, false},
+		{"10.0.0.1", 70000, false, false, false},
+		{"10.0.0.1", 5000, false, true, false},
+	} {
+		setupTest(t)
+		gServerConfig.AllowForeignWakeupIP = test.allow
+		gServerConfig.DisableUDPWakeup = test.disabled
+
+		client := newClient(nil)
+		client.RemoteAddr = "10.0.0.1:40000"
+		handleHello(client, map[string]interface{}{"uaid": "uaid",
+			"wakeup_hostport": map[string]interface{}{"ip": test.ip, "port": test.port}})
+		if hello := receiveFields(t, client); string(hello["status"]) != "200" {
+			t.Fatalf("hello with wakeup address %s:%g was refused: %s", test.ip, test.port, hello["status"])
+		}
+		if kept := client.Ip != ""; kept != test.kept {
+			t.Fatalf("wakeup address %s:%g from 10.0.0.1 (allow %v, disabled %v) kept %v",
+				test.ip, test.port, test.allow, test.disabled, kept)
+		}
+	}
+
+	// with wakeups off there's nothing wrong with the hello to warn about
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+	gServerConfig.DisableUDPWakeup = true
+	client := newClient(nil)
+	handleHello(client, map[string]interface{}{"uaid": "uaid",
+		"wakeup_hostport": map[string]interface{}{"ip": "192.0.2.1", "port": 5000}})
+	receiveFields(t, client)
+	if strings.Contains(buf.String(), "wakeup_hostport_ignored") {
+		t.Fatalf("hello with UDP wakeups disabled logged %q", buf.String())
+	}
+
+	client = newClient(nil)
+	client.Ip, client.Port = "127.0.0.1", 9
+	if err := wakeupClient(client, "chan"); err == nil {
+		t.Fatalf("woke up a client with UDP wakeups disabled")
+	}
+}
+
+func TestFailingWakeupsBackOff(t *testing.T) {
+	setupTest(t)
+	gServerConfig.WakeupRetryBackoff = 0.02
+	gServerConfig.MaxWakeupFailures = 3
+	startWakeups()
+
+	attempts := make(chan time.Time, 10)
+	wakeup = func(client *Client, channelID string) error {
+		attempts <- time.Now()
+		return errors.New("no such host")
+	}
+	defer func() { wakeup = wakeupClient }()
+
+	client := newClient(nil)
+	client.UAID = "uaid"
+	abandoned := wakeupsAbandoned.Value()
+	deadline := time.Now().Add(500 * time.Millisecond)
+	for time.Now().Before(deadline) {
+		requestWakeup(client, "chan")
+		time.Sleep(time.Millisecond)
+	}
+
+	if len(attempts) != 3 {
+		t.Fatalf("failing client was woken %d times, want 3", len(attempts))
+	}
+	first, second, third := <-attempts, <-attempts, <-attempts
+	if second.Sub(first) < 20*time.Millisecond || third.Sub(second) < 40*time.Millisecond {
+		t.Fatalf("wakeups %s and %s apart didn't back off", second.Sub(first), third.Sub(second))
+	}
+	if wakeupsAbandoned.Value() != abandoned+1 {
+		t.Fatalf("giving up on the client was not counted")
+	}
+}
+
+func TestStrictChannelWaitsForAck(t *testing.T) {
+	setupTest(t)
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.attached = true
+	gServerState.ConnectedClients["uaid"] = client
+	handleRegister(client, map[string]interface{}{"channelID": "chan", "strict": true})
+	<-client.outgoing
+
+	notifications := make(chan Notification)
+	acks := make(chan []Ack)
+	pendingDumps = make(chan chan []pendingInfo)
+	startTestDelivery(t, notifications, acks)
+
+	// what the client was sent, once the loop is done with everything
+	// before
+	sent := func() []uint64 {
+		reply := make(chan []pendingInfo, 1)
+		pendingDumps <- reply
+		<-reply
+		var versions []uint64
+		for len(client.outgoing) > 0 {
+			var n struct{ Updates []Channel }
+			json.Unmarshal([]byte(<-client.outgoing), &n)
+			versions = append(versions, n.Updates[0].Version)
+		}
+		return versions
+	}
+
+	for version := uint64(1); version <= 2; version++ {
+		notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: version}}
+	}
+	if got := sent(); fmt.Sprint(got) != "[1]" {
+		t.Fatalf("strict channel first delivered %v, want just version 1", got)
+	}
+
+	acks <- []Ack{{ChannelID: "chan", Version: 1}}
+	if got := sent(); fmt.Sprint(got) != "[2]" {
+		t.Fatalf("after the ack got %v, want version 2", got)
+	}
+}
+
+func TestStrictVersionsAreCappedAndKept(t *testing.T) {
+	setupTest(t)
+	gServerConfig.StrictQueueLimit = 2
+	client := newClient(nil)
+	client.UAID = "uaid"
+	client.attached = true
+	gServerState.ConnectedClients["uaid"] = client
+	handleRegister(client, map[string]interface{}{"channelID": "chan", "strict": true})
+	<-client.outgoing
+
+	notifications := make(chan Notification)
+	pendingDumps = make(chan chan []pendingInfo)
+	pendingSnapshots = make(chan chan []Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	dropped := strictVersionsDropped.Value()
+	for version := uint64(1); version <= 4; version++ {
+		notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: version}}
+	}
+	reply := make(chan []pendingInfo, 1)
+	pendingDumps <- reply
+	dump := <-reply
+	if strictVersionsDropped.Value() != dropped+1 {
+		t.Fatalf("dropping version 2 past the limit was not counted")
+	}
+	if len(dump) != 3 || dump[0].Version != 1 || dump[0].Strict != "inFlight" ||
+		dump[1].Version != 3 || dump[1].Strict != "waiting" || dump[2].Version != 4 {
+		t.Fatalf("dumped %+v, want 1 in flight and 3 and 4 waiting", dump)
+	}
+
+	// all three outlive a restart, at the versions they were
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := savePendingNotifications(snapshotPending(ctx)); err != nil {
+		t.Fatal(err)
+	}
+	gServerState.ChannelIDToChannel["chan"].Version = 4
+	restarted := make(chan Notification, 3)
+	notifyChan = restarted
+	loadPendingNotifications()
+	close(restarted)
+	var versions []uint64
+	for notification := range restarted {
+		versions = append(versions, notification.Channel.Version)
+	}
+	if fmt.Sprint(versions) != "[1 3 4]" {
+		t.Fatalf("requeued versions %v, want [1 3 4]", versions)
+	}
+}
+
+func TestStrictAckTimeoutIsCounted(t *testing.T) {
+	setupTest(t)
+	gServerConfig.StrictAckTimeout = 0.01
+	gServerConfig.RedeliverySweepInterval = 0.01
+	addTestChannel("uaid", "chan", 1)
+	gServerState.StrictChannels["chan"] = true
+
+	notifications := make(chan Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	timedOut := strictAcksTimedOut.Value()
+	notifications <- Notification{UAID: "uaid", Channel: &Channel{UAID: "uaid", ChannelID: "chan", Version: 1}}
+
+	deadline := time.Now().Add(time.Second)
+	for strictAcksTimedOut.Value() == timedOut && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if strictAcksTimedOut.Value() != timedOut+1 {
+		t.Fatalf("the overdue ack was not counted")
+	}
+}
+
+func TestConcurrentTrafficIsSafe(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	notifyChan = make(chan Notification)
+	startTestDelivery(t, notifyChan, make(chan []Ack))
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		uaid := fmt.Sprint("uaid", i)
+		client := attachClient(uaid)
+		defer detachClient(client)
+		go func() {
+			for {
+				select {
+				case <-client.outgoing:
+				case <-client.done:
+					return
+				}
+			}
+		}()
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				channelID := fmt.Sprint(uaid, "-", j)
+				handleRegister(client, map[string]interface{}{"channelID": channelID})
+				r := httptest.NewRequest("PUT", "/notify/"+channelID, nil)
+				notifyHandler(httptest.NewRecorder(), r)
+				saveState()
+				admin(httptest.NewRecorder(), adminRequest("GET", "/admin", "secret"))
+			}
+		}()
+	}
+	wg.Wait()
+
+	checkIndices(t)
+	if len(gServerState.ChannelIDToChannel) != 8*20 {
+		t.Fatalf("%d channels were registered, want %d", len(gServerState.ChannelIDToChannel), 8*20)
+	}
+}
+
+func TestBatchedAckClearsEveryChannel(t *testing.T) {
+	setupTest(t)
+	a := addTestChannel("uaid", "a", 1)
+	b := addTestChannel("uaid", "b", 1)
+	client := attachClient("uaid")
+	defer detachClient(client)
+	// made after attaching, so that the redelivery attaching asks
+	// for can't send a third copy
+	redeliverChan = make(chan string, 1)
+
+	notifyChan = make(chan Notification)
+	ackChan = make(chan []Ack)
+	startTestDelivery(t, notifyChan, ackChan)
+
+	if err := deliverChannels([]*Channel{a, b}, []Channel{*a, *b}, []uint64{1, 1}); err != nil {
+		t.Fatal(err)
+	}
+	<-client.outgoing
+	<-client.outgoing
+
+	handleAck(client, map[string]interface{}{"updates": []interface{}{
+		map[string]interface{}{"channelID": "a", "version": 1.0},
+		map[string]interface{}{"channelID": "b", "version": 1.0},
+	}})
+
+	requestRedelivery("uaid")
+	select {
+	case message := <-client.outgoing:
+		t.Fatalf("acked notification was delivered again: %s", message)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestFailedSaveKeepsOldState(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "chan", 1)
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat("serverstate.json.tmp"); err == nil {
+		t.Fatalf("save left its temporary file behind")
+	}
+
+	// make the next save fail halfway
+	os.Mkdir("serverstate.json.tmp", 0755)
+	addTestChannel("uaid", "other", 1)
+	if err := saveState(); err == nil {
+		t.Fatalf("save into a directory succeeded")
+	}
+
+	data, _ := ioutil.ReadFile("serverstate.json")
+	var saved ServerState
+	if err := json.Unmarshal(data, &saved); err != nil {
+		t.Fatalf("failed save damaged the state: %s", err)
+	}
+	if len(saved.ChannelIDToChannel) != 1 {
+		t.Fatalf("state has %d channels after a failed save, want 1", len(saved.ChannelIDToChannel))
+	}
+}
+
+func TestOldConnectionsAreClosed(t *testing.T) {
+	setupTest(t)
+	gServerConfig.MaxConnectionAge = 0.2
+
+	server := startTestServer(t)
+	conn, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var read bytes.Buffer
+	config, _ := websocket.NewConfig(strings.Replace(server.URL, "http://", "ws://", 1), server.URL)
+	ws, err := websocket.NewClient(config, recordingConn{conn, &read})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if status := hello(t, ws, "uaid"); status != 200 {
+		t.Fatalf("hello got status %g", status)
+	}
+
+	start := time.Now()
+	var msg string
+	ws.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if err := websocket.Message.Receive(ws, &msg); err == nil || strings.Contains(err.Error(), "timeout") {
+		t.Fatalf("old connection was not closed: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("old connection was closed after %s", elapsed)
+	}
+
+	closeFrame := []byte{0x88, 2, closeReconnect >> 8, closeReconnect & 0xff}
+	if !bytes.Contains(read.Bytes(), closeFrame) {
+		t.Fatalf("old connection was not closed with the reconnect status")
+	}
+}
+
+func TestAbruptDisconnectsDontLeakGoroutines(t *testing.T) {
+	const connections = 20
+	setupTest(t)
+
+	server := startTestServer(t)
+
+	config, _ := websocket.NewConfig(strings.Replace(server.URL, "http://", "ws://", 1), server.URL)
+	for i := 0; i < connections; i++ {
+		conn, err := net.Dial("tcp", server.Listener.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		ws, err := websocket.NewClient(config, conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status := hello(t, ws, fmt.Sprintf("uaid%d", i)); status != 200 {
+			t.Fatalf("hello got status %g", status)
+		}
+		if i%2 == 0 {
+			// an ack without updates, which is rejected
+			websocket.JSON.Send(ws, map[string]interface{}{"messageType": "ack"})
+		}
+		// hang up without a close frame
+		conn.Close()
+	}
+
+	// a handler only returns once its writer has, so none running
+	// means nothing was left behind
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&testHandlersRunning) > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := atomic.LoadInt32(&testHandlersRunning); n > 0 {
+		t.Fatalf("%d handlers left behind by closed connections", n)
+	}
+
+	gServerState.RLock()
+	defer gServerState.RUnlock()
+	for uaid, client := range gServerState.ConnectedClients {
+		if client.Websocket != nil {
+			t.Fatalf("closed connection left %s with a websocket", uaid)
+		}
+	}
+}
+
+func TestUnansweredPingsCloseConnection(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PingInterval = 0.02
+	gServerConfig.PongTimeout = 0.05
+
+	server := startTestServer(t)
+	alive := dialTestServer(t, server)
+	defer alive.Close()
+	silent := dialTestServer(t, server)
+	defer silent.Close()
+	hello(t, alive, "alive")
+	hello(t, silent, "silent")
+
+	// reading is what answers pings, which silent never does again
+	go func() {
+		var msg string
+		for websocket.Message.Receive(alive, &msg) == nil {
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+	reapConnections(time.Now())
+
+	gServerState.RLock()
+	aliveOpen := gServerState.ConnectedClients["alive"].Websocket != nil
+	silentOpen := gServerState.ConnectedClients["silent"].Websocket != nil
+	gServerState.RUnlock()
+	if !aliveOpen {
+		t.Fatalf("connection answering pings was closed")
+	}
+	if silentOpen {
+		t.Fatalf("connection not answering pings was left open")
+	}
+	if !isClosed(silent) {
+		t.Fatalf("silent client's socket is still open")
+	}
+}
+
+func TestReaperToleratesMissingClients(t *testing.T) {
+	setupTest(t)
+	gServerConfig.PingInterval = 0.01
+	gServerState.ConnectedClients["ghost"] = nil
+
+	reapConnections(time.Now().Add(time.Hour))
+	if disconnectClient("ghost", closeWakeup, true) || disconnectClient("missing", closeWakeup, true) {
+		t.Fatalf("disconnected a client that isn't there")
+	}
+}
+
+func TestIdleConnectionsAreClosed(t *testing.T) {
+	setupTest(t)
+	gServerConfig.IdleTimeout = 0.1
+
+	server := startTestServer(t)
+	quiet := dialTestServer(t, server)
+	defer quiet.Close()
+	wakeable := dialTestServer(t, server)
+	defer wakeable.Close()
+	hello(t, quiet, "quiet")
+	exchange(t, wakeable, map[string]interface{}{"messageType": "hello", "uaid": "wakeable",
+		"wakeup_hostport": map[string]interface{}{"ip": "127.0.0.1", "port": 9.0}})
+
+	for _, ws := range []*websocket.Conn{quiet, wakeable} {
+		closed := false
+		for i := 0; i < 10 && !closed; i++ {
+			closed = isClosed(ws)
+		}
+		if !closed {
+			t.Fatalf("idle connection was left open")
+		}
+	}
+
+	// the handlers clean up after the socket is closed
+	for i := 0; i < 100 && connectedClient("quiet") != nil; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if connectedClient("quiet") != nil {
+		t.Fatalf("idle client without a wakeup address was kept")
+	}
+	if connectedClient("wakeable") == nil {
+		t.Fatalf("idle client with a wakeup address was forgotten")
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"go.net/websocket"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// On SIGINT or SIGTERM the server stops taking requests, sends its
+// websocket clients away with a close frame, keeps the notifications
+// still awaiting an ack in pendingFilename, next to the state file, to
+// deliver once it's back, and saves the state before exiting.
+
+var gHTTPServer = &http.Server{}
+
+const pendingFilename = "pending.json"
+
+func pendingPath() string {
+	return filepath.Join(filepath.Dir(stateFilename()), pendingFilename)
+}
+
+const closeGoingAway = 1001
+
+// The delivery loop answers with its pending notifications
+var pendingSnapshots chan chan []Notification
+
+func gracefulShutdown() {
+	timeout := configDuration(gServerConfig.ShutdownTimeout)
+	if timeout <= 0 {
+		timeout = 5 * time.Second
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	// websockets and polls are hijacked or long-lived, so this
+	// doesn't wait for them
+	if err := gHTTPServer.Shutdown(ctx); err != nil {
+		log.Println("Requests still running at shutdown: ", err)
+	}
+	if gServerConfig.ListenNetwork == "unix" {
+		// closing the listener removes the socket file, unless
+		// we got here before it was opened
+		os.Remove(gServerConfig.ListenAddress)
+	}
+	closeWebsockets(closeGoingAway)
+
+	if isReady() {
+		if err := savePendingNotifications(snapshotPending(ctx)); err != nil {
+			log.Println("Could not save pending notifications ", err)
+		}
+	}
+	shutdown(0)
+}
+
+// Close every client's websocket with status
+func closeWebsockets(status int) {
+	var sockets []*websocket.Conn
+	gServerState.RLock()
+	for _, client := range gServerState.ConnectedClients {
+		if client.Websocket != nil {
+			sockets = append(sockets, client.Websocket)
+		}
+	}
+	gServerState.RUnlock()
+
+	timeout := writeTimeout()
+	for _, ws := range sockets {
+		closeClientSocket(ws, status, timeout)
+	}
+}
+
+// The delivery loop's pending notifications, or nil if it doesn't
+// answer before ctx is done
+func snapshotPending(ctx context.Context) []Notification {
+	reply := make(chan []Notification, 1)
+	select {
+	case pendingSnapshots <- reply:
+	case <-ctx.Done():
+		return nil
+	}
+	select {
+	case pending := <-reply:
+		return pending
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func savePendingNotifications(pending []Notification) error {
+	if len(pending) == 0 {
+		return nil
+	}
+	data, err := json.Marshal(pending)
+	if err != nil {
+		return err
+	}
+	log.Println("Saving ", len(pending), " pending notifications")
+	return replaceFile(pendingPath(), data)
+}
+
+// Queue the notifications left pending by the last shutdown again.
+// The delivery loop must be running.
+func loadPendingNotifications() {
+	data, err := ioutil.ReadFile(pendingPath())
+	if os.IsNotExist(err) {
+		return
+	} else if err != nil {
+		log.Println("Could not read pending notifications ", err)
+		return
+	}
+
+	var pending []Notification
+	if err = json.Unmarshal(data, &pending); err != nil {
+		log.Println("Dropping pending notifications ", err)
+	}
+
+	var notifications []Notification
+	gServerState.RLock()
+	for _, saved := range pending {
+		if saved.Channel == nil {
+			continue
+		}
+		// channels unregistered since are left out, and the
+		// rest go out at the version they are at now, except
+		// for strict channels, whose every version is sent
+		channel, ok := gServerState.ChannelIDToChannel[saved.Channel.ChannelID]
+		if !ok || channel.UAID != saved.UAID {
+			continue
+		}
+		snapshot := *channel
+		if gServerState.StrictChannels[channel.ChannelID] && saved.Channel.Version <= channel.Version {
+			snapshot = *saved.Channel
+		}
+		notifications = append(notifications, Notification{UAID: snapshot.UAID, Channel: &snapshot})
+	}
+	gServerState.RUnlock()
+
+	for _, notification := range notifications {
+		notifyChan <- notification
+	}
+	log.Println("Queued ", len(notifications), " notifications left pending at shutdown")
+	os.Remove(pendingPath())
+}
+
+// Write out what hasn't been saved or logged yet, and exit
+func shutdown(code int) {
+	stopStateWriter()
+	stopAudit()
+	os.Exit(code)
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestPendingNotificationsOutliveShutdown(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "kept", 1)
+	addTestChannel("uaid", "gone", 1)
+
+	notifications := make(chan Notification)
+	pendingSnapshots = make(chan chan []Notification)
+	startTestDelivery(t, notifications, make(chan []Ack))
+	for _, channelID := range []string{"kept", "gone"} {
+		snapshot := *gServerState.ChannelIDToChannel[channelID]
+		notifications <- Notification{UAID: "uaid", Channel: &snapshot}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	pending := snapshotPending(ctx)
+	if len(pending) != 2 {
+		t.Fatalf("got %d pending notifications, want 2", len(pending))
+	}
+	if err := savePendingNotifications(pending); err != nil {
+		t.Fatal(err)
+	}
+
+	// while the server was down, one channel went away and the
+	// other one moved on
+	delete(gServerState.UAIDToChannelIDs["uaid"], "gone")
+	delete(gServerState.ChannelIDToChannel, "gone")
+	gServerState.ChannelIDToChannel["kept"].Version = 2
+
+	notifyChan = make(chan Notification, 2)
+	loadPendingNotifications()
+	close(notifyChan)
+	var queued []Notification
+	for notification := range notifyChan {
+		queued = append(queued, notification)
+	}
+	if len(queued) != 1 || queued[0].Channel.ChannelID != "kept" || queued[0].Channel.Version != 2 {
+		t.Fatalf("requeued %v, want kept at version 2", queued)
+	}
+	if _, err := os.Stat(pendingFilename); !os.IsNotExist(err) {
+		t.Fatalf("pending notifications were left behind to be queued again")
+	}
+}
+
+func TestShutdownClosesWebsockets(t *testing.T) {
+	setupTest(t)
+	server := startTestServer(t)
+	ws := dialTestServer(t, server)
+	defer ws.Close()
+	hello(t, ws, "uaid")
+
+	closeWebsockets(closeGoingAway)
+	if !isClosed(ws) {
+		t.Fatalf("websocket was left open")
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Websocket handlers don't save the state themselves, which would mean
+// encoding and writing all of it for every message. They mark it dirty
+// instead, and the state writer saves it at most once every
+// SaveInterval, and once more on the way out.
+
+var gStateDirty int32
+
+var stateWriterStop chan bool
+var stateWriterDone chan bool
+
+func markStateDirty() {
+	atomic.StoreInt32(&gStateDirty, 1)
+}
+
+func startStateWriter() {
+	interval := configDuration(gServerConfig.SaveInterval)
+	if interval <= 0 {
+		interval = time.Second
+	}
+
+	stateWriterStop = make(chan bool)
+	stateWriterDone = make(chan bool)
+	go stateWriter(interval, stateWriterStop, stateWriterDone)
+}
+
+// Save whatever is still dirty and stop the state writer
+func stopStateWriter() {
+	if stateWriterStop == nil {
+		return
+	}
+	close(stateWriterStop)
+	<-stateWriterDone
+	stateWriterStop = nil
+}
+
+func stateWriter(interval time.Duration, stop, done chan bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			saveIfDirty()
+		case <-stop:
+			saveIfDirty()
+			close(done)
+			return
+		}
+	}
+}
+
+func saveIfDirty() {
+	if atomic.SwapInt32(&gStateDirty, 0) == 0 {
+		return
+	}
+	if err := storeState(); err != nil {
+		log.Println("Will try saving the state again later")
+		markStateDirty()
+	}
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStateWriterCoalescesSaves(t *testing.T) {
+	setupTest(t)
+	gServerConfig.SaveInterval = 0.05
+	atomic.StoreInt32(&gStateDirty, 0)
+
+	var saves int32
+	storeState = func() error {
+		atomic.AddInt32(&saves, 1)
+		return nil
+	}
+	defer func() { storeState = saveState }()
+
+	startStateWriter()
+	defer stopStateWriter()
+
+	for i := 0; i < 100; i++ {
+		markStateDirty()
+	}
+	time.Sleep(150 * time.Millisecond)
+	if n := atomic.LoadInt32(&saves); n != 1 {
+		t.Fatalf("100 changes were saved %d times, want once", n)
+	}
+
+	markStateDirty()
+	stopStateWriter()
+	if n := atomic.LoadInt32(&saves); n != 2 {
+		t.Fatalf("stopping the state writer did not save the last change")
+	}
+}
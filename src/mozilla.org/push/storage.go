@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Where the server state is kept between runs. Backends take the
+// state's read lock themselves while they read it, so that they can
+// do their I/O without it; Load is called with the lock held.
+type Storage interface {
+	// Fill in state from storage, or return errNoSavedState
+	Load(state *ServerState) error
+	Save(state *ServerState) error
+	// Save just the versions, data and update times of some channels
+	// of state, which is all a notify changes
+	PutChannels(state *ServerState, channels []*Channel) error
+	// Whether a save could go through now; cheap enough to call
+	// every second
+	Check() error
+}
+
+var errNoSavedState = errors.New("no saved state")
+
+// Keeps the state in a local file, in JSON or, if Format is "gob", in
+// gob. New channel versions are appended to a journal next to it, one
+// JSON channel per line, instead of rewriting the whole file; the
+// journal is replayed on load and trimmed by the next full save.
+type FileStorage struct {
+	Filename string
+	Format   string
+
+	journalLock sync.Mutex
+	journal     *os.File
+}
+
+func (storage *FileStorage) journalName() string {
+	return storage.Filename + ".journal"
+}
+
+func (storage *FileStorage) Load(state *ServerState) error {
+	data, err := ioutil.ReadFile(storage.Filename)
+	if os.IsNotExist(err) {
+		return errNoSavedState
+	} else if err != nil {
+		return err
+	}
+
+	if bytes.HasPrefix(data, []byte(gobStateMagic)) {
+		if err = decodeGobState(state, data[len(gobStateMagic):]); err != nil {
+			return fmt.Errorf("could not decode %s: %v", storage.Filename, err)
+		}
+	} else if err = json.Unmarshal(data, state); err != nil {
+		log.Println("Could not unmarshal ", storage.Filename, ", recovering what we can: ", err)
+		recoverState(state, data)
+	}
+	return storage.replayJournal(state)
+}
+
+// Gob state files start with this, which JSON never does
+const gobStateMagic = "push-state/gob\n"
+
+// What goes into a gob state file. The channels are only kept once,
+// by UAID; ChannelIDToChannel is rebuilt from them on load.
+type gobState struct {
+	UAIDs              map[string][]Channel
+	TopicToUAIDs       map[string]map[string]bool
+	MinNotifyIntervals map[string]float64
+	StrictChannels     map[string]bool
+	History            map[string][]HistoryEntry
+}
+
+// Called with the state's read lock held
+func encodeGobState(state *ServerState) ([]byte, error) {
+	encoded := gobState{
+		UAIDs:              make(map[string][]Channel, len(state.UAIDToChannelIDs)),
+		TopicToUAIDs:       state.TopicToUAIDs,
+		MinNotifyIntervals: state.MinNotifyIntervals,
+		StrictChannels:     state.StrictChannels,
+		History:            state.History,
+	}
+	for uaid, set := range state.UAIDToChannelIDs {
+		channels := make([]Channel, 0, len(set))
+		for _, channel := range set {
+			if channel != nil {
+				channels = append(channels, *channel)
+			}
+		}
+		encoded.UAIDs[uaid] = channels
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString(gobStateMagic)
+	if err := gob.NewEncoder(&buf).Encode(&encoded); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeGobState(state *ServerState, data []byte) error {
+	var decoded gobState
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&decoded); err != nil {
+		return err
+	}
+
+	state.UAIDToChannelIDs = make(map[string]ChannelIDSet, len(decoded.UAIDs))
+	state.ChannelIDToChannel = make(ChannelIDSet)
+	for uaid, channels := range decoded.UAIDs {
+		state.UAIDToChannelIDs[uaid] = make(ChannelIDSet, len(channels))
+		for i := range channels {
+			state.addChannel(&channels[i])
+		}
+	}
+	state.TopicToUAIDs = decoded.TopicToUAIDs
+	state.MinNotifyIntervals = decoded.MinNotifyIntervals
+	state.StrictChannels = decoded.StrictChannels
+	state.History = decoded.History
+	return nil
+}
+
+func (storage *FileStorage) replayJournal(state *ServerState) error {
+	file, err := os.Open(storage.journalName())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var update Channel
+		if err := json.Unmarshal(scanner.Bytes(), &update); err != nil {
+			// most likely a line cut short by a crash
+			log.Println("Dropping journal entry ", scanner.Text(), ": ", err)
+			continue
+		}
+		// channels unregistered since are left out; the rest get
+		// everything a notify changes, not just the version
+		if channel, ok := state.ChannelIDToChannel[update.ChannelID]; ok && channel.UAID == update.UAID {
+			channel.Version = update.Version
+			channel.Data = update.Data
+			channel.Updated = update.Updated
+		}
+	}
+	return scanner.Err()
+}
+
+func (storage *FileStorage) Save(state *ServerState) error {
+	// Every journal entry written so far is for a version that is
+	// already in the state, so once it's saved they can go
+	storage.journalLock.Lock()
+	journaled, err := storage.journalSize()
+	storage.journalLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// only the encoding needs the lock, so connections carry on
+	// while the file is written
+	state.RLock()
+	var data []byte
+	if storage.Format == "gob" {
+		data, err = encodeGobState(state)
+	} else {
+		data, err = json.Marshal(state)
+	}
+	state.RUnlock()
+	if err != nil {
+		return fmt.Errorf("could not encode server state: %v", err)
+	}
+
+	if err = replaceFile(storage.Filename, data); err != nil {
+		return err
+	}
+	return storage.trimJournal(journaled)
+}
+
+func (storage *FileStorage) PutChannels(state *ServerState, channels []*Channel) error {
+	if len(channels) == 0 {
+		return nil
+	}
+
+	storage.journalLock.Lock()
+	defer storage.journalLock.Unlock()
+
+	// the versions are read with the journal locked, so that the
+	// journal never has a version after a newer one
+	var entries bytes.Buffer
+	state.RLock()
+	for _, channel := range channels {
+		j, err := json.Marshal(channel)
+		if err != nil {
+			state.RUnlock()
+			return err
+		}
+		entries.Write(j)
+		entries.WriteByte('\n')
+	}
+	state.RUnlock()
+
+	if storage.journal == nil {
+		file, err := os.OpenFile(storage.journalName(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		storage.journal = file
+	}
+	if _, err := storage.journal.Write(entries.Bytes()); err != nil {
+		return err
+	}
+	return storage.journal.Sync()
+}
+
+// The state file, or before the first save its directory, can be
+// written to
+func (storage *FileStorage) Check() error {
+	file, err := os.OpenFile(storage.Filename, os.O_WRONLY|os.O_APPEND, 0)
+	if os.IsNotExist(err) {
+		file, err = ioutil.TempFile(filepath.Dir(storage.Filename), ".check")
+		if err == nil {
+			defer os.Remove(file.Name())
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// Called with the journal locked
+func (storage *FileStorage) journalSize() (int64, error) {
+	info, err := os.Stat(storage.journalName())
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Drop the first n bytes of the journal
+func (storage *FileStorage) trimJournal(n int64) error {
+	if n == 0 {
+		return nil
+	}
+
+	storage.journalLock.Lock()
+	defer storage.journalLock.Unlock()
+
+	size, err := storage.journalSize()
+	if err != nil {
+		return err
+	}
+	if size == n {
+		// nothing was journaled during the save, which is
+		// the usual case
+		return os.Truncate(storage.journalName(), 0)
+	}
+
+	file, err := os.Open(storage.journalName())
+	if err != nil {
+		return err
+	}
+	rest, err := ioutil.ReadAll(io.NewSectionReader(file, n, size-n))
+	file.Close()
+	if err != nil {
+		return err
+	}
+	if storage.journal != nil {
+		storage.journal.Close()
+		storage.journal = nil
+	}
+	return replaceFile(storage.journalName(), rest)
+}
+
+// Write data to a temporary file, sync it and rename it over filename,
+// so that a crash in the middle leaves either the old file or the new
+// one, never half of one
+func replaceFile(filename string, data []byte) error {
+	tmp := filename + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp, filename)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
+
+var gStorage Storage = &FileStorage{Filename: "serverstate.json"}
+
+func stateFilename() string {
+	if gServerConfig.StateFilename == "" {
+		return "serverstate.json"
+	}
+	return gServerConfig.StateFilename
+}
+
+// Storage shared with other servers, which can look up the channels
+// they registered
+type channelLoader interface {
+	// Returns nil if there is no such channel
+	LoadChannel(channelID string) (*Channel, error)
+}
+
+// Storage that won't let a save take a channel back to an older
+// version, unless it's told which version it reverts
+type channelReverter interface {
+	// Save channels as they are now, over the versions in from
+	RevertChannels(state *ServerState, channels []*Channel, from []uint64) error
+}
+
+// Save channels that were reverted from the versions in from
+func revertSavedChannels(storage Storage, channels []*Channel, from []uint64) error {
+	if reverter, ok := storage.(channelReverter); ok {
+		return reverter.RevertChannels(&gServerState, channels, from)
+	}
+	// the journal is replayed in order, so this goes over them
+	return storage.PutChannels(&gServerState, channels)
+}
+
+// Find a channel another server registered in the shared storage, and
+// take it into our state. Returns the channel as it is in our state.
+func loadSharedChannel(channelID string) (*Channel, bool) {
+	loader, ok := gStorage.(channelLoader)
+	if !ok {
+		return nil, false
+	}
+	loaded, err := loader.LoadChannel(channelID)
+	if err != nil {
+		log.Println("Could not look up channel ", channelID, ": ", err)
+		return nil, false
+	} else if loaded == nil {
+		return nil, false
+	}
+
+	gServerState.Lock()
+	defer gServerState.Unlock()
+	if channel, ok := gServerState.ChannelIDToChannel[channelID]; ok {
+		// registered here while we were looking
+		return channel, true
+	}
+	gServerState.addChannel(loaded)
+	return loaded, true
+}
+
+// The storage backend named in the config
+func newStorage(name string) (Storage, error) {
+	switch name {
+	case "", "file":
+		switch gServerConfig.StateFormat {
+		case "", "json", "gob":
+		default:
+			return nil, fmt.Errorf("unknown state format %q", gServerConfig.StateFormat)
+		}
+		return &FileStorage{Filename: stateFilename(), Format: gServerConfig.StateFormat}, nil
+	case "redis":
+		if gServerConfig.RedisAddress == "" {
+			return nil, errors.New("redis storage needs a redisAddress")
+		}
+		return newRedisStorage(gServerConfig.RedisAddress, gServerConfig.RedisPassword), nil
+	}
+	return nil, fmt.Errorf("unknown storage %q", name)
+}
+
+func startStorage() {
+	storage, err := newStorage(gServerConfig.Storage)
+	if err != nil {
+		log.Println("Could not set up storage ", err)
+		os.Exit(-1)
+	}
+	gStorage = storage
+}
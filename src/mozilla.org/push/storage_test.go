@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestFileStorageRoundTrip(t *testing.T) {
+	setupTest(t)
+	storage := &FileStorage{Filename: "state.json"}
+
+	var state ServerState
+	if err := storage.Load(&state); err != errNoSavedState {
+		t.Fatalf("loading before any save got %v, want errNoSavedState", err)
+	}
+
+	addTestChannel("uaid", "chan", 7)
+	if err := storage.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if channel := state.ChannelIDToChannel["chan"]; channel == nil || *channel != (Channel{UAID: "uaid", ChannelID: "chan", Version: 7}) {
+		t.Fatalf("loaded channel %+v", channel)
+	}
+}
+
+func TestUnknownStorageIsRefused(t *testing.T) {
+	if _, err := newStorage("floppy"); err == nil {
+		t.Fatalf("unknown storage was accepted")
+	}
+	if storage, err := newStorage(""); err != nil || storage.(*FileStorage).Filename != "serverstate.json" {
+		t.Fatalf("default storage is %v, %v", storage, err)
+	}
+}
+
+func TestNotifyOnlyJournalsItsChannel(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "a", 1)
+	addTestChannel("uaid", "b", 5)
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	saved, _ := ioutil.ReadFile("serverstate.json")
+
+	if w, _ := notify(t, "a", "version=2"); w.Code != http.StatusOK {
+		t.Fatalf("notify got %d", w.Code)
+	}
+	if w, _ := notify(t, "a", "version=3&data=payload"); w.Code != http.StatusOK {
+		t.Fatalf("notify got %d", w.Code)
+	}
+	if data, _ := ioutil.ReadFile("serverstate.json"); !bytes.Equal(data, saved) {
+		t.Fatalf("notify rewrote the whole state")
+	}
+	journal, _ := ioutil.ReadFile("serverstate.json.journal")
+	if lines := strings.Count(string(journal), "\n"); lines != 2 {
+		t.Fatalf("journal has %d entries, want 2: %s", lines, journal)
+	}
+
+	// a fresh load picks the versions up from the journal
+	var state ServerState
+	if err := (&FileStorage{Filename: "serverstate.json"}).Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if a, b := state.ChannelIDToChannel["a"], state.ChannelIDToChannel["b"]; a.Version != 3 || b.Version != 5 {
+		t.Fatalf("loaded versions %d and %d, want 3 and 5", a.Version, b.Version)
+	}
+	if a := state.ChannelIDToChannel["a"]; a.Data != "payload" || a.Updated == 0 {
+		t.Fatalf("loaded %+v, want the journaled data and update time", a)
+	}
+
+	// and a full save leaves nothing to replay
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+	if journal, _ := ioutil.ReadFile("serverstate.json.journal"); len(journal) != 0 {
+		t.Fatalf("full save left the journal at %s", journal)
+	}
+}
+
+func TestSaveKeepsEntriesJournaledSinceItStarted(t *testing.T) {
+	setupTest(t)
+	storage := gStorage.(*FileStorage)
+	channel := addTestChannel("uaid", "chan", 1)
+	storage.PutChannels(&gServerState, []*Channel{channel})
+
+	journaled, _ := storage.journalSize()
+	channel.Version = 2
+	storage.PutChannels(&gServerState, []*Channel{channel})
+	if err := storage.trimJournal(journaled); err != nil {
+		t.Fatal(err)
+	}
+
+	journal, _ := ioutil.ReadFile("serverstate.json.journal")
+	if string(journal) != `{"uaid":"uaid","channelID":"chan","version":2}`+"\n" {
+		t.Fatalf("trimmed journal is %s", journal)
+	}
+	// and it can still be appended to
+	channel.Version = 3
+	if err := storage.PutChannels(&gServerState, []*Channel{channel}); err != nil {
+		t.Fatal(err)
+	}
+	if journal, _ = ioutil.ReadFile("serverstate.json.journal"); strings.Count(string(journal), "\n") != 2 {
+		t.Fatalf("journal after trimming is %s", journal)
+	}
+}
+
+// Notify latency shouldn't depend on how many channels there are
+func benchmarkNotify(b *testing.B, channels int) {
+	setupTest(b)
+	for i := 0; i < channels; i++ {
+		addTestChannel(fmt.Sprintf("uaid%d", i/10), fmt.Sprintf("chan%d", i), 1)
+	}
+	saveState()
+	notifyChan = make(chan Notification, 1)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		notifyHandler(w, httptest.NewRequest("PUT", "/notify/chan0", nil))
+		<-notifyChan
+	}
+}
+
+func BenchmarkNotify100Channels(b *testing.B) {
+	benchmarkNotify(b, 100)
+}
+
+func BenchmarkNotify10000Channels(b *testing.B) {
+	benchmarkNotify(b, 10000)
+}
+
+// Fill the state with channels for uaids UAIDs, ten each
+func populateState(uaids int) {
+	for i := 0; i < uaids*10; i++ {
+		uaid := fmt.Sprintf("uaid%d", i/10)
+		channelID := fmt.Sprintf("chan%d", i)
+		addTestChannel(uaid, channelID, uint64(i))
+		if i%3 == 0 {
+			gServerState.MinNotifyIntervals[channelID] = 1.5
+		}
+		if i%5 == 0 {
+			gServerState.StrictChannels[channelID] = true
+		}
+	}
+	gServerState.UAIDToChannelIDs["empty"] = make(ChannelIDSet)
+	gServerState.TopicToUAIDs["news"] = map[string]bool{"uaid0": true, "uaid1": true}
+}
+
+func TestGobStateRoundTrip(t *testing.T) {
+	setupTest(t)
+	populateState(20)
+	storage := &FileStorage{Filename: "state.gob", Format: "gob"}
+	if err := storage.Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+
+	var state ServerState
+	if err := storage.Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	for name, pair := range map[string][2]interface{}{
+		"uaidToChannels":     {state.UAIDToChannelIDs, gServerState.UAIDToChannelIDs},
+		"channelIDToChannel": {state.ChannelIDToChannel, gServerState.ChannelIDToChannel},
+		"topicToUAIDs":       {state.TopicToUAIDs, gServerState.TopicToUAIDs},
+		"minNotifyIntervals": {state.MinNotifyIntervals, gServerState.MinNotifyIntervals},
+		"strictChannels":     {state.StrictChannels, gServerState.StrictChannels},
+	} {
+		if !reflect.DeepEqual(pair[0], pair[1]) {
+			t.Fatalf("%s did not survive the round trip", name)
+		}
+	}
+	if state.ChannelIDToChannel["chan7"] != state.UAIDToChannelIDs["uaid0"]["chan7"] {
+		t.Fatalf("loaded maps don't share their channels")
+	}
+}
+
+func TestStateFormatIsDetectedOnLoad(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "chan", 7)
+	if err := (&FileStorage{Filename: "state.json"}).Save(&gServerState); err != nil {
+		t.Fatal(err)
+	}
+
+	// a server switched to gob still reads the JSON it saved before
+	var state ServerState
+	if err := (&FileStorage{Filename: "state.json", Format: "gob"}).Load(&state); err != nil {
+		t.Fatal(err)
+	}
+	if channel := state.ChannelIDToChannel["chan"]; channel == nil || channel.Version != 7 {
+		t.Fatalf("loaded channel %+v", channel)
+	}
+}
+
+func benchmarkStateFormat(b *testing.B, format string) {
+	setupTest(b)
+	populateState(10000)
+	storage := &FileStorage{Filename: "state", Format: format}
+
+	b.Run("Save", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if err := storage.Save(&gServerState); err != nil {
+				b.Fatal(err)
+			}
+		}
+		info, _ := os.Stat("state")
+		b.ReportMetric(float64(info.Size()), "bytes")
+	})
+	b.Run("Load", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var state ServerState
+			if err := storage.Load(&state); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkStateJSON(b *testing.B) {
+	benchmarkStateFormat(b, "json")
+}
+
+func BenchmarkStateGob(b *testing.B) {
+	benchmarkStateFormat(b, "gob")
+}
+
+func TestOpenStateKeepsChannelSettings(t *testing.T) {
+	setupTest(t)
+	addTestChannel("uaid", "chan", 1)
+	gServerState.MinNotifyIntervals["chan"] = 2
+	gServerState.StrictChannels["chan"] = true
+	if err := saveState(); err != nil {
+		t.Fatal(err)
+	}
+
+	openState()
+	if gServerState.MinNotifyIntervals["chan"] != 2 || !gServerState.StrictChannels["chan"] {
+		t.Fatalf("reopened state lost the channel's interval or strictness")
+	}
+}
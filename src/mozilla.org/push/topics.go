@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+)
+
+// Besides their channels, clients can subscribe to named topics shared
+// by everyone, such as "announcements". A broadcast to a topic is sent
+// to its subscribers that are connected at the time; it isn't stored
+// or retried, so offline subscribers miss it.
+
+func (state *ServerState) subscribe(uaid, topic string) {
+	if state.TopicToUAIDs[topic] == nil {
+		state.TopicToUAIDs[topic] = make(map[string]bool)
+	}
+	state.TopicToUAIDs[topic][uaid] = true
+}
+
+func (state *ServerState) unsubscribeAll(uaid string) {
+	for topic, uaids := range state.TopicToUAIDs {
+		delete(uaids, uaid)
+		if len(uaids) == 0 {
+			delete(state.TopicToUAIDs, topic)
+		}
+	}
+}
+
+func handleSubscribe(client *Client, f map[string]interface{}) {
+	type SubscribeResponse struct {
+		Name   string `json:"messageType"`
+		Status int    `json:"status"`
+		Topic  string `json:"topic"`
+	}
+
+	topic, _ := f["topic"].(string)
+	response := SubscribeResponse{"subscribe", 200, topic}
+	if topic == "" {
+		log.Println("topic is missing!")
+		response.Status = 400
+	} else {
+		gServerState.Lock()
+		gServerState.subscribe(client.UAID, topic)
+		gServerState.Unlock()
+		audit(client.UAID, "subscribe", topic)
+	}
+
+	j, err := json.Marshal(response)
+	if err != nil {
+		log.Println("Could not convert subscribe response to json ", err)
+		return
+	}
+
+	sendToClient(client, string(j))
+}
+
+// Send the posted body to every connected subscriber of the topic in
+// POST /admin/broadcast/{topic}
+func adminBroadcast(w http.ResponseWriter, r *http.Request) {
+	if !requirePost(w, r) || !adminAuthorized(w, r) {
+		return
+	}
+
+	topic := strings.TrimPrefix(r.URL.Path, "/admin/broadcast/")
+	if topic == "" || strings.Contains(topic, "/") {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Not found."))
+		return
+	}
+
+	data, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Could not read the broadcast."))
+		return
+	}
+
+	j, err := json.Marshal(struct {
+		Name  string `json:"messageType"`
+		Topic string `json:"topic"`
+		Data  string `json:"data"`
+	}{"broadcast", topic, string(data)})
+	if err != nil {
+		log.Println("Could not convert broadcast to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	audit("admin@"+r.RemoteAddr, "broadcast", topic)
+	var clients []*Client
+	gServerState.RLock()
+	for uaid := range gServerState.TopicToUAIDs[topic] {
+		client, ok := gServerState.ConnectedClients[uaid]
+		if ok && client.online() {
+			clients = append(clients, client)
+		}
+	}
+	gServerState.RUnlock()
+
+	delivered := 0
+	for _, client := range clients {
+		sendToClient(client, string(j))
+		delivered++
+	}
+	log.Println("Broadcast to ", topic, " reached ", delivered, " clients")
+
+	j, err = json.Marshal(struct {
+		Delivered int `json:"delivered"`
+	}{delivered})
+	if err != nil {
+		log.Println("Could not convert broadcast response to json ", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(j)
+}
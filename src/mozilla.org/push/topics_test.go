@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"go.net/websocket"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestBroadcastReachesOnlySubscribers(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+
+	subscriber := newClient(&websocket.Conn{})
+	subscriber.UAID = "subscriber"
+	bystander := newClient(&websocket.Conn{})
+	bystander.UAID = "bystander"
+	gServerState.ConnectedClients["subscriber"] = subscriber
+	gServerState.ConnectedClients["bystander"] = bystander
+
+	handleSubscribe(subscriber, map[string]interface{}{"topic": "announcements"})
+	var reply map[string]interface{}
+	json.Unmarshal([]byte(<-subscriber.outgoing), &reply)
+	if reply["status"] != 200.0 {
+		t.Fatalf("subscribe got %v", reply)
+	}
+
+	w := httptest.NewRecorder()
+	adminBroadcast(w, adminRequest("POST", "/admin/broadcast/announcements", "secret"))
+	if w.Code != http.StatusOK || w.Body.String() != `{"delivered":1}` {
+		t.Fatalf("broadcast got %d %s", w.Code, w.Body.String())
+	}
+
+	json.Unmarshal([]byte(<-subscriber.outgoing), &reply)
+	if reply["messageType"] != "broadcast" || reply["topic"] != "announcements" {
+		t.Fatalf("subscriber got %v", reply)
+	}
+	if len(bystander.outgoing) != 0 {
+		t.Fatalf("client that didn't subscribe got %s", <-bystander.outgoing)
+	}
+
+	// resetting a UAID drops its subscriptions
+	gServerState.removeUAID("subscriber")
+	if len(gServerState.TopicToUAIDs) != 0 {
+		t.Fatalf("topics left after removing the only subscriber: %v", gServerState.TopicToUAIDs)
+	}
+}
+
+func TestSubscribingTwiceBroadcastsOnce(t *testing.T) {
+	setupTest(t)
+	gServerConfig.AdminToken = "secret"
+	client := newClient(&websocket.Conn{})
+	client.UAID = "uaid"
+	gServerState.ConnectedClients["uaid"] = client
+
+	for i := 0; i < 2; i++ {
+		handleSubscribe(client, map[string]interface{}{"topic": "announcements"})
+		<-client.outgoing
+	}
+
+	w := httptest.NewRecorder()
+	adminBroadcast(w, adminRequest("POST", "/admin/broadcast/announcements", "secret"))
+	if w.Body.String() != `{"delivered":1}` || len(client.outgoing) != 1 {
+		t.Fatalf("broadcast got %s and sent %d messages, want 1", w.Body.String(), len(client.outgoing))
+	}
+}
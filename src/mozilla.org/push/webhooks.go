@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+// Connect and disconnect webhooks are delivered by a fixed pool of
+// workers, so a slow webhook receiver can never hold up the connection
+// handlers. When all the workers are busy and the queue is full, new
+// webhooks are dropped.
+
+type webhook struct {
+	URL   string `json:"-"`
+	Event string `json:"event"`
+	UAID  string `json:"uaid,omitempty"`
+	Time  int64  `json:"time"`
+}
+
+var webhookQueue chan webhook
+
+var webhooksSent = newCounter("push_webhooks_sent_total",
+	"Webhook requests that got a 2xx response")
+var webhooksFailed = newCounter("push_webhooks_failed_total",
+	"Webhook requests that failed or got a non-2xx response")
+var webhooksDropped = newCounter("push_webhooks_dropped_total",
+	"Webhooks dropped because the queue was full")
+
+func startWebhooks() {
+	workers := gServerConfig.WebhookWorkers
+	if workers <= 0 {
+		workers = 4
+	}
+	queueSize := gServerConfig.WebhookQueueSize
+	if queueSize <= 0 {
+		queueSize = 100
+	}
+
+	webhookQueue = make(chan webhook, queueSize)
+	for i := 0; i < workers; i++ {
+		go webhookWorker(webhookQueue)
+	}
+}
+
+// Queue a webhook without ever blocking the caller
+func fireWebhook(url, event, uaid string) {
+	if url == "" || webhookQueue == nil {
+		return
+	}
+
+	select {
+	case webhookQueue <- webhook{url, event, uaid, time.Now().Unix()}:
+	default:
+		log.Println("Webhook queue is full, dropping", event, "for", uaid)
+		webhooksDropped.Inc()
+	}
+}
+
+func webhookWorker(queue chan webhook) {
+	for hook := range queue {
+		body, err := json.Marshal(hook)
+		if err != nil {
+			log.Println("Could not convert webhook to json ", err)
+			continue
+		}
+
+		resp, err := outboundClient.Post(hook.URL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("Webhook error ", hook.URL, err)
+			webhooksFailed.Inc()
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode/100 != 2 {
+			log.Println("Webhook ", hook.URL, " returned ", resp.Status)
+			webhooksFailed.Inc()
+			continue
+		}
+		webhooksSent.Inc()
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookBurstIsBounded(t *testing.T) {
+	setupTest(t)
+	gServerConfig.WebhookWorkers = 2
+	gServerConfig.WebhookQueueSize = 3
+
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	release := make(chan struct{})
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+
+		<-release
+
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer receiver.Close()
+	defer close(release)
+
+	startWebhooks()
+	defer func() {
+		close(webhookQueue)
+		webhookQueue = nil
+	}()
+
+	dropped := webhooksDropped.Value()
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		fireWebhook(receiver.URL, "connect", "uaid")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Fatalf("firing webhooks blocked for %s", time.Since(start))
+	}
+
+	// two in flight and three queued; the rest are dropped
+	if n := webhooksDropped.Value() - dropped; n < 5 {
+		t.Fatalf("dropped %d webhooks, want at least 5", n)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	mu.Lock()
+	defer mu.Unlock()
+	if maxInFlight > 2 {
+		t.Fatalf("%d webhooks were in flight at once, want at most 2", maxInFlight)
+	}
+}